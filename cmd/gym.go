@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"os/exec"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,20 +31,110 @@ func main() {
 	nocolor := gymcmd.Bool(cli.BoolOpt{Name: "n nocolor", Desc: "disable color output"})
 	insecure := gymcmd.Bool(cli.BoolOpt{Name: "i insecure", Desc: "do not verify ssl certificates"})
 	workers := gymcmd.Int(cli.IntOpt{Name: "w workers", Value: numCPU, Desc: "number of parallel download workers"})
+	retries := gymcmd.Int(cli.IntOpt{Name: "retries", Value: 2, Desc: "maximum number of retries per download after the first attempt"})
+	retryDelay := gymcmd.String(cli.StringOpt{Name: "retry-delay", Value: "1s", Desc: "delay before the first retry, doubled for every further retry"})
+	retryMaxDelay := gymcmd.String(cli.StringOpt{Name: "retry-max-delay", Value: "30s", Desc: "maximum delay between two retries"})
+	retryJitter := gymcmd.Int(cli.IntOpt{Name: "retry-jitter", Value: 20, Desc: "random jitter in percent applied to retry delays"})
+	retryStatus := gymcmd.String(cli.StringOpt{Name: "retry-status", Value: "408,429,500,502,503,504", Desc: "comma separated list of http status codes to retry"})
+	retryErrors := gymcmd.String(cli.StringOpt{Name: "retry-errors", Value: "timeout,reset,refused,eof", Desc: "comma separated list of network errors to retry: timeout, reset, refused, eof, dns"})
 	gymcmd.Action = func() {
 	}
+	retryPolicy := func() gym.RetryPolicy {
+		p := gym.RetryPolicy{
+			Attempts: *retries + 1,
+			Jitter:   float64(*retryJitter) / 100,
+		}
+		var err error
+		if p.BaseDelay, err = time.ParseDuration(*retryDelay); err != nil {
+			gym.Log.Crit("invalid retry delay", "err", err, "duration", *retryDelay)
+		}
+		if p.MaxDelay, err = time.ParseDuration(*retryMaxDelay); err != nil {
+			gym.Log.Crit("invalid retry max delay", "err", err, "duration", *retryMaxDelay)
+		}
+		for _, s := range strings.Split(*retryStatus, ",") {
+			if len(s) == 0 {
+				continue
+			}
+			code, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				gym.Log.Crit("invalid retry status code", "err", err, "code", s)
+			}
+			p.StatusCodes = append(p.StatusCodes, code)
+		}
+		for _, s := range strings.Split(*retryErrors, ",") {
+			if len(s) > 0 {
+				p.NetErrors = append(p.NetErrors, strings.TrimSpace(s))
+			}
+		}
+		return p
+	}
+	// splitList splits a comma separated list, an empty string is an empty list
+	splitList := func(s string) []string {
+		list := []string{}
+		for _, e := range strings.Split(s, ",") {
+			if e = strings.TrimSpace(e); len(e) > 0 {
+				list = append(list, e)
+			}
+		}
+		return list
+	}
+	// keepNewest returns the number of versions to keep for --keep and --newest-only
+	keepNewest := func(keep int, newestOnly bool) int {
+		if newestOnly && keep == 0 {
+			return 1
+		}
+		return keep
+	}
+	// errataFilter returns the advisories selected by the --errata options
+	errataFilter := func(types, severities, ids, until string) gym.ErrataFilter {
+		f := gym.ErrataFilter{
+			Types:      splitList(types),
+			Severities: splitList(severities),
+			IDs:        splitList(ids),
+		}
+		if len(until) > 0 {
+			var err error
+			if f.IssuedUntil, err = time.Parse("2006-01-02", until); err != nil {
+				gym.Log.Crit("invalid errata date", "err", err, "date", until)
+			}
+		}
+		return f
+	}
 	gymcmd.Command("url", "sync repoository form url", func(cmd *cli.Cmd) {
-		cmd.Spec = "[--cert --key] [--cacerts] [-f] URL DESTINATION"
+		cmd.Spec = "[--cert --key] [--cacerts] [-f...] [--prune] [--dry-run] [--max-prune] [--gpgcheck] [--repo-gpgcheck] [--gpgkey] [--keyring] [--keep-unsigned] [--filter-meta] [--packages] [--keep | --newest-only] [--arches] [--exclude-arches] [--exclude-filter...] [--errata-type] [--errata-severity] [--errata-id] [--errata-until] [--modules] [--store] [--full] [--reverify] URL DESTINATION"
 
 		var (
-			filter  = cmd.String(cli.StringOpt{Name: "f filter", Desc: "sync only packages with names containing filter string"})
-			cert    = cmd.String(cli.StringOpt{Name: "cert", Desc: "spath to ssl certificate"})
-			key     = cmd.String(cli.StringOpt{Name: "key", Desc: "spath to ssl certificate key"})
-			cacerts = cmd.String(cli.StringOpt{Name: "cacerts", Desc: "comma separated list of ca certificates"})
+			filter         = cmd.Strings(cli.StringsOpt{Name: "f filter", Desc: "sync only packages matching one of the filter expressions e.g: 'kernel >= 5.14 and arch=x86_64', bare words match package locations containing the word"})
+			excludeFilter  = cmd.Strings(cli.StringsOpt{Name: "exclude-filter", Desc: "do not sync packages matching one of the filter expressions e.g: 'name=*-debuginfo' or 'size>100M'"})
+			cert           = cmd.String(cli.StringOpt{Name: "cert", Desc: "spath to ssl certificate"})
+			key            = cmd.String(cli.StringOpt{Name: "key", Desc: "spath to ssl certificate key"})
+			cacerts        = cmd.String(cli.StringOpt{Name: "cacerts", Desc: "comma separated list of ca certificates"})
+			prune          = cmd.Bool(cli.BoolOpt{Name: "prune", Desc: "delete local rpms no longer referenced by the repository metadata"})
+			dryRun         = cmd.Bool(cli.BoolOpt{Name: "dry-run", Desc: "only list the rpms prune would delete"})
+			maxPrune       = cmd.Int(cli.IntOpt{Name: "max-prune", Value: 10, Desc: "refuse to prune if more than this percentage of rpms would be deleted"})
+			gpgCheck       = cmd.Bool(cli.BoolOpt{Name: "gpgcheck", Desc: "verify the gpg signatures of downloaded rpms"})
+			repoGPGCheck   = cmd.Bool(cli.BoolOpt{Name: "repo-gpgcheck", Desc: "verify the gpg signature of repomd.xml"})
+			gpgKey         = cmd.String(cli.StringOpt{Name: "gpgkey", Desc: "comma separated list of gpg public key urls (file://, http:// or https://)"})
+			keyring        = cmd.String(cli.StringOpt{Name: "keyring", Desc: "directory with gpg public keys"})
+			keepUnsigned   = cmd.Bool(cli.BoolOpt{Name: "keep-unsigned", Desc: "keep rpms without signature or whose payload is not signed when gpgcheck is enabled"})
+			filterMeta     = cmd.Bool(cli.BoolOpt{Name: "filter-meta", Desc: "rewrite repodata to list only the rpms present locally"})
+			packages       = cmd.String(cli.StringOpt{Name: "packages", Desc: "comma separated list of package names or provides to sync with all their requires"})
+			keep           = cmd.Int(cli.IntOpt{Name: "keep", Desc: "sync only the newest N versions of each package and rewrite repodata accordingly"})
+			newestOnly     = cmd.Bool(cli.BoolOpt{Name: "newest-only", Desc: "sync only the newest version of each package, same as --keep 1"})
+			arches         = cmd.String(cli.StringOpt{Name: "arches", Desc: "comma separated list of architectures to sync e.g: x86_64,noarch"})
+			excludeArches  = cmd.String(cli.StringOpt{Name: "exclude-arches", Desc: "comma separated list of architectures not to sync e.g: i686,src"})
+			errataType     = cmd.String(cli.StringOpt{Name: "errata-type", Desc: "comma separated list of advisory types to sync e.g: security,bugfix,enhancement"})
+			errataSeverity = cmd.String(cli.StringOpt{Name: "errata-severity", Desc: "comma separated list of advisory severities to sync e.g: Critical,Important"})
+			errataID       = cmd.String(cli.StringOpt{Name: "errata-id", Desc: "comma separated list of advisory ids to sync, globs are supported e.g: RHSA-2026:*"})
+			errataUntil    = cmd.String(cli.StringOpt{Name: "errata-until", Desc: "sync only advisories issued on or before this date e.g: 2026-09-30"})
+			modules        = cmd.String(cli.StringOpt{Name: "modules", Desc: "comma separated list of module streams to sync, packages of other streams are skipped e.g: nginx:1.20,postgresql"})
+			store          = cmd.String(cli.StringOpt{Name: "store", Desc: "shared blob store directory, rpms are hardlinked from the store and downloaded only once"})
+			full           = cmd.Bool(cli.BoolOpt{Name: "full", Desc: "ignore the state of the last sync, download all metadata and verify all rpms"})
+			reverify       = cmd.Bool(cli.BoolOpt{Name: "reverify", Desc: "hash all local rpms, even if they are unchanged since their last verification"})
 		)
 
 		var (
-			urlString = cmd.String(cli.StringArg{Name: "URL", Value: "", Desc: "remote yum repository url"})
+			urlString = cmd.String(cli.StringArg{Name: "URL", Value: "", Desc: "remote yum repository url, mirrors can be added as comma separated list"})
 			dest      = cmd.String(cli.StringArg{Name: "DESTINATION", Value: "", Desc: "local destination directory"})
 		)
 
@@ -61,14 +153,38 @@ func main() {
 				"insecure", *insecure,
 				"meta", *meta,
 				"workers", *workers,
+				"retries", *retries,
 				"cert", *cert,
 				"key", *key,
 				"cacerts", *cacerts,
-				"filter", *filter,
+				"filter", strings.Join(*filter, ","),
+				"excludeFilter", strings.Join(*excludeFilter, ","),
+				"prune", *prune,
+				"dryRun", *dryRun,
+				"maxPrune", *maxPrune,
+				"gpgcheck", *gpgCheck,
+				"repoGPGCheck", *repoGPGCheck,
+				"gpgkey", *gpgKey,
+				"keyring", *keyring,
+				"keepUnsigned", *keepUnsigned,
+				"filterMeta", *filterMeta,
+				"packages", *packages,
+				"keep", keepNewest(*keep, *newestOnly),
+				"arches", *arches,
+				"excludeArches", *excludeArches,
+				"errataType", *errataType,
+				"errataSeverity", *errataSeverity,
+				"errataID", *errataID,
+				"errataUntil", *errataUntil,
+				"modules", *modules,
+				"store", *store,
+				"full", *full,
+				"reverify", *reverify,
 				"url", *urlString,
 				"destination", *dest,
 			)
-			u, err := url.Parse(*urlString)
+			urls := strings.Split(*urlString, ",")
+			u, err := url.Parse(urls[0])
 			if err != nil {
 				gym.Log.Crit("could not parse url '%s'", urlString)
 			}
@@ -84,7 +200,31 @@ func main() {
 			if err != nil {
 				gym.Log.Crit("invalid timout duration", "err", err, "duration", timeout)
 			}
-			r := gym.NewRepo(*dest, *urlString, t, to)
+			r := gym.NewRepo(*dest, urls, t, to)
+			r.Retry = retryPolicy()
+			r.GPGCheck = *gpgCheck
+			r.RepoGPGCheck = *repoGPGCheck
+			if len(*gpgKey) > 0 {
+				r.GPGKeys = strings.Split(*gpgKey, ",")
+			}
+			r.KeyringDir = *keyring
+			r.KeepUnsigned = *keepUnsigned
+			r.FilterMeta = *filterMeta
+			if len(*packages) > 0 {
+				r.Packages = strings.Split(*packages, ",")
+			}
+			r.KeepNewest = keepNewest(*keep, *newestOnly)
+			r.Arches = splitList(*arches)
+			r.ExcludeArches = splitList(*excludeArches)
+			r.Include = *filter
+			r.Exclude = *excludeFilter
+			r.Errata = errataFilter(*errataType, *errataSeverity, *errataID, *errataUntil)
+			r.Modules = splitList(*modules)
+			if len(*store) > 0 {
+				r.Store = gym.NewStore(*store)
+			}
+			r.FullSync = *full
+			r.Reverify = *reverify
 
 			gym.Log.Info("start metadata sync", "url", *urlString, "dest", *dest, "workers", *workers)
 			if err := r.SyncMeta(); err != nil {
@@ -94,24 +234,53 @@ func main() {
 			if *meta {
 				return
 			}
-			if err := r.Sync(*filter, *workers); err != nil {
+			if err := r.Sync("", *workers); err != nil {
 				gym.Log.Crit("rpm sync failed", "err", err)
 			}
+			if *prune || *dryRun {
+				if _, err := r.Prune(*maxPrune, *dryRun); err != nil {
+					gym.Log.Crit("prune failed", "err", err)
+				}
+			}
 		}
 	})
 	gymcmd.Command("repo", "sync repoository form yum repository file", func(cmd *cli.Cmd) {
 
-		cmd.Spec = "[([--exclude]  [--include] [--enabled]) | ([--repoid] [--name])] [--arch] [-f] -r REPOFILE DESTINATION"
+		cmd.Spec = "[([--exclude]  [--include] [--enabled]) | ([--repoid] [--name])] [--arch] [-f...] [--prune] [--dry-run] [--max-prune] [--gpgcheck] [--repo-gpgcheck] [--keyring] [--keep-unsigned] [--filter-meta] [--packages [--span-repos]] [--keep | --newest-only] [--arches] [--exclude-arches] [--exclude-filter...] [--ignore-excludes] [--errata-type] [--errata-severity] [--errata-id] [--errata-until] [--modules] [--store] [--full] [--reverify] -r REPOFILE DESTINATION"
 
 		var (
-			filter  = cmd.String(cli.StringOpt{Name: "f filter", Desc: "sync only packages with names containing filter string"})
-			exclude = cmd.String(cli.StringOpt{Name: "exclude", Desc: "exclude repositories containing this string"})
-			include = cmd.String(cli.StringOpt{Name: "include", Desc: "include repositories containing this string"})
-			enabled = cmd.Bool(cli.BoolOpt{Name: "enabled", Desc: "sync only enabled repositories"})
-			arch    = cmd.String(cli.StringOpt{Name: "arch", Value: "x86_64", Desc: "base architecture e.g: x86_64, PPC"})
-			release = cmd.String(cli.StringOpt{Name: "r release", Desc: "release version e.g: Server7, 7.1"})
-			repoid  = cmd.String(cli.StringOpt{Name: "repoid", Desc: "only sync repository with name repoid"})
-			name    = cmd.String(cli.StringOpt{Name: "name", Desc: "use name instead of repoid as directory name"})
+			filter         = cmd.Strings(cli.StringsOpt{Name: "f filter", Desc: "sync only packages matching one of the filter expressions e.g: 'kernel >= 5.14 and arch=x86_64', bare words match package locations containing the word"})
+			excludeFilter  = cmd.Strings(cli.StringsOpt{Name: "exclude-filter", Desc: "do not sync packages matching one of the filter expressions e.g: 'name=*-debuginfo' or 'size>100M'"})
+			exclude        = cmd.String(cli.StringOpt{Name: "exclude", Desc: "exclude repositories containing this string"})
+			include        = cmd.String(cli.StringOpt{Name: "include", Desc: "include repositories containing this string"})
+			enabled        = cmd.Bool(cli.BoolOpt{Name: "enabled", Desc: "sync only enabled repositories"})
+			arch           = cmd.String(cli.StringOpt{Name: "arch", Value: "x86_64", Desc: "base architecture e.g: x86_64, PPC"})
+			release        = cmd.String(cli.StringOpt{Name: "r release", Desc: "release version e.g: Server7, 7.1"})
+			repoid         = cmd.String(cli.StringOpt{Name: "repoid", Desc: "only sync repository with name repoid"})
+			name           = cmd.String(cli.StringOpt{Name: "name", Desc: "use name instead of repoid as directory name"})
+			prune          = cmd.Bool(cli.BoolOpt{Name: "prune", Desc: "delete local rpms no longer referenced by the repository metadata"})
+			dryRun         = cmd.Bool(cli.BoolOpt{Name: "dry-run", Desc: "only list the rpms prune would delete"})
+			maxPrune       = cmd.Int(cli.IntOpt{Name: "max-prune", Value: 10, Desc: "refuse to prune if more than this percentage of rpms would be deleted"})
+			gpgCheck       = cmd.Bool(cli.BoolOpt{Name: "gpgcheck", Desc: "verify the gpg signatures of downloaded rpms for repositories with gpgcheck=1"})
+			repoGPGCheck   = cmd.Bool(cli.BoolOpt{Name: "repo-gpgcheck", Desc: "verify the gpg signature of repomd.xml for repositories with repo_gpgcheck=1"})
+			keyring        = cmd.String(cli.StringOpt{Name: "keyring", Desc: "directory with additional gpg public keys"})
+			keepUnsigned   = cmd.Bool(cli.BoolOpt{Name: "keep-unsigned", Desc: "keep rpms without signature or whose payload is not signed when gpgcheck is enabled"})
+			filterMeta     = cmd.Bool(cli.BoolOpt{Name: "filter-meta", Desc: "rewrite repodata to list only the rpms present locally"})
+			packages       = cmd.String(cli.StringOpt{Name: "packages", Desc: "comma separated list of package names or provides to sync with all their requires"})
+			spanRepos      = cmd.Bool(cli.BoolOpt{Name: "span-repos", Desc: "resolve the requires of packages across all synced repositories"})
+			keep           = cmd.Int(cli.IntOpt{Name: "keep", Desc: "sync only the newest N versions of each package and rewrite repodata accordingly"})
+			newestOnly     = cmd.Bool(cli.BoolOpt{Name: "newest-only", Desc: "sync only the newest version of each package, same as --keep 1"})
+			arches         = cmd.String(cli.StringOpt{Name: "arches", Desc: "comma separated list of architectures to sync e.g: x86_64,noarch"})
+			excludeArches  = cmd.String(cli.StringOpt{Name: "exclude-arches", Desc: "comma separated list of architectures not to sync e.g: i686,src"})
+			errataType     = cmd.String(cli.StringOpt{Name: "errata-type", Desc: "comma separated list of advisory types to sync e.g: security,bugfix,enhancement"})
+			errataSeverity = cmd.String(cli.StringOpt{Name: "errata-severity", Desc: "comma separated list of advisory severities to sync e.g: Critical,Important"})
+			errataID       = cmd.String(cli.StringOpt{Name: "errata-id", Desc: "comma separated list of advisory ids to sync, globs are supported e.g: RHSA-2026:*"})
+			errataUntil    = cmd.String(cli.StringOpt{Name: "errata-until", Desc: "sync only advisories issued on or before this date e.g: 2026-09-30"})
+			modules        = cmd.String(cli.StringOpt{Name: "modules", Desc: "comma separated list of module streams to sync, packages of other streams are skipped e.g: nginx:1.20,postgresql"})
+			store          = cmd.String(cli.StringOpt{Name: "store", Desc: "shared blob store directory, rpms are hardlinked from the store and downloaded only once"})
+			full           = cmd.Bool(cli.BoolOpt{Name: "full", Desc: "ignore the state of the last sync, download all metadata and verify all rpms"})
+			reverify       = cmd.Bool(cli.BoolOpt{Name: "reverify", Desc: "hash all local rpms, even if they are unchanged since their last verification"})
+			ignoreExcludes = cmd.Bool(cli.BoolOpt{Name: "ignore-excludes", Desc: "ignore exclude= and includepkgs= of the repository file and sync all packages"})
 		)
 
 		var (
@@ -134,21 +303,46 @@ func main() {
 				"insecure", *insecure,
 				"meta", *meta,
 				"workers", *workers,
+				"retries", *retries,
 				"exclude", *exclude,
 				"enabled", *enabled,
-				"filter", *filter,
+				"filter", strings.Join(*filter, ","),
+				"excludeFilter", strings.Join(*excludeFilter, ","),
 				"arch", *arch,
 				"release", *release,
 				"repo", *repo,
 				"repoid", *repoid,
 				"destination", *dest,
 				"name", *name,
+				"prune", *prune,
+				"dryRun", *dryRun,
+				"maxPrune", *maxPrune,
+				"gpgcheck", *gpgCheck,
+				"repoGPGCheck", *repoGPGCheck,
+				"keyring", *keyring,
+				"keepUnsigned", *keepUnsigned,
+				"filterMeta", *filterMeta,
+				"packages", *packages,
+				"spanRepos", *spanRepos,
+				"keep", keepNewest(*keep, *newestOnly),
+				"arches", *arches,
+				"excludeArches", *excludeArches,
+				"errataType", *errataType,
+				"errataSeverity", *errataSeverity,
+				"errataID", *errataID,
+				"errataUntil", *errataUntil,
+				"modules", *modules,
+				"store", *store,
+				"full", *full,
+				"reverify", *reverify,
+				"ignoreExcludes", *ignoreExcludes,
 			)
 
 			start := time.Now()
 			failedRepositories := []string{}
 			skippedRepositories := []string{}
 			syncedRepositories := []string{}
+			var prunedBytes int64
 			gym.Log.Info("parsing repofile", "file", *repo)
 			to, err := time.ParseDuration(*timeout)
 			if err != nil {
@@ -158,6 +352,7 @@ func main() {
 			if err != nil {
 				gym.Log.Crit("could not create repolist", "repofile", *repo, "err", err)
 			}
+			metaSynced := gym.RepoList{}
 		Loop:
 			for _, re := range repos {
 				if len(*repoid) > 0 && *repoid != re.Name {
@@ -195,20 +390,67 @@ func main() {
 					re.Name = *name
 					re.LocalPath = path.Join(path.Dir(re.LocalPath), "/", *name)
 				}
+				re.Retry = retryPolicy()
+				re.GPGCheck = *gpgCheck && re.GPGCheck
+				re.RepoGPGCheck = *repoGPGCheck && re.RepoGPGCheck
+				re.KeyringDir = *keyring
+				re.KeepUnsigned = *keepUnsigned
+				re.FilterMeta = *filterMeta
+				if len(*packages) > 0 {
+					re.Packages = strings.Split(*packages, ",")
+				}
+				re.KeepNewest = keepNewest(*keep, *newestOnly)
+				re.Arches = splitList(*arches)
+				re.ExcludeArches = splitList(*excludeArches)
+				re.Include = *filter
+				re.Exclude = *excludeFilter
+				re.Errata = errataFilter(*errataType, *errataSeverity, *errataID, *errataUntil)
+				re.Modules = splitList(*modules)
+				if len(*store) > 0 {
+					re.Store = gym.NewStore(*store)
+				}
+				re.FullSync = *full
+				re.Reverify = *reverify
+				if *ignoreExcludes {
+					re.ExcludePkgs = nil
+					re.IncludePkgs = nil
+				}
 				gym.Log.Info("matadata sync", "name", re.Name)
 				if err := re.SyncMeta(); err != nil {
 					failedRepositories = append(failedRepositories, re.Name)
 					gym.Log.Error("metadata sync failed", "err", err)
 					continue
 				}
-				if *meta {
-					continue
+				metaSynced = append(metaSynced, re)
+			}
+			if *meta {
+				metaSynced = nil
+			}
+			if *spanRepos && len(*packages) > 0 && len(metaSynced) > 0 {
+				repoPtrs := []*gym.Repo{}
+				for i := range metaSynced {
+					repoPtrs = append(repoPtrs, &metaSynced[i])
 				}
-				if err := re.Sync(*filter, *workers); err != nil {
+				if err := gym.ResolvePackages(repoPtrs, strings.Split(*packages, ",")); err != nil {
+					gym.Log.Crit("could not resolve packages", "err", err)
+				}
+			}
+			for i := range metaSynced {
+				re := &metaSynced[i]
+				if err := re.Sync("", *workers); err != nil {
 					failedRepositories = append(failedRepositories, re.Name)
 					gym.Log.Error("rpm sync failed", "err", err)
 					continue
 				}
+				if *prune || *dryRun {
+					pruned, err := re.Prune(*maxPrune, *dryRun)
+					if err != nil {
+						failedRepositories = append(failedRepositories, re.Name)
+						gym.Log.Error("prune failed", "err", err)
+						continue
+					}
+					prunedBytes = prunedBytes + pruned.Bytes
+				}
 				syncedRepositories = append(syncedRepositories, re.Name)
 			}
 			gym.Log.Info("finish",
@@ -216,6 +458,7 @@ func main() {
 				"failedRepositories", len(failedRepositories),
 				"skippedRepositories", len(skippedRepositories),
 				"syncedRepositories", len(syncedRepositories),
+				"prunedBytes", prunedBytes,
 			)
 			return
 
@@ -223,11 +466,24 @@ func main() {
 	})
 
 	gymcmd.Command("snapshot", "create snapshot of exsiting yum repository", func(cmd *cli.Cmd) {
-		cmd.Spec = "[-c] [-l] [-t] SOURCE... DESTINATION"
+		cmd.Spec = "[-c] [-l | --mode] [-t] [--compress] [--checksum] [--filter-meta] [--keep | --newest-only] [--errata-type] [--errata-severity] [--errata-id] [--errata-until] [--modules] [--merge [--conflict]] SOURCE... DESTINATION"
 		var (
-			link       = cmd.Bool(cli.BoolOpt{Name: "link l", Desc: "create symlinks instead of copy"})
-			createRepo = cmd.Bool(cli.BoolOpt{Name: "createrepo c", Desc: "run create repo"})
-			timestamp  = cmd.Bool(cli.BoolOpt{Name: "timestamp t", Desc: "append timestamp"})
+			link           = cmd.Bool(cli.BoolOpt{Name: "link l", Desc: "create symlinks instead of copy, same as --mode symlink"})
+			mode           = cmd.String(cli.StringOpt{Name: "mode", Value: gym.SnapshotCopy, Desc: "how rpms are added to the snapshot: copy, symlink, relsymlink, hardlink or reflink, hardlinks and reflinks fall back to copy if not possible"})
+			createRepo     = cmd.Bool(cli.BoolOpt{Name: "createrepo c", Desc: "generate new repodata"})
+			timestamp      = cmd.Bool(cli.BoolOpt{Name: "timestamp t", Desc: "append timestamp"})
+			compress       = cmd.String(cli.StringOpt{Name: "compress", Value: "gz", Desc: "compression of generated repodata: gz, xz, zstd"})
+			checksum       = cmd.String(cli.StringOpt{Name: "checksum", Value: "sha256", Desc: "checksum type of generated repodata: sha1, sha256, sha512"})
+			filterMeta     = cmd.Bool(cli.BoolOpt{Name: "filter-meta", Desc: "skip missing rpms and rewrite repodata to list only the rpms in the snapshot"})
+			keep           = cmd.Int(cli.IntOpt{Name: "keep", Desc: "copy only the newest N versions of each package"})
+			newestOnly     = cmd.Bool(cli.BoolOpt{Name: "newest-only", Desc: "copy only the newest version of each package, same as --keep 1"})
+			errataType     = cmd.String(cli.StringOpt{Name: "errata-type", Desc: "comma separated list of advisory types to copy e.g: security,bugfix,enhancement"})
+			errataSeverity = cmd.String(cli.StringOpt{Name: "errata-severity", Desc: "comma separated list of advisory severities to copy e.g: Critical,Important"})
+			errataID       = cmd.String(cli.StringOpt{Name: "errata-id", Desc: "comma separated list of advisory ids to copy, globs are supported e.g: RHSA-2026:*"})
+			errataUntil    = cmd.String(cli.StringOpt{Name: "errata-until", Desc: "copy only advisories issued on or before this date e.g: 2026-09-30"})
+			modules        = cmd.String(cli.StringOpt{Name: "modules", Desc: "comma separated list of module streams to copy, packages of other streams are skipped e.g: nginx:1.20,postgresql"})
+			merge          = cmd.String(cli.StringOpt{Name: "merge", Desc: "merge all sources into one snapshot with this name and generate common repodata"})
+			conflict       = cmd.String(cli.StringOpt{Name: "conflict", Value: gym.MergeFirst, Desc: "package used if sources contain the same package with different checksums: first, last (in order of the sources) or fail"})
 		)
 		var (
 			sources = cmd.Strings(cli.StringsArg{Name: "SOURCE", Value: []string{}, Desc: "path to the yum repository file"})
@@ -248,15 +504,47 @@ func main() {
 				"workers", *workers,
 				"destination", *dest,
 				"createLinks", *link,
+				"snapshotMode", *mode,
 				"createrepo", *createRepo,
+				"compress", *compress,
+				"checksum", *checksum,
+				"filterMeta", *filterMeta,
+				"keep", keepNewest(*keep, *newestOnly),
+				"errataType", *errataType,
+				"errataSeverity", *errataSeverity,
+				"errataID", *errataID,
+				"errataUntil", *errataUntil,
+				"modules", *modules,
+				"merge", *merge,
+				"conflict", *conflict,
 				"sources", strings.Join(*sources, ", "),
 			)
 			start := time.Now()
 			failedSources := []string{}
+			if *link {
+				*mode = gym.SnapshotSymlink
+			}
+			repos := []*gym.Repo{}
 			for _, source := range *sources {
-				r := gym.NewRepo(source, "", nil, time.Second)
-				if err := r.Snapshot(*dest, *timestamp, *link, *createRepo, *workers); err != nil {
-					failedSources = append(failedSources, source)
+				r := gym.NewRepo(source, nil, nil, time.Second)
+				r.Repodata.Compression = *compress
+				r.Repodata.ChecksumType = *checksum
+				r.FilterMeta = *filterMeta
+				r.KeepNewest = keepNewest(*keep, *newestOnly)
+				r.Errata = errataFilter(*errataType, *errataSeverity, *errataID, *errataUntil)
+				r.Modules = splitList(*modules)
+				repos = append(repos, r)
+			}
+			if len(*merge) > 0 {
+				if err := gym.MergeSnapshot(repos, *dest, *merge, *timestamp, *mode, *conflict, *workers); err != nil {
+					gym.Log.Crit("could not create merged snapshot", "err", err)
+				}
+				gym.Log.Info("finish", "duration", time.Since(start))
+				return
+			}
+			for _, r := range repos {
+				if err := r.Snapshot(*dest, *timestamp, *mode, *createRepo, *workers); err != nil {
+					failedSources = append(failedSources, r.LocalPath)
 					gym.Log.Crit("could not create snapshot", "err", err)
 				}
 			}
@@ -267,6 +555,316 @@ func main() {
 		}
 	})
 
+	gymcmd.Command("retention", "remove old snapshots of repositories", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--keep-last] [--keep-daily] [--keep-weekly] [--keep-monthly] [--aliases] [--dry-run] SNAPSHOTS..."
+		var (
+			keepLast    = cmd.Int(cli.IntOpt{Name: "keep-last", Desc: "keep the newest N snapshots"})
+			keepDaily   = cmd.Int(cli.IntOpt{Name: "keep-daily", Desc: "keep the newest snapshot of each of the last N days"})
+			keepWeekly  = cmd.Int(cli.IntOpt{Name: "keep-weekly", Desc: "keep the newest snapshot of each of the last N weeks"})
+			keepMonthly = cmd.Int(cli.IntOpt{Name: "keep-monthly", Desc: "keep the newest snapshot of each of the last N months"})
+			aliases     = cmd.String(cli.StringOpt{Name: "aliases", Desc: "directory with symlinks to snapshots e.g: promotion channels, referenced snapshots and rollback targets are kept (default: parent of SNAPSHOTS)"})
+			dryRun      = cmd.Bool(cli.BoolOpt{Name: "dry-run", Desc: "only list the snapshots retention would delete"})
+		)
+		var (
+			dirs = cmd.Strings(cli.StringsArg{Name: "SNAPSHOTS", Value: nil, Desc: "snapshot directories of repositories e.g: DESTINATION/rhel8-baseos of snapshot -t"})
+		)
+		cmd.Action = func() {
+			if *debug {
+				gym.Debug()
+			}
+			if *nocolor {
+				gym.NoColor()
+			}
+			gym.Log.Info("starting retention",
+				"version", gitHashString,
+				"mode", "retention",
+				"debug", *debug,
+				"nocolor", *nocolor,
+				"keepLast", *keepLast,
+				"keepDaily", *keepDaily,
+				"keepWeekly", *keepWeekly,
+				"keepMonthly", *keepMonthly,
+				"aliases", *aliases,
+				"dryRun", *dryRun,
+				"snapshots", strings.Join(*dirs, ", "),
+			)
+			start := time.Now()
+			policy := gym.RetentionPolicy{Last: *keepLast, Daily: *keepDaily, Weekly: *keepWeekly, Monthly: *keepMonthly}
+			var freedBytes int64
+			failedDirs := []string{}
+			for _, dir := range *dirs {
+				aliasRoot := *aliases
+				if len(aliasRoot) == 0 {
+					aliasRoot = path.Dir(strings.TrimRight(dir, "/"))
+				}
+				res, err := gym.ApplyRetention(dir, policy, aliasRoot, *dryRun)
+				if err != nil {
+					failedDirs = append(failedDirs, dir)
+					gym.Log.Error("retention failed", "dir", dir, "err", err)
+					continue
+				}
+				freedBytes = freedBytes + res.FreedBytes
+			}
+			gym.Log.Info("finish",
+				"duration", time.Since(start),
+				"failedDirs", len(failedDirs),
+				"freedBytes", freedBytes,
+			)
+			if len(failedDirs) > 0 {
+				gym.Log.Crit("retention failed", "dirs", strings.Join(failedDirs, ", "))
+			}
+		}
+	})
+
+	gymcmd.Command("pin", "protect a snapshot from removal by retention", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--unpin] SNAPSHOT"
+		var (
+			unpin = cmd.Bool(cli.BoolOpt{Name: "unpin", Desc: "remove the pin of the snapshot"})
+		)
+		var (
+			dir = cmd.String(cli.StringArg{Name: "SNAPSHOT", Value: "", Desc: "snapshot directory"})
+		)
+		cmd.Action = func() {
+			if *debug {
+				gym.Debug()
+			}
+			if *nocolor {
+				gym.NoColor()
+			}
+			if err := gym.PinSnapshot(*dir, !*unpin); err != nil {
+				gym.Log.Crit("could not pin snapshot", "err", err)
+			}
+			gym.Log.Info("finish", "snapshot", *dir, "pinned", !*unpin)
+		}
+	})
+
+	gymcmd.Command("promote", "switch a channel of a repository to a snapshot", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--root] REPO SNAPSHOT CHANNEL"
+		var (
+			root = cmd.String(cli.StringOpt{Name: "root", Value: ".", Desc: "snapshot destination with the snapshots in <root>/<repo> and the channels in <root>/<channel>"})
+		)
+		var (
+			repo     = cmd.String(cli.StringArg{Name: "REPO", Value: "", Desc: "repository name e.g: rhel8-baseos"})
+			snapshot = cmd.String(cli.StringArg{Name: "SNAPSHOT", Value: "", Desc: "snapshot name in <root>/<repo> e.g: 20261016 or snapshot directory"})
+			channel  = cmd.String(cli.StringArg{Name: "CHANNEL", Value: "", Desc: "channel name e.g: prod"})
+		)
+		cmd.Action = func() {
+			if *debug {
+				gym.Debug()
+			}
+			if *nocolor {
+				gym.NoColor()
+			}
+			if err := gym.Promote(*root, *repo, *snapshot, *channel); err != nil {
+				gym.Log.Crit("could not promote snapshot", "err", err)
+			}
+		}
+	})
+
+	gymcmd.Command("rollback", "switch a channel of a repository back to the previously promoted snapshot", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--root] REPO CHANNEL"
+		var (
+			root = cmd.String(cli.StringOpt{Name: "root", Value: ".", Desc: "snapshot destination with the snapshots in <root>/<repo> and the channels in <root>/<channel>"})
+		)
+		var (
+			repo    = cmd.String(cli.StringArg{Name: "REPO", Value: "", Desc: "repository name e.g: rhel8-baseos"})
+			channel = cmd.String(cli.StringArg{Name: "CHANNEL", Value: "", Desc: "channel name e.g: prod"})
+		)
+		cmd.Action = func() {
+			if *debug {
+				gym.Debug()
+			}
+			if *nocolor {
+				gym.NoColor()
+			}
+			if _, err := gym.Rollback(*root, *repo, *channel); err != nil {
+				gym.Log.Crit("could not roll back channel", "err", err)
+			}
+		}
+	})
+
+	gymcmd.Command("channels", "list the snapshots the channels point to", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--root] [--history]"
+		var (
+			root    = cmd.String(cli.StringOpt{Name: "root", Value: ".", Desc: "snapshot destination with the snapshots in <root>/<repo> and the channels in <root>/<channel>"})
+			history = cmd.Bool(cli.BoolOpt{Name: "history", Desc: "list the whole promotion history"})
+		)
+		cmd.Action = func() {
+			if *debug {
+				gym.Debug()
+			}
+			if *nocolor {
+				gym.NoColor()
+			}
+			current, err := gym.ListChannels(*root)
+			if err != nil {
+				gym.Log.Crit("could not list channels", "err", err)
+			}
+			for _, c := range current {
+				promotions := []gym.Promotion{c}
+				if *history {
+					if promotions, err = gym.PromotionHistory(*root, c.Channel, c.Repo); err != nil {
+						gym.Log.Crit("could not read promotion history", "err", err)
+					}
+				}
+				for _, p := range promotions {
+					fmt.Printf("%s/%s -> %s (%s %s)\n", p.Channel, p.Repo, p.Snapshot, p.Action, p.Time.Format("2006-01-02 15:04:05"))
+				}
+			}
+		}
+	})
+
+	gymcmd.Command("diff", "show the package and errata changes between two repositories or snapshots", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--json] A B"
+		var (
+			jsonOutput = cmd.Bool(cli.BoolOpt{Name: "json", Desc: "print the changes as json"})
+		)
+		var (
+			a = cmd.String(cli.StringArg{Name: "A", Value: "", Desc: "local repository or snapshot, e.g. the currently promoted one"})
+			b = cmd.String(cli.StringArg{Name: "B", Value: "", Desc: "local repository or snapshot compared to A"})
+		)
+		cmd.Action = func() {
+			if *debug {
+				gym.Debug()
+			}
+			if *nocolor {
+				gym.NoColor()
+			}
+			d, err := gym.Diff(gym.NewRepo(*a, nil, nil, 0), gym.NewRepo(*b, nil, nil, 0))
+			if err != nil {
+				gym.Log.Crit("could not compare repositories", "err", err)
+			}
+			if *jsonOutput {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				err = enc.Encode(d)
+			} else {
+				err = d.WriteText(os.Stdout)
+			}
+			if err != nil {
+				gym.Log.Crit("could not write diff", "err", err)
+			}
+		}
+	})
+
+	gymcmd.Command("createrepo", "generate repodata for a directory with rpms", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--compress] [--checksum] [--groupfile] [--modulesfile] DIR"
+		var (
+			compress    = cmd.String(cli.StringOpt{Name: "compress", Value: "gz", Desc: "compression of generated repodata: gz, xz, zstd"})
+			checksum    = cmd.String(cli.StringOpt{Name: "checksum", Value: "sha256", Desc: "checksum type of generated repodata: sha1, sha256, sha512"})
+			groupFile   = cmd.String(cli.StringOpt{Name: "groupfile", Desc: "path to comps group file"})
+			modulesFile = cmd.String(cli.StringOpt{Name: "modulesfile", Desc: "path to modules.yaml with the module streams of the rpms"})
+		)
+		var (
+			dir = cmd.String(cli.StringArg{Name: "DIR", Value: "", Desc: "directory with rpms"})
+		)
+		cmd.Action = func() {
+			if *debug {
+				gym.Debug()
+			}
+			if *nocolor {
+				gym.NoColor()
+			}
+			gym.Log.Info("starting createrepo",
+				"version", gitHashString,
+				"mode", "createrepo",
+				"debug", *debug,
+				"nocolor", *nocolor,
+				"dir", *dir,
+				"compress", *compress,
+				"checksum", *checksum,
+				"groupfile", *groupFile,
+				"modulesfile", *modulesFile,
+			)
+			start := time.Now()
+			opts := gym.RepodataOptions{
+				Compression:  *compress,
+				ChecksumType: *checksum,
+				GroupFile:    *groupFile,
+				ModulesFile:  *modulesFile,
+			}
+			if err := gym.CreateRepo(*dir, opts); err != nil {
+				gym.Log.Crit("could not create repodata", "err", err)
+			}
+			gym.Log.Info("finish", "duration", time.Since(start))
+		}
+	})
+
+	gymcmd.Command("gc", "remove rpms no longer referenced by a repository from the blob store", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--dry-run] STORE"
+		var (
+			dryRun = cmd.Bool(cli.BoolOpt{Name: "dry-run", Desc: "only list the blobs gc would delete"})
+		)
+		var (
+			dir = cmd.String(cli.StringArg{Name: "STORE", Value: "", Desc: "blob store directory"})
+		)
+		cmd.Action = func() {
+			if *debug {
+				gym.Debug()
+			}
+			if *nocolor {
+				gym.NoColor()
+			}
+			gym.Log.Info("starting gc",
+				"version", gitHashString,
+				"mode", "gc",
+				"debug", *debug,
+				"nocolor", *nocolor,
+				"dryRun", *dryRun,
+				"store", *dir,
+			)
+			start := time.Now()
+			if _, _, err := gym.NewStore(*dir).GC(*dryRun); err != nil {
+				gym.Log.Crit("gc failed", "err", err)
+			}
+			gym.Log.Info("finish", "duration", time.Since(start))
+		}
+	})
+
+	gymcmd.Command("status", "show the verification state of the rpms of a local repository", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--list] DIR"
+		var (
+			list = cmd.Bool(cli.BoolOpt{Name: "list", Desc: "list the modified, unverified and missing rpms"})
+		)
+		var (
+			dir = cmd.String(cli.StringArg{Name: "DIR", Value: "", Desc: "local repository directory"})
+		)
+		cmd.Action = func() {
+			if *debug {
+				gym.Debug()
+			}
+			if *nocolor {
+				gym.NoColor()
+			}
+			gym.Log.Info("starting status",
+				"version", gitHashString,
+				"mode", "status",
+				"debug", *debug,
+				"nocolor", *nocolor,
+				"list", *list,
+				"dir", *dir,
+			)
+			r := gym.NewRepo(*dir, nil, nil, 0)
+			status, err := r.VerifyStatus()
+			if err != nil {
+				gym.Log.Crit("could not read verification state", "err", err)
+				return
+			}
+			if !*list {
+				return
+			}
+			for _, rpm := range status.Modified {
+				fmt.Println("modified   ", rpm)
+			}
+			for _, rpm := range status.Unverified {
+				fmt.Println("unverified ", rpm)
+			}
+			for _, rpm := range status.Missing {
+				fmt.Println("missing    ", rpm)
+			}
+		}
+	})
+
 	gymcmd.Command("version", "show version info", func(cmd *cli.Cmd) {
 		cmd.Spec = "[-d]"
 		var (
@@ -308,6 +906,7 @@ func main() {
 			if r == nil {
 				gym.Log.Crit("could not find repoid", "repoid", *repoid)
 			}
+			r.Retry = retryPolicy()
 			isoFileName := fmt.Sprintf("rhel-server-%s-%s-boot.iso", *release, *arch)
 			url := fmt.Sprintf("https://cdn.redhat.com/content/dist/rhel/server/%s/%sServer/%s/iso/%s", string((*release)[0]), string((*release)[0]), *arch, isoFileName)
 
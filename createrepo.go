@@ -0,0 +1,263 @@
+package gym
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CreateRepo generates the repository metadata for all rpms found in dir. It replaces
+// the createrepo command, symlinked rpms are followed.
+func CreateRepo(dir string, opts RepodataOptions) error {
+	return createRepodata(dir, opts, nil)
+}
+
+// createRepodata generates the repository metadata in dir with additional metadata files.
+func createRepodata(dir string, opts RepodataOptions, extra map[string][]byte) error {
+	if len(opts.ChecksumType) == 0 {
+		opts.ChecksumType = "sha256"
+	}
+	if _, err := newHash(opts.ChecksumType); err != nil {
+		return err
+	}
+	rpms, err := findRPMs(dir)
+	if err != nil {
+		return err
+	}
+	pkgs := []*pkgMeta{}
+	for _, relPath := range rpms {
+		p, err := readPkgMeta(filepath.Join(dir, relPath), relPath, opts.ChecksumType)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %s", relPath, err)
+		}
+		pkgs = append(pkgs, p)
+	}
+	if err := writeRepodata(dir, pkgs, opts, extra); err != nil {
+		return err
+	}
+	Log.Info("created repodata", "dir", dir, "packages", len(pkgs), "compression", opts.Compression, "checksum", opts.ChecksumType)
+	return nil
+}
+
+// findRPMs returns the relative paths of all rpms in dir, hidden directories are skipped.
+func findRPMs(dir string) ([]string, error) {
+	rpms := []string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != dir && strings.HasPrefix(info.Name(), ".") || p != dir && info.Name() == "repodata" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(info.Name(), ".rpm") {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			fi, err := os.Stat(p)
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rpms = append(rpms, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(rpms)
+	return rpms, err
+}
+
+// readPkgMeta reads the package metadata from the headers of an rpm.
+func readPkgMeta(pathToRPM string, relPath string, checksumType string) (*pkgMeta, error) {
+	f, err := os.Open(pathToRPM)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	rpmf, err := readRPMFile(f)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := fileChecksum(pathToRPM, checksumType)
+	if err != nil {
+		return nil, err
+	}
+	h := rpmf.header
+
+	p := &pkgMeta{
+		Type:        "rpm",
+		Name:        h.string(rpmTagName),
+		Arch:        h.string(rpmTagArch),
+		Summary:     h.string(rpmTagSummary),
+		Description: h.string(rpmTagDescription),
+		Packager:    h.string(rpmTagPackager),
+		URL:         h.string(rpmTagURL),
+		Version: pkgVersion{
+			Epoch: "0",
+			Ver:   h.string(rpmTagVersion),
+			Rel:   h.string(rpmTagRelease),
+		},
+		Checksum: pkgChecksum{Type: checksumType, PkgID: "YES", Value: checksum},
+		Time:     pkgTime{File: fi.ModTime().Unix(), Build: h.int(rpmTagBuildTime)},
+		Size: pkgSize{
+			Package:   fi.Size(),
+			Installed: h.int(rpmTagSize),
+			Archive:   h.int(rpmTagArchiveSize),
+		},
+		Location: pkgLocation{Href: relPath},
+		Format: pkgFormat{
+			License:     h.string(rpmTagLicense),
+			Vendor:      h.string(rpmTagVendor),
+			Group:       h.string(rpmTagGroup),
+			BuildHost:   h.string(rpmTagBuildHost),
+			SourceRPM:   h.string(rpmTagSourceRPM),
+			HeaderRange: pkgHeaderRange{Start: rpmf.headerStart, End: rpmf.headerEnd},
+		},
+	}
+	if h.has(rpmTagEpoch) {
+		p.Version.Epoch = strconv.FormatInt(h.int(rpmTagEpoch), 10)
+	}
+	if h.has(rpmTagSourcePackage) || len(p.Format.SourceRPM) == 0 {
+		p.Arch = "src"
+	}
+	if h.has(rpmTagLongSize) {
+		p.Size.Installed = h.int(rpmTagLongSize)
+	}
+	if p.Size.Archive == 0 {
+		p.Size.Archive = rpmf.signature.int(sigTagPayloadSize)
+	}
+
+	p.Files = headerFiles(h)
+	for _, file := range p.Files {
+		if isPrimaryFile(file.Path) {
+			p.Format.Files = append(p.Format.Files, file)
+		}
+	}
+
+	p.Format.Provides = headerDeps(h, rpmTagProvideName, rpmTagProvideFlags, rpmTagProvideVersion)
+	p.Format.Conflicts = headerDeps(h, rpmTagConflictName, rpmTagConflictFlags, rpmTagConflictVersion)
+	p.Format.Obsoletes = headerDeps(h, rpmTagObsoleteName, rpmTagObsoleteFlags, rpmTagObsoleteVersion)
+	p.Format.Suggests = headerDeps(h, rpmTagSuggestName, rpmTagSuggestFlags, rpmTagSuggestVersion)
+	p.Format.Enhances = headerDeps(h, rpmTagEnhanceName, rpmTagEnhanceFlags, rpmTagEnhanceVersion)
+	p.Format.Recommends = headerDeps(h, rpmTagRecommendName, rpmTagRecommendFlags, rpmTagRecommendVersion)
+	p.Format.Supplements = headerDeps(h, rpmTagSupplementName, rpmTagSupplementFlags, rpmTagSupplementVersion)
+	// requires and provides are compared without pre like the duplicates in headerDeps
+	provided := map[pkgEntry]bool{}
+	for _, e := range p.Format.Provides {
+		e.Pre = ""
+		provided[e] = true
+	}
+	for _, e := range headerDeps(h, rpmTagRequireName, rpmTagRequireFlags, rpmTagRequireVersion) {
+		// rpmlib requires and requires provided by the package itself are not listed
+		key := e
+		key.Pre = ""
+		if strings.HasPrefix(e.Name, "rpmlib(") || provided[key] {
+			continue
+		}
+		p.Format.Requires = append(p.Format.Requires, e)
+	}
+
+	times := h.ints(rpmTagChangelogTime)
+	names := h.strings(rpmTagChangelogName)
+	texts := h.strings(rpmTagChangelogText)
+	for i := range times {
+		if i >= len(names) || i >= len(texts) {
+			break
+		}
+		p.Changelogs = append(p.Changelogs, pkgChangelog{Author: names[i], Date: times[i], Text: texts[i]})
+	}
+	return p, nil
+}
+
+// headerFiles returns the files of a package with their type.
+func headerFiles(h *rpmHeader) []pkgFile {
+	paths := h.strings(rpmTagOldFilenames)
+	if basenames := h.strings(rpmTagBasenames); len(basenames) > 0 {
+		dirs := h.strings(rpmTagDirNames)
+		indexes := h.ints(rpmTagDirIndexes)
+		paths = []string{}
+		for i, name := range basenames {
+			if i >= len(indexes) || int(indexes[i]) >= len(dirs) {
+				break
+			}
+			paths = append(paths, dirs[indexes[i]]+name)
+		}
+	}
+	modes := h.ints(rpmTagFileModes)
+	flags := h.ints(rpmTagFileFlags)
+	files := []pkgFile{}
+	for i, p := range paths {
+		f := pkgFile{Path: p}
+		switch {
+		case i < len(flags) && flags[i]&rpmFileGhost != 0:
+			f.Type = "ghost"
+		case i < len(modes) && modes[i]&0170000 == 0040000:
+			f.Type = "dir"
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// headerDeps returns the dependency entries of a dependency type, duplicates are removed.
+func headerDeps(h *rpmHeader, nameTag int, flagsTag int, versionTag int) []pkgEntry {
+	names := h.strings(nameTag)
+	flags := h.ints(flagsTag)
+	versions := h.strings(versionTag)
+	entries := []pkgEntry{}
+	seen := map[pkgEntry]bool{}
+	for i, name := range names {
+		e := pkgEntry{Name: name}
+		var fl int64
+		if i < len(flags) {
+			fl = flags[i]
+		}
+		if i < len(versions) && len(versions[i]) > 0 {
+			e.Flags = depFlags(fl)
+			e.Epoch, e.Ver, e.Rel = splitEVR(versions[i])
+		}
+		if fl&(rpmSensePrereq|rpmSenseScriptPre|rpmSenseScriptPost) != 0 {
+			e.Pre = "1"
+		}
+		key := e
+		key.Pre = ""
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// depFlags converts rpm sense flags to the comparison used in the metadata.
+func depFlags(flags int64) string {
+	switch flags & (rpmSenseLess | rpmSenseGreater | rpmSenseEqual) {
+	case rpmSenseLess:
+		return "LT"
+	case rpmSenseGreater:
+		return "GT"
+	case rpmSenseEqual:
+		return "EQ"
+	case rpmSenseLess | rpmSenseEqual:
+		return "LE"
+	case rpmSenseGreater | rpmSenseEqual:
+		return "GE"
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package gym
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// readPrimaryXML reads the packages from the primary xml of a repository.
+func readPrimaryXML(t *testing.T, repo string) []pkgMeta {
+	r := NewRepo(repo, nil, nil, 0)
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, ok := metaFiles.get("primary")
+	if !ok {
+		t.Fatal("no primary xml found")
+	}
+	tmpFile, err := uncompress(path.Join(repo, primary.href))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	data, err := ioutil.ReadFile(tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata struct {
+		Packages []pkgMeta `xml:"package"`
+	}
+	if err := xml.Unmarshal(data, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	return metadata.Packages
+}
+
+func TestCreateRepo(t *testing.T) {
+	expected := readPrimaryXML(t, "testdata/repo")
+	for _, compression := range []string{"gz", "xz", "zstd"} {
+		dir, err := ioutil.TempDir("", "gym")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := os.Mkdir(path.Join(dir, "Packages"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := copyFile("testdata/repo/Packages/GeoIP-devel-1.5.0-9.el7.i686.rpm", path.Join(dir, "Packages/GeoIP-devel-1.5.0-9.el7.i686.rpm")); err != nil {
+			t.Fatal(err)
+		}
+		if err := CreateRepo(dir, RepodataOptions{Compression: compression, ChecksumType: "sha256"}); err != nil {
+			t.Fatalf("%s: %s", compression, err)
+		}
+		pkgs := readPrimaryXML(t, dir)
+		if len(pkgs) != 1 {
+			t.Fatalf("%s: expected 1 package, got %d", compression, len(pkgs))
+		}
+		got, want := pkgs[0], expected[0]
+		// the file time depends on the copy
+		got.Time.File = want.Time.File
+		for _, field := range []string{"Name", "Arch", "Version", "Checksum", "Summary", "Description", "Packager", "URL", "Time", "Size", "Location", "Format"} {
+			g := reflect.ValueOf(got).FieldByName(field).Interface()
+			w := reflect.ValueOf(want).FieldByName(field).Interface()
+			if !reflect.DeepEqual(g, w) {
+				t.Errorf("%s: %s: expected %+v, got %+v", compression, field, w, g)
+			}
+		}
+
+		// the generated sqlite database is used for the rpm list
+		r := NewRepo(dir, nil, nil, 0)
+		if err := r.rpmList(""); err != nil {
+			t.Fatal(err)
+		}
+		for rpm := range r.rpmc {
+			if rpm.checksum != want.Checksum.Value {
+				t.Errorf("%s: expected checksum %s in primary db, got %s", compression, want.Checksum.Value, rpm.checksum)
+			}
+		}
+		if err := <-r.errorc; err != nil {
+			t.Error(err)
+		}
+		if _, err := os.Stat(path.Join(dir, ".repodata")); !os.IsNotExist(err) {
+			t.Errorf("%s: temporary repodata directory has not been removed", compression)
+		}
+	}
+}
+
+func TestReadPkgMetaSelfRequires(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	str := func(s string) []byte { return []byte(s + "\x00") }
+	flags := func(f uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, f)
+		return b
+	}
+	// a Requires(pre) on a capability the package provides itself is not listed
+	dest := path.Join(dir, "foo-1.0-1.x86_64.rpm")
+	testRPMWithHeader(t, dest, nil, []testHeaderEntry{
+		{rpmTagName, rpmTypeString, str("foo")},
+		{rpmTagVersion, rpmTypeString, str("1.0")},
+		{rpmTagRelease, rpmTypeString, str("1")},
+		{rpmTagArch, rpmTypeString, str("x86_64")},
+		{rpmTagSourceRPM, rpmTypeString, str("foo-1.0-1.src.rpm")},
+		{rpmTagRequireFlags, rpmTypeInt32, flags(rpmSenseScriptPre)},
+		{rpmTagRequireName, rpmTypeStringArray, str("foo-config")},
+		{rpmTagRequireVersion, rpmTypeStringArray, str("")},
+		{rpmTagProvideName, rpmTypeStringArray, str("foo-config")},
+		{rpmTagProvideFlags, rpmTypeInt32, flags(rpmSensePrereq)},
+		{rpmTagProvideVersion, rpmTypeStringArray, str("")},
+	}, nil)
+	p, err := readPkgMeta(dest, path.Base(dest), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Format.Provides) != 1 || len(p.Format.Requires) != 0 {
+		t.Errorf("expected 1 provide and no requires, got %+v and %+v", p.Format.Provides, p.Format.Requires)
+	}
+}
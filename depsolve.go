@@ -0,0 +1,462 @@
+package gym
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ResolvePackages selects the packages with the given names or provides together with the
+// closure of their requires over the primary metadata of repos. Requires are resolved across
+// all repos, every repository then syncs only its part of the closure. Requested names that
+// are not found and unresolvable requires are logged.
+func ResolvePackages(repos []*Repo, names []string) error {
+	pool := newDepPool()
+	for _, r := range repos {
+		pkgs, err := r.loadPrimary()
+		if err != nil {
+			return fmt.Errorf("could not read primary metadata of %s: %s", r.Name, err)
+		}
+		// filtered packages are not synced and can not satisfy requires
+		f, err := r.rpmFilter("")
+		if err != nil {
+			return err
+		}
+		synced := []*pkgMeta{}
+		for _, p := range pkgs {
+			if f.match(p) {
+				synced = append(synced, p)
+			}
+		}
+		pool.add(r, synced)
+	}
+	selected := pool.resolve(names)
+	for _, r := range repos {
+		// a non nil selection restricts the sync to the selected rpms, even if it is empty
+		r.selection = []*rpm{}
+	}
+	for _, p := range selected {
+		p.repo.selection = append(p.repo.selection, p.rpm())
+	}
+	for _, r := range repos {
+		Log.Info("resolved packages", "name", r.Name, "requested", strings.Join(names, ","), "packages", len(r.selection))
+	}
+	return nil
+}
+
+// poolPkg is a package of a repository in the dependency pool.
+type poolPkg struct {
+	*pkgMeta
+	repo *Repo
+}
+
+// requirement is a capability a package needs. Its provider has to provide all entries of with
+// and none of without as well.
+type requirement struct {
+	pkgEntry
+	with    []pkgEntry
+	without []pkgEntry
+}
+
+// provider is a package providing a capability, entry is the matching provide.
+type provider struct {
+	pkg   *poolPkg
+	entry pkgEntry
+}
+
+// depPool indexes the packages of several repositories by their provides and primary files.
+type depPool struct {
+	byName    map[string][]*poolPkg
+	providers map[string][]provider
+}
+
+func newDepPool() *depPool {
+	return &depPool{
+		byName:    map[string][]*poolPkg{},
+		providers: map[string][]provider{},
+	}
+}
+
+// add adds the binary packages of a repository to the pool.
+func (d *depPool) add(r *Repo, pkgs []*pkgMeta) {
+	for _, p := range pkgs {
+		if p.Arch == "src" || p.Arch == "nosrc" {
+			continue
+		}
+		pp := &poolPkg{pkgMeta: p, repo: r}
+		d.byName[p.Name] = append(d.byName[p.Name], pp)
+		for _, e := range p.Format.Provides {
+			d.providers[e.Name] = append(d.providers[e.Name], provider{pp, e})
+		}
+		for _, f := range p.Format.Files {
+			d.providers[f.Path] = append(d.providers[f.Path], provider{pkg: pp, entry: pkgEntry{Name: f.Path}})
+		}
+	}
+}
+
+// resolve returns the packages for names with their requires closure.
+func (d *depPool) resolve(names []string) []*poolPkg {
+	selected := map[*poolPkg]bool{}
+	queue := []*poolPkg{}
+	sel := func(p *poolPkg) {
+		if !selected[p] {
+			selected[p] = true
+			queue = append(queue, p)
+		}
+	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if pkgs, ok := d.byName[name]; ok {
+			// the newest package of every architecture is selected
+			newest := map[string]*poolPkg{}
+			for _, p := range pkgs {
+				if n, ok := newest[p.Arch]; !ok || comparePkgs(p.pkgMeta, n.pkgMeta) > 0 {
+					newest[p.Arch] = p
+				}
+			}
+			for _, p := range newest {
+				sel(p)
+			}
+			continue
+		}
+		p := d.best(requirement{pkgEntry: pkgEntry{Name: name}}, "", selected)
+		if p == nil {
+			Log.Warn("package not found", "package", name)
+			continue
+		}
+		sel(p)
+	}
+
+	unresolved := map[string]bool{}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, req := range p.Format.Requires {
+			for _, e := range d.requirements(req) {
+				if r := d.best(e, p.Arch, selected); r != nil {
+					sel(r)
+				} else if !unresolved[e.Name] {
+					unresolved[e.Name] = true
+					Log.Warn("unresolved requirement", "package", p.Name, "requires", e.Name)
+				}
+			}
+		}
+	}
+
+	result := []*poolPkg{}
+	for p := range selected {
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Location.Href < result[j].Location.Href
+	})
+	return result
+}
+
+// requirements returns the requirements for a require entry. Rich dependencies are split into
+// the alternatives that are needed: and needs all operands, or needs the first resolvable
+// operand. For if/unless the condition is ignored and the first operand is always needed.
+// The operands of with/without constrain a single package: it has to provide the first operand
+// and all others (with) or none of the others (without), they have to be simple dependencies.
+func (d *depPool) requirements(req pkgEntry) []requirement {
+	if !strings.HasPrefix(req.Name, "(") {
+		return []requirement{{pkgEntry: req}}
+	}
+	op, operands := parseRichDep(req.Name)
+	switch op {
+	case "or":
+		for _, o := range operands {
+			if reqs := d.requirements(o); d.resolvable(reqs) {
+				return reqs
+			}
+		}
+		return nil
+	case "if", "unless":
+		return d.requirements(operands[0])
+	case "with":
+		return []requirement{{pkgEntry: operands[0], with: operands[1:]}}
+	case "without":
+		return []requirement{{pkgEntry: operands[0], without: operands[1:]}}
+	}
+	reqs := []requirement{}
+	for _, o := range operands {
+		reqs = append(reqs, d.requirements(o)...)
+	}
+	return reqs
+}
+
+// resolvable reports whether all requirements have a provider.
+func (d *depPool) resolvable(reqs []requirement) bool {
+	for _, req := range reqs {
+		if d.best(req, "", nil) == nil {
+			return false
+		}
+	}
+	return len(reqs) > 0
+}
+
+// provides reports whether the package p provides the entry e.
+func (d *depPool) provides(p *poolPkg, e pkgEntry) bool {
+	for _, pr := range d.providers[e.Name] {
+		if pr.pkg == p && depMatches(pr.entry, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// satisfies reports whether the package p satisfies the with and without constraints of req.
+func (d *depPool) satisfies(p *poolPkg, req requirement) bool {
+	for _, e := range req.with {
+		if !d.provides(p, e) {
+			return false
+		}
+	}
+	for _, e := range req.without {
+		if d.provides(p, e) {
+			return false
+		}
+	}
+	return true
+}
+
+// best returns the best provider of a requirement. Already selected packages are preferred,
+// then packages with the architecture of the requiring package or noarch, packages whose
+// name is the requirement and at last the newest version.
+func (d *depPool) best(req requirement, arch string, selected map[*poolPkg]bool) *poolPkg {
+	candidates := []*poolPkg{}
+	for _, pr := range d.providers[req.Name] {
+		if depMatches(pr.entry, req.pkgEntry) && d.satisfies(pr.pkg, req) {
+			candidates = append(candidates, pr.pkg)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	score := func(p *poolPkg) int {
+		s := 0
+		if selected[p] {
+			s += 8
+		}
+		if len(arch) > 0 && (p.Arch == arch || p.Arch == "noarch") {
+			s += 4
+		}
+		if p.Name == req.Name {
+			s += 2
+		}
+		return s
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		si, sj := score(candidates[i]), score(candidates[j])
+		if si != sj {
+			return si > sj
+		}
+		if c := comparePkgs(candidates[i].pkgMeta, candidates[j].pkgMeta); c != 0 {
+			return c > 0
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates[0]
+}
+
+// comparePkgs compares the epoch, version and release of two packages.
+func comparePkgs(a, b *pkgMeta) int {
+	return evrcmp(a.Version.Epoch, a.Version.Ver, a.Version.Rel, b.Version.Epoch, b.Version.Ver, b.Version.Rel)
+}
+
+// depMatches reports whether the provide satisfies the requirement, both with the same name.
+// The ranges of the flags have to overlap like in rpm.
+func depMatches(provide pkgEntry, req pkgEntry) bool {
+	if len(req.Flags) == 0 || len(provide.Flags) == 0 {
+		return true
+	}
+	pf, rf := senseFlags(provide.Flags), senseFlags(req.Flags)
+	sense := evrcmp(provide.Epoch, provide.Ver, provide.Rel, req.Epoch, req.Ver, req.Rel)
+	switch {
+	case sense < 0:
+		return pf&rpmSenseGreater != 0 || rf&rpmSenseLess != 0
+	case sense > 0:
+		return pf&rpmSenseLess != 0 || rf&rpmSenseGreater != 0
+	}
+	return pf&rf&(rpmSenseEqual|rpmSenseLess|rpmSenseGreater) != 0
+}
+
+// senseFlags converts the flags of the metadata to rpm sense flags.
+func senseFlags(flags string) int {
+	switch flags {
+	case "LT":
+		return rpmSenseLess
+	case "GT":
+		return rpmSenseGreater
+	case "EQ":
+		return rpmSenseEqual
+	case "LE":
+		return rpmSenseLess | rpmSenseEqual
+	case "GE":
+		return rpmSenseGreater | rpmSenseEqual
+	}
+	return 0
+}
+
+// parseRichDep parses a rich dependency like (a or (b >= 1.0 and c)) and returns the
+// operator and the operands of the outer expression.
+func parseRichDep(dep string) (string, []pkgEntry) {
+	dep = strings.TrimSpace(dep)
+	dep = strings.TrimSuffix(strings.TrimPrefix(dep, "("), ")")
+	tokens := []string{}
+	depth, start := 0, 0
+	for i, c := range dep {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ' ' && depth == 0:
+			if i > start {
+				tokens = append(tokens, dep[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(dep) {
+		tokens = append(tokens, dep[start:])
+	}
+
+	op := "and"
+	operands := []pkgEntry{}
+	current := []string{}
+	flush := func() {
+		if len(current) == 0 {
+			return
+		}
+		e := pkgEntry{Name: current[0]}
+		if len(current) == 3 {
+			e.Flags = map[string]string{"<": "LT", ">": "GT", "=": "EQ", "<=": "LE", ">=": "GE"}[current[1]]
+			e.Epoch, e.Ver, e.Rel = splitEVR(current[2])
+		}
+		operands = append(operands, e)
+		current = nil
+	}
+	for _, t := range tokens {
+		switch t {
+		case "and", "or", "if", "unless", "with", "without", "else":
+			if t != "else" {
+				op = t
+			}
+			flush()
+		default:
+			current = append(current, t)
+		}
+	}
+	flush()
+	return op, operands
+}
+
+// loadPrimary reads all packages with their provides, requires and primary files from the
+// primary sqlite database or, if there is none, from the primary xml.
+func (r *Repo) loadPrimary() ([]*pkgMeta, error) {
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		return nil, err
+	}
+	if primary, ok := metaFiles.get("primary_db"); ok {
+		return r.loadPrimaryFromSqlite(primary)
+	}
+	primary, ok := metaFiles.get("primary")
+	if !ok {
+		return nil, errors.New("no primary db sqlite or xml file found")
+	}
+	pkgs := []*pkgMeta{}
+	err = r.decodePackages(primary, func(d *xml.Decoder, se *xml.StartElement) error {
+		p := &pkgMeta{}
+		if err := d.DecodeElement(p, se); err != nil {
+			return err
+		}
+		pkgs = append(pkgs, p)
+		return nil
+	})
+	return pkgs, err
+}
+
+func (r *Repo) loadPrimaryFromSqlite(primary metaFile) ([]*pkgMeta, error) {
+	tmpFile, err := uncompress(r.metaPath(primary))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	pkgs := []*pkgMeta{}
+	byKey := map[int64]*pkgMeta{}
+	query := "select pkgKey, pkgId, name, arch, epoch, version, release, location_href, checksum_type, size_package, size_archive, rpm_license, rpm_group from packages"
+	err = processSqlite(tmpFile.Name(), query, func(rows *sql.Rows) error {
+		for rows.Next() {
+			var key int64
+			var epoch, release, license, group sql.NullString
+			p := &pkgMeta{}
+			if err := rows.Scan(&key, &p.Checksum.Value, &p.Name, &p.Arch, &epoch, &p.Version.Ver, &release,
+				&p.Location.Href, &p.Checksum.Type, &p.Size.Package, &p.Size.Archive, &license, &group); err != nil {
+				return err
+			}
+			p.Version.Epoch = epoch.String
+			p.Version.Rel = release.String
+			p.Format.License = license.String
+			p.Format.Group = group.String
+			pkgs = append(pkgs, p)
+			byKey[key] = p
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, table := range []string{"provides", "requires"} {
+		query := "select pkgKey, name, flags, epoch, version, release from " + table
+		err := processSqlite(tmpFile.Name(), query, func(rows *sql.Rows) error {
+			for rows.Next() {
+				var key int64
+				var name string
+				var flags, epoch, version, release sql.NullString
+				if err := rows.Scan(&key, &name, &flags, &epoch, &version, &release); err != nil {
+					return err
+				}
+				p, ok := byKey[key]
+				if !ok {
+					continue
+				}
+				e := pkgEntry{Name: name, Flags: flags.String, Epoch: epoch.String, Ver: version.String, Rel: release.String}
+				if table == "provides" {
+					p.Format.Provides = append(p.Format.Provides, e)
+				} else {
+					p.Format.Requires = append(p.Format.Requires, e)
+				}
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = processSqlite(tmpFile.Name(), "select pkgKey, name, type from files", func(rows *sql.Rows) error {
+		for rows.Next() {
+			var key int64
+			var name string
+			var fileType sql.NullString
+			if err := rows.Scan(&key, &name, &fileType); err != nil {
+				return err
+			}
+			if p, ok := byKey[key]; ok {
+				p.Format.Files = append(p.Format.Files, pkgFile{Path: name, Type: fileType.String})
+			}
+		}
+		return rows.Err()
+	})
+	return pkgs, err
+}
@@ -0,0 +1,172 @@
+package gym
+
+import (
+	"encoding/xml"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testPkg creates a package for dependency tests, deps are name [flags evr] entries.
+func testPkg(name, evr, arch string, provides []string, requires []string, files ...string) *pkgMeta {
+	entry := func(dep string) pkgEntry {
+		if strings.HasPrefix(dep, "(") {
+			return pkgEntry{Name: dep}
+		}
+		fields := strings.Fields(dep)
+		e := pkgEntry{Name: fields[0]}
+		if len(fields) == 3 {
+			e.Flags = fields[1]
+			e.Epoch, e.Ver, e.Rel = splitEVR(fields[2])
+		}
+		return e
+	}
+	p := &pkgMeta{Name: name, Arch: arch}
+	p.Version.Epoch, p.Version.Ver, p.Version.Rel = splitEVR(evr)
+	p.Location.Href = "Packages/" + name + "-" + evr + "." + arch + ".rpm"
+	p.Format.Provides = append(p.Format.Provides, pkgEntry{Name: name, Flags: "EQ", Epoch: p.Version.Epoch, Ver: p.Version.Ver, Rel: p.Version.Rel})
+	for _, dep := range provides {
+		p.Format.Provides = append(p.Format.Provides, entry(dep))
+	}
+	for _, dep := range requires {
+		p.Format.Requires = append(p.Format.Requires, entry(dep))
+	}
+	for _, f := range files {
+		p.Format.Files = append(p.Format.Files, pkgFile{Path: f})
+	}
+	return p
+}
+
+func TestResolveClosure(t *testing.T) {
+	base := &Repo{Name: "baseos"}
+	appstream := &Repo{Name: "appstream"}
+	pool := newDepPool()
+	pool.add(base, []*pkgMeta{
+		testPkg("glibc", "2.28-1", "x86_64", []string{"libc.so.6()(64bit)"}, nil),
+		testPkg("glibc", "2.28-1", "i686", []string{"libc.so.6"}, nil),
+		testPkg("mailcap", "2.1-1", "noarch", nil, nil, "/etc/mime.types"),
+		testPkg("openssl-libs", "1.1.1-1", "x86_64", []string{"libssl.so.1.1()(64bit)"}, []string{"libc.so.6()(64bit)"}),
+		testPkg("unrelated", "1.0-1", "x86_64", nil, nil),
+	})
+	pool.add(appstream, []*pkgMeta{
+		testPkg("apr", "1.4.0-1", "x86_64", nil, []string{"libc.so.6()(64bit)"}),
+		testPkg("apr", "1.6.3-1", "x86_64", nil, []string{"libc.so.6()(64bit)"}),
+		testPkg("apr-util", "1.6.1-1", "x86_64", nil, []string{"apr GE 1.5"}),
+		testPkg("httpd", "2.4.37-1", "x86_64", []string{"webserver"}, []string{"apr GE 1.5", "apr-util", "/etc/mime.types", "(mod_ssl if openssl-libs)", "(nginx or libssl.so.1.1()(64bit))", "missing"}),
+		testPkg("mod_ssl", "2.4.37-1", "x86_64", nil, []string{"httpd EQ 2.4.37-1"}),
+		testPkg("httpd", "src", "src", nil, nil),
+	})
+
+	selected := pool.resolve([]string{"webserver"})
+	got := []string{}
+	for _, p := range selected {
+		got = append(got, p.repo.Name+":"+p.Name+"-"+p.Version.Ver+"."+p.Arch)
+	}
+	sort.Strings(got)
+	expected := []string{
+		"appstream:apr-1.6.3.x86_64",
+		"appstream:apr-util-1.6.1.x86_64",
+		"appstream:httpd-2.4.37.x86_64",
+		"appstream:mod_ssl-2.4.37.x86_64",
+		"baseos:glibc-2.28.x86_64",
+		"baseos:mailcap-2.1.noarch",
+		"baseos:openssl-libs-1.1.1.x86_64",
+	}
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected closure\n%s\ngot\n%s", strings.Join(expected, " "), strings.Join(got, " "))
+	}
+
+	// packages requested by name are selected with every architecture
+	if selected := pool.resolve([]string{"glibc"}); len(selected) != 2 {
+		t.Errorf("expected glibc for both architectures, got %d packages", len(selected))
+	}
+}
+
+func TestResolveWithWithout(t *testing.T) {
+	r := &Repo{Name: "baseos"}
+	pool := newDepPool()
+	pool.add(r, []*pkgMeta{
+		testPkg("kmod-a", "1.0-1", "x86_64", []string{"kmod", "kernel-abi EQ 5.14"}, nil),
+		testPkg("kmod-b", "2.0-1", "x86_64", []string{"kmod", "kernel-abi EQ 6.1"}, nil),
+		testPkg("with", "1.0-1", "x86_64", nil, []string{"(kmod with kernel-abi = 5.14)"}),
+		testPkg("without", "1.0-1", "x86_64", nil, []string{"(kmod without kernel-abi = 6.1)"}),
+		testPkg("unresolvable", "1.0-1", "x86_64", nil, []string{"(kmod with kernel-abi = 4.18)"}),
+	})
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		// one package has to satisfy all operands, the newest kmod provider is not selected
+		{"with", "kmod-a with"},
+		{"without", "kmod-a without"},
+		{"unresolvable", "unresolvable"},
+	}
+	for _, test := range tests {
+		got := []string{}
+		for _, p := range pool.resolve([]string{test.name}) {
+			got = append(got, p.Name)
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, strings.Join(got, " "))
+		}
+	}
+}
+
+func TestDepMatches(t *testing.T) {
+	tests := []struct {
+		provide, require pkgEntry
+		expected         bool
+	}{
+		{pkgEntry{Name: "a", Flags: "EQ", Epoch: "0", Ver: "1.0", Rel: "1"}, pkgEntry{Name: "a"}, true},
+		{pkgEntry{Name: "a"}, pkgEntry{Name: "a", Flags: "GE", Ver: "2.0"}, true},
+		{pkgEntry{Name: "a", Flags: "EQ", Epoch: "0", Ver: "1.0", Rel: "1"}, pkgEntry{Name: "a", Flags: "GE", Epoch: "0", Ver: "1.0"}, true},
+		{pkgEntry{Name: "a", Flags: "EQ", Epoch: "0", Ver: "1.0", Rel: "1"}, pkgEntry{Name: "a", Flags: "GT", Epoch: "0", Ver: "1.0"}, false},
+		{pkgEntry{Name: "a", Flags: "EQ", Epoch: "0", Ver: "1.0", Rel: "1"}, pkgEntry{Name: "a", Flags: "LT", Epoch: "0", Ver: "1.0", Rel: "2"}, true},
+		{pkgEntry{Name: "a", Flags: "EQ", Epoch: "1", Ver: "0.5", Rel: "1"}, pkgEntry{Name: "a", Flags: "GE", Epoch: "0", Ver: "1.0"}, true},
+		{pkgEntry{Name: "a", Flags: "GE", Epoch: "0", Ver: "2.0"}, pkgEntry{Name: "a", Flags: "LE", Epoch: "0", Ver: "1.0"}, false},
+	}
+	for i, test := range tests {
+		if got := depMatches(test.provide, test.require); got != test.expected {
+			t.Errorf("test %d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestLoadPrimary(t *testing.T) {
+	r := NewRepo("testdata/repo", nil, nil, 0)
+	fromSqlite, err := r.loadPrimary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, _ := metaFiles.get("primary")
+	fromXML := []*pkgMeta{}
+	if err := r.decodePackages(primary, func(d *xml.Decoder, se *xml.StartElement) error {
+		p := &pkgMeta{}
+		fromXML = append(fromXML, p)
+		return d.DecodeElement(p, se)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fromSqlite) != 1 || len(fromXML) != 1 {
+		t.Fatalf("expected 1 package, got %d from sqlite and %d from xml", len(fromSqlite), len(fromXML))
+	}
+	s, x := fromSqlite[0], fromXML[0]
+	if s.Name != x.Name || s.Version != x.Version || s.Location.Href != x.Location.Href || s.Checksum.Value != x.Checksum.Value {
+		t.Errorf("packages differ: %+v %+v", s, x)
+	}
+	if len(s.Format.Provides) != len(x.Format.Provides) || len(s.Format.Requires) != len(x.Format.Requires) {
+		t.Errorf("dependencies differ: %d/%d provides, %d/%d requires", len(s.Format.Provides), len(x.Format.Provides), len(s.Format.Requires), len(x.Format.Requires))
+	}
+
+	if err := ResolvePackages([]*Repo{r}, []string{"geoip-devel"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.selection) != 1 || r.selection[0].relPath != "Packages/GeoIP-devel-1.5.0-9.el7.i686.rpm" {
+		t.Errorf("unexpected selection %+v", r.selection)
+	}
+}
@@ -0,0 +1,244 @@
+package gym
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// PackageChange is a package added, removed, upgraded or downgraded between two repositories.
+type PackageChange struct {
+	Name string `json:"name"`
+	Arch string `json:"arch"`
+	From string `json:"from,omitempty"` // [epoch:]version-release in the first repository
+	To   string `json:"to,omitempty"`   // [epoch:]version-release in the second repository
+}
+
+// ErratumChange is an advisory of the second repository missing in the first one.
+type ErratumChange struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Severity string `json:"severity,omitempty"`
+}
+
+// RepoDiff lists the changes between two repositories. Packages are compared by name and
+// architecture, upgrades and downgrades compare the newest versions in both repositories.
+type RepoDiff struct {
+	Added      []PackageChange `json:"added"`
+	Removed    []PackageChange `json:"removed"`
+	Upgraded   []PackageChange `json:"upgraded"`
+	Downgraded []PackageChange `json:"downgraded"`
+	Errata     []ErratumChange `json:"errata"`               // advisories newly covered by the second repository
+	Unverified []string        `json:"unverified,omitempty"` // local rpms of the second repository not verified or modified since
+}
+
+// Diff compares the primary metadata and updateinfo of the repositories a and b. If b has a state
+// of verified rpms, its local rpms which are not verified or have been modified since are listed.
+func Diff(a, b *Repo) (*RepoDiff, error) {
+	pkgsA, err := a.loadPrimary()
+	if err != nil {
+		return nil, err
+	}
+	pkgsB, err := b.loadPrimary()
+	if err != nil {
+		return nil, err
+	}
+	d := &RepoDiff{
+		Added:      []PackageChange{},
+		Removed:    []PackageChange{},
+		Upgraded:   []PackageChange{},
+		Downgraded: []PackageChange{},
+	}
+	byNameA, byNameB := pkgsByNameArch(pkgsA), pkgsByNameArch(pkgsB)
+	for key, pkgs := range byNameB {
+		if _, ok := byNameA[key]; !ok {
+			for _, p := range pkgs {
+				d.Added = append(d.Added, PackageChange{Name: p.Name, Arch: p.Arch, To: pkgEVR(p)})
+			}
+			continue
+		}
+		from, to := newestPkgs(byNameA[key], 1)[0], newestPkgs(pkgs, 1)[0]
+		c := PackageChange{Name: to.Name, Arch: to.Arch, From: pkgEVR(from), To: pkgEVR(to)}
+		switch cmp := comparePkgs(from, to); {
+		case cmp < 0:
+			d.Upgraded = append(d.Upgraded, c)
+		case cmp > 0:
+			d.Downgraded = append(d.Downgraded, c)
+		}
+	}
+	for key, pkgs := range byNameA {
+		if _, ok := byNameB[key]; !ok {
+			for _, p := range pkgs {
+				d.Removed = append(d.Removed, PackageChange{Name: p.Name, Arch: p.Arch, From: pkgEVR(p)})
+			}
+		}
+	}
+	// the same version can be listed more than once, e.g. in different directories
+	d.Added, d.Removed = uniqPackageChanges(d.Added), uniqPackageChanges(d.Removed)
+	d.Upgraded, d.Downgraded = uniqPackageChanges(d.Upgraded), uniqPackageChanges(d.Downgraded)
+	if d.Errata, err = newErrata(a, b); err != nil {
+		return nil, err
+	}
+	d.Unverified = unverifiedRPMs(b, pkgsB)
+	Log.Debug("finished diff", "a", a.LocalPath, "b", b.LocalPath, "added", len(d.Added), "removed", len(d.Removed), "upgraded", len(d.Upgraded), "downgraded", len(d.Downgraded), "errata", len(d.Errata), "unverified", len(d.Unverified))
+	return d, nil
+}
+
+// newErrata returns the advisories in the updateinfo of b which are not in a.
+func newErrata(a, b *Repo) ([]ErratumChange, error) {
+	ids := map[string]bool{}
+	metaFiles, err := a.lsMeta()
+	if err != nil {
+		return nil, err
+	}
+	updates, err := a.readUpdateinfo(metaFiles)
+	if err != nil {
+		return nil, err
+	}
+	for i := range updates {
+		if id := updates[i].child("id"); id != nil {
+			ids[strings.TrimSpace(id.Content)] = true
+		}
+	}
+	if metaFiles, err = b.lsMeta(); err != nil {
+		return nil, err
+	}
+	if updates, err = b.readUpdateinfo(metaFiles); err != nil {
+		return nil, err
+	}
+	errata := []ErratumChange{}
+	for i := range updates {
+		u := &updates[i]
+		id := u.child("id")
+		if id == nil || ids[strings.TrimSpace(id.Content)] {
+			continue
+		}
+		e := ErratumChange{ID: strings.TrimSpace(id.Content), Type: u.attr("type")}
+		if severity := u.child("severity"); severity != nil {
+			e.Severity = strings.TrimSpace(severity.Content)
+		}
+		errata = append(errata, e)
+	}
+	sort.Slice(errata, func(i, j int) bool {
+		return errata[i].ID < errata[j].ID
+	})
+	return errata, nil
+}
+
+// unverifiedRPMs returns the local rpms of the packages which are not verified or have been
+// modified since their verification. Nothing is returned if r has no state of verified rpms.
+func unverifiedRPMs(r *Repo, pkgs []*pkgMeta) []string {
+	if _, err := os.Stat(path.Join(r.LocalPath, verifiedFile)); err != nil {
+		return nil
+	}
+	db := openVerifiedDB(r.LocalPath)
+	unverified := []string{}
+	for _, p := range pkgs {
+		relPath := path.Clean(p.Location.Href)
+		if _, err := os.Stat(path.Join(r.LocalPath, relPath)); err != nil {
+			// rpms not synced are not reported
+			continue
+		}
+		if !db.trusted(relPath, p.Checksum.Type, p.Checksum.Value) {
+			unverified = append(unverified, relPath)
+		}
+	}
+	sort.Strings(unverified)
+	return unverified
+}
+
+// WriteText writes the changes human readable to w.
+func (d *RepoDiff) WriteText(w io.Writer) error {
+	sections := []struct {
+		title   string
+		changes []PackageChange
+	}{
+		{"added", d.Added},
+		{"removed", d.Removed},
+		{"upgraded", d.Upgraded},
+		{"downgraded", d.Downgraded},
+	}
+	for _, s := range sections {
+		if len(s.changes) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s packages:\n", s.title); err != nil {
+			return err
+		}
+		for _, c := range s.changes {
+			line := fmt.Sprintf("  %s.%s %s -> %s\n", c.Name, c.Arch, c.From, c.To)
+			if len(c.From) == 0 {
+				line = fmt.Sprintf("  %s-%s.%s\n", c.Name, c.To, c.Arch)
+			} else if len(c.To) == 0 {
+				line = fmt.Sprintf("  %s-%s.%s\n", c.Name, c.From, c.Arch)
+			}
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+	}
+	if len(d.Errata) > 0 {
+		if _, err := io.WriteString(w, "new errata:\n"); err != nil {
+			return err
+		}
+		for _, e := range d.Errata {
+			if _, err := fmt.Fprintf(w, "  %s %s %s\n", e.ID, e.Type, e.Severity); err != nil {
+				return err
+			}
+		}
+	}
+	if len(d.Unverified) > 0 {
+		if _, err := io.WriteString(w, "unverified rpms:\n"); err != nil {
+			return err
+		}
+		for _, rpm := range d.Unverified {
+			if _, err := fmt.Fprintf(w, "  %s\n", rpm); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d added, %d removed, %d upgraded, %d downgraded, %d new errata\n", len(d.Added), len(d.Removed), len(d.Upgraded), len(d.Downgraded), len(d.Errata))
+	return err
+}
+
+// pkgsByNameArch groups packages by name.arch.
+func pkgsByNameArch(pkgs []*pkgMeta) map[string][]*pkgMeta {
+	byName := map[string][]*pkgMeta{}
+	for _, p := range pkgs {
+		key := p.Name + "." + p.Arch
+		byName[key] = append(byName[key], p)
+	}
+	return byName
+}
+
+// pkgEVR returns [epoch:]version-release of a package, epoch 0 is omitted.
+func pkgEVR(p *pkgMeta) string {
+	evr := p.Version.Ver + "-" + p.Version.Rel
+	if len(p.Version.Epoch) > 0 && p.Version.Epoch != "0" {
+		evr = p.Version.Epoch + ":" + evr
+	}
+	return evr
+}
+
+// uniqPackageChanges sorts changes by name and architecture and removes duplicates.
+func uniqPackageChanges(changes []PackageChange) []PackageChange {
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Name != changes[j].Name {
+			return changes[i].Name < changes[j].Name
+		}
+		if changes[i].Arch != changes[j].Arch {
+			return changes[i].Arch < changes[j].Arch
+		}
+		return changes[i].From+changes[i].To < changes[j].From+changes[j].To
+	})
+	uniq := []PackageChange{}
+	for i, c := range changes {
+		if i == 0 || c != changes[i-1] {
+			uniq = append(uniq, c)
+		}
+	}
+	return uniq
+}
@@ -0,0 +1,90 @@
+package gym
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b := path.Join(dir, "a"), path.Join(dir, "b")
+	testNamedRPM(t, a, "foo", "1.0", "1", "x86_64")
+	testNamedRPM(t, a, "bar", "1.0", "1", "noarch")
+	testNamedRPM(t, a, "baz", "2.0", "1", "noarch")
+	testNamedRPM(t, a, "qux", "1.0", "1", "noarch")
+	if err := CreateRepo(a, DefaultRepodataOptions()); err != nil {
+		t.Fatal(err)
+	}
+	testNamedRPM(t, b, "foo", "1.0", "1", "x86_64")
+	testNamedRPM(t, b, "foo", "2.0", "1", "x86_64")
+	testNamedRPM(t, b, "baz", "1.0", "1", "noarch")
+	testNamedRPM(t, b, "qux", "1.0", "1", "noarch")
+	testNamedRPM(t, b, "new", "1.0", "1", "x86_64")
+	if err := createRepodata(b, DefaultRepodataOptions(), map[string][]byte{"updateinfo": []byte(testErrata)}); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := Diff(NewRepo(a, nil, nil, 0), NewRepo(b, nil, nil, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"added":[{"name":"new","arch":"x86_64","to":"1.0-1"}],` +
+		`"removed":[{"name":"bar","arch":"noarch","from":"1.0-1"}],` +
+		`"upgraded":[{"name":"foo","arch":"x86_64","from":"1.0-1","to":"2.0-1"}],` +
+		`"downgraded":[{"name":"baz","arch":"noarch","from":"2.0-1","to":"1.0-1"}],` +
+		`"errata":[{"id":"EXBA-2026:0002","type":"bugfix"},{"id":"EXSA-2026:0001","type":"security","severity":"Important"},{"id":"EXSA-2026:0003","type":"security","severity":"Critical"}]}`
+	if string(data) != expected {
+		t.Errorf("unexpected diff:\n%s\nexpected:\n%s", data, expected)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := d.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"  new-1.0-1.x86_64\n", "  foo.x86_64 1.0-1 -> 2.0-1\n", "  EXSA-2026:0003 security Critical\n", "1 added, 1 removed, 1 upgraded, 1 downgraded, 3 new errata\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("expected %q in text output:\n%s", line, buf)
+		}
+	}
+
+	// a repository has no changes to itself
+	d, err = Diff(NewRepo(b, nil, nil, 0), NewRepo(b, nil, nil, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Added)+len(d.Removed)+len(d.Upgraded)+len(d.Downgraded)+len(d.Errata) != 0 {
+		t.Errorf("expected no changes, got %+v", d)
+	}
+
+	// the rpms of b missing in its state of verified rpms are reported
+	db := openVerifiedDB(b)
+	checksum, err := fileChecksum(path.Join(b, "Packages/foo-2.0-1.x86_64.rpm"), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.record("Packages/foo-2.0-1.x86_64.rpm", "sha256", checksum, "")
+	if err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	d, err = Diff(NewRepo(a, nil, nil, 0), NewRepo(b, nil, nil, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedUnverified := "Packages/baz-1.0-1.noarch.rpm Packages/foo-1.0-1.x86_64.rpm Packages/new-1.0-1.x86_64.rpm Packages/qux-1.0-1.noarch.rpm"
+	if strings.Join(d.Unverified, " ") != expectedUnverified {
+		t.Errorf("expected unverified rpms %s, got %v", expectedUnverified, d.Unverified)
+	}
+}
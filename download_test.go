@@ -0,0 +1,156 @@
+package gym
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadResume(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	modTime := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		http.ServeContent(w, req, "test.rpm", modTime, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest := path.Join(dir, "test.rpm")
+	r := NewRepo(dir, []string{ts.URL}, nil, time.Second)
+
+	tests := []struct {
+		name         string
+		partModTime  time.Time
+		expectedSize int64
+	}{
+		{"resume", modTime, 9000},
+		{"changed remote file", modTime.Add(-time.Hour), 10000},
+	}
+	for _, test := range tests {
+		ranges = nil
+		if err := ioutil.WriteFile(dest+".part", content[:1000], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dest+".part", test.partModTime, test.partModTime); err != nil {
+			t.Fatal(err)
+		}
+		size, err := r.Download(ts.URL+"/test.rpm", dest)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if size != test.expectedSize {
+			t.Errorf("%s: expected %d downloaded bytes, got %d", test.name, test.expectedSize, size)
+		}
+		if len(ranges) != 1 || ranges[0] != "bytes=1000-" {
+			t.Errorf("%s: expected one range request 'bytes=1000-', got %v", test.name, ranges)
+		}
+		data, err := ioutil.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("%s: downloaded file differs from remote file", test.name)
+		}
+		if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+			t.Errorf("%s: part file has not been removed", test.name)
+		}
+	}
+}
+
+func TestDownloadRetry(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("test"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := NewRepo(dir, []string{ts.URL}, nil, time.Second)
+	r.Retry.BaseDelay = time.Millisecond
+	_, retries, err := r.download(ts.URL+"/test.rpm", path.Join(dir, "test.rpm"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retries != 2 {
+		t.Errorf("expected 2 retries, got %d", retries)
+	}
+
+	requests = 0
+	r.Retry.Attempts = 2
+	if _, retries, err = r.download(ts.URL+"/test.rpm", path.Join(dir, "test.rpm"), "", ""); err == nil {
+		t.Error("expected an error after 2 attempts")
+	}
+	if retries != 1 {
+		t.Errorf("expected 1 retry, got %d", retries)
+	}
+
+	requests = 0
+	r.Retry.StatusCodes = []int{}
+	if _, retries, err = r.download(ts.URL+"/test.rpm", path.Join(dir, "test.rpm"), "", ""); err == nil || retries != 0 {
+		t.Errorf("status 503 is not retryable, expected an error without retries, got %d retries and err %v", retries, err)
+	}
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	modTime := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "test.rpm", modTime, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest := path.Join(dir, "test.rpm")
+	r := NewRepo(dir, []string{ts.URL}, nil, time.Second)
+	checksum := fmt.Sprintf("%x", sha256.Sum256(content))
+
+	// the part of a resumed download is part of the checksum
+	if err := ioutil.WriteFile(dest+".part", content[:1000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dest+".part", modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	size, _, err := r.download(ts.URL+"/test.rpm", dest, checksum, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 9000 {
+		t.Errorf("expected resumed download of 9000 bytes, got %d", size)
+	}
+	if size, _, err := r.download(ts.URL+"/test.rpm", dest, checksum, "sha256"); err != nil || size != 0 {
+		t.Errorf("expected cached file, got %d bytes and error %v", size, err)
+	}
+
+	os.Remove(dest)
+	if _, _, err := r.download(ts.URL+"/test.rpm", dest, strings.Repeat("0", 64), "sha256"); err != errChecksumMismatch {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package gym
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrataFilter selects advisories of the updateinfo metadata. An advisory is selected if it
+// matches all non empty criteria.
+type ErrataFilter struct {
+	Types       []string  // advisory types e.g: security, bugfix or enhancement
+	Severities  []string  // severities e.g: Critical, Important, Moderate or Low
+	IDs         []string  // advisory ids, globs are supported e.g: RHSA-2026:*
+	IssuedUntil time.Time // only advisories issued on or before this day
+}
+
+// empty reports whether no criteria are set, an empty filter selects all advisories.
+func (f ErrataFilter) empty() bool {
+	return len(f.Types) == 0 && len(f.Severities) == 0 && len(f.IDs) == 0 && f.IssuedUntil.IsZero()
+}
+
+// match reports whether the update element u is selected by the filter.
+func (f ErrataFilter) match(u *xmlNode) bool {
+	if len(f.Types) > 0 && !containsFold(f.Types, u.attr("type")) {
+		return false
+	}
+	if len(f.Severities) > 0 {
+		severity := u.child("severity")
+		if severity == nil || !containsFold(f.Severities, strings.TrimSpace(severity.Content)) {
+			return false
+		}
+	}
+	if len(f.IDs) > 0 {
+		id := u.child("id")
+		if id == nil {
+			return false
+		}
+		found := false
+		for _, pattern := range f.IDs {
+			if ok, _ := path.Match(pattern, strings.TrimSpace(id.Content)); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.IssuedUntil.IsZero() {
+		issued, ok := updateIssued(u)
+		end := time.Date(f.IssuedUntil.Year(), f.IssuedUntil.Month(), f.IssuedUntil.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+		if !ok || !issued.Before(end) {
+			return false
+		}
+	}
+	return true
+}
+
+// updateIssued returns the issue date of the update element u.
+func updateIssued(u *xmlNode) (time.Time, bool) {
+	issued := u.child("issued")
+	if issued == nil {
+		return time.Time{}, false
+	}
+	date := strings.TrimSpace(issued.attr("date"))
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04:05 UTC", "2006-01-02T15:04:05Z07:00", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, date, time.UTC); err == nil {
+			return t, true
+		}
+	}
+	// some generators write seconds since the epoch
+	if seconds, err := strconv.ParseInt(date, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// attr returns the value of the attribute with name or an empty string.
+func (n *xmlNode) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// selectErrata restricts the rpms to sync to the packages of the advisories selected by Errata.
+// An existing selection, e.g. from ResolvePackages, is restricted further. Packages not matching
+// the repository's filters and filter are not considered.
+func (r *Repo) selectErrata(filter string) error {
+	f, err := r.rpmFilter(filter)
+	if err != nil {
+		return err
+	}
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		return err
+	}
+	updates, err := r.readUpdateinfo(metaFiles)
+	if err != nil {
+		return err
+	}
+	advisories := 0
+	filenames := map[string]bool{}
+	for i := range updates {
+		if !r.Errata.match(&updates[i]) {
+			continue
+		}
+		advisories++
+		for _, filename := range updateFilenames(&updates[i]) {
+			filenames[filename] = true
+		}
+	}
+	pkgs, err := r.loadPrimary()
+	if err != nil {
+		return err
+	}
+	selected := r.selectedRPMs()
+	selection := []*rpm{}
+	for _, p := range pkgs {
+		if selected != nil && !selected[p.Location.Href] || !filenames[path.Base(p.Location.Href)] || !f.match(p) {
+			continue
+		}
+		selection = append(selection, p.rpm())
+	}
+	sort.Slice(selection, func(i, j int) bool {
+		return selection[i].relPath < selection[j].relPath
+	})
+	r.selection = selection
+	Log.Info("selected errata packages", "name", r.Name, "advisories", advisories, "packages", len(selection))
+	return nil
+}
+
+// updateFilenames returns the rpm file names of all packages of the update element u.
+func updateFilenames(u *xmlNode) []string {
+	filenames := []string{}
+	pkglist := u.child("pkglist")
+	if pkglist == nil {
+		return filenames
+	}
+	for _, c := range pkglist.Nodes {
+		for _, n := range c.Nodes {
+			if n.XMLName.Local != "package" {
+				continue
+			}
+			if filename := n.child("filename"); filename != nil {
+				filenames = append(filenames, path.Base(strings.TrimSpace(filename.Content)))
+			}
+		}
+	}
+	return filenames
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
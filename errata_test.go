@@ -0,0 +1,143 @@
+package gym
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testErrata = `<?xml version="1.0" encoding="UTF-8"?>
+<updates>
+  <update from="security@example.com" status="final" type="security" version="1">
+    <id>EXSA-2026:0001</id>
+    <severity>Important</severity>
+    <issued date="2026-09-01 10:00:00"/>
+    <pkglist>
+      <collection short="ex">
+        <package name="foo" version="2.0" release="1" epoch="0" arch="x86_64">
+          <filename>foo-2.0-1.x86_64.rpm</filename>
+        </package>
+      </collection>
+    </pkglist>
+  </update>
+  <update from="security@example.com" status="final" type="bugfix" version="1">
+    <id>EXBA-2026:0002</id>
+    <issued date="2026-09-15"/>
+    <pkglist>
+      <collection short="ex">
+        <package name="bar" version="1.0" release="1" epoch="0" arch="noarch">
+          <filename>bar-1.0-1.noarch.rpm</filename>
+        </package>
+      </collection>
+    </pkglist>
+  </update>
+  <update from="security@example.com" status="final" type="security" version="1">
+    <id>EXSA-2026:0003</id>
+    <severity>Critical</severity>
+    <issued date="1791244800"/>
+    <pkglist>
+      <collection short="ex">
+        <package name="foo" version="3.0" release="1" epoch="0" arch="x86_64">
+          <filename>foo-3.0-1.x86_64.rpm</filename>
+        </package>
+      </collection>
+    </pkglist>
+  </update>
+</updates>
+`
+
+func TestErrataFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := createRepodata(dir, DefaultRepodataOptions(), map[string][]byte{"updateinfo": []byte(testErrata)}); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepo(dir, nil, nil, 0)
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, err := r.readUpdateinfo(metaFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		filter   ErrataFilter
+		expected string
+	}{
+		{ErrataFilter{}, "EXSA-2026:0001 EXBA-2026:0002 EXSA-2026:0003"},
+		{ErrataFilter{Types: []string{"Security"}}, "EXSA-2026:0001 EXSA-2026:0003"},
+		{ErrataFilter{Severities: []string{"critical", "moderate"}}, "EXSA-2026:0003"},
+		{ErrataFilter{IDs: []string{"EXBA-*", "EXSA-2026:0003"}}, "EXBA-2026:0002 EXSA-2026:0003"},
+		{ErrataFilter{IssuedUntil: time.Date(2026, 9, 15, 0, 0, 0, 0, time.UTC)}, "EXSA-2026:0001 EXBA-2026:0002"},
+		{ErrataFilter{Types: []string{"security"}, IssuedUntil: time.Date(2026, 9, 30, 0, 0, 0, 0, time.UTC)}, "EXSA-2026:0001"},
+	}
+	for _, test := range tests {
+		got := []string{}
+		for i := range updates {
+			if test.filter.match(&updates[i]) {
+				got = append(got, strings.TrimSpace(updates[i].child("id").Content))
+			}
+		}
+		if strings.Join(got, " ") != test.expected {
+			t.Errorf("filter %+v: expected %s, got %v", test.filter, test.expected, got)
+		}
+	}
+}
+
+func TestSnapshotErrata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := path.Join(dir, "source")
+	for _, v := range []string{"1.0", "2.0", "3.0"} {
+		testNamedRPM(t, source, "foo", v, "1", "x86_64")
+	}
+	testNamedRPM(t, source, "bar", "1.0", "1", "noarch")
+	if err := createRepodata(source, DefaultRepodataOptions(), map[string][]byte{"updateinfo": []byte(testErrata)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, createRepo := range []bool{false, true} {
+		r := NewRepo(source, nil, nil, 0)
+		r.Errata = ErrataFilter{Types: []string{"security"}, IssuedUntil: time.Date(2026, 9, 30, 0, 0, 0, 0, time.UTC)}
+		dest := path.Join(dir, "snapshot")
+		if err := r.Snapshot(dest, false, SnapshotCopy, createRepo, 1); err != nil {
+			t.Fatal(err)
+		}
+		snapshot := NewRepo(path.Join(dest, "source"), nil, nil, 0)
+		rpms, err := findRPMs(snapshot.LocalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(rpms, " ") != "Packages/foo-2.0-1.x86_64.rpm" {
+			t.Errorf("createrepo %t: expected only foo-2.0, got %v", createRepo, rpms)
+		}
+		pkgs := readPrimaryXML(t, snapshot.LocalPath)
+		if len(pkgs) != 1 || pkgs[0].Location.Href != "Packages/foo-2.0-1.x86_64.rpm" {
+			t.Errorf("createrepo %t: expected only foo-2.0 in primary, got %d packages", createRepo, len(pkgs))
+		}
+		metaFiles, err := snapshot.lsMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		updates, err := snapshot.readUpdateinfo(metaFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(updates) != 1 || strings.TrimSpace(updates[0].child("id").Content) != "EXSA-2026:0001" {
+			t.Errorf("createrepo %t: expected only advisory EXSA-2026:0001, got %d advisories", createRepo, len(updates))
+		}
+		if err := os.RemoveAll(dest); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
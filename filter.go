@@ -0,0 +1,348 @@
+package gym
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// filterColumns are the string fields of filter conditions with their packages table column.
+var filterColumns = map[string]string{
+	"name":    "name",
+	"arch":    "arch",
+	"license": "rpm_license",
+	"group":   "rpm_group",
+	"href":    "location_href",
+}
+
+var (
+	filterCondRe = regexp.MustCompile(`^([^\s=!<>~]+)\s*(<=|>=|!=|!~|=|<|>|~)\s*(.+)$`)
+	filterAndRe  = regexp.MustCompile(`(^|\s+)and(\s+|$)`)
+	filterSizeRe = regexp.MustCompile(`^(?i)(\d+)\s*([kmg]?)b?$`)
+	filterEVRRe  = regexp.MustCompile(`^(\d+:)?\d[\w.+~^]*(-[\w.+~^]+)?$`)
+)
+
+// filterCond is a condition of a filter expression.
+type filterCond struct {
+	field string         // name, arch, license, group, href, size, evr or pkgspec
+	op    string         // =, !=, ~, !~, <, <=, > or >=
+	arg   string         // glob, regular expression or the name glob of a version comparison
+	re    *regexp.Regexp // compiled arg
+	size  int64
+	evr   [3]string // epoch, version and release of a version comparison
+}
+
+// filterExpr is a parsed filter expression, a package matches if all conditions match.
+type filterExpr []filterCond
+
+// parseFilter parses a package filter expression. An expression is a list of conditions
+// joined by "and":
+//
+//	name=kernel*          glob on the name, arch, license, group or href (the location)
+//	license!=GPL*         the glob does not match
+//	name~^kernel-(core)$  regular expression, !~ negates it
+//	kernel >= 5.14        version of the packages whose name matches the glob, compared with
+//	                      =, !=, <, <=, > or >= to [epoch:]version[-release], the version has
+//	                      to start with a digit
+//	size<10M              package size in bytes, the suffixes K, M and G are supported
+//	el7                   bare words match locations containing the word, like href=*el7*
+func parseFilter(expr string) (filterExpr, error) {
+	e := filterExpr{}
+	for _, s := range filterAndRe.Split(strings.TrimSpace(expr), -1) {
+		c, err := parseFilterCond(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %s", expr, err)
+		}
+		e = append(e, c)
+	}
+	return e, nil
+}
+
+// parseFilters parses a list of filter expressions.
+func parseFilters(exprs []string) ([]filterExpr, error) {
+	filters := []filterExpr{}
+	for _, expr := range exprs {
+		e, err := parseFilter(expr)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, e)
+	}
+	return filters, nil
+}
+
+// andFilters returns the filters matching a package if it matches one of the filters a and one
+// of the filters b, no filters match every package.
+func andFilters(a, b []filterExpr) []filterExpr {
+	if len(b) == 0 {
+		return a
+	}
+	if len(a) == 0 {
+		a = []filterExpr{{}}
+	}
+	filters := []filterExpr{}
+	for _, ea := range a {
+		for _, eb := range b {
+			filters = append(filters, append(append(filterExpr{}, ea...), eb...))
+		}
+	}
+	return filters
+}
+
+func parseFilterCond(s string) (filterCond, error) {
+	if len(s) == 0 {
+		return filterCond{}, fmt.Errorf("empty condition")
+	}
+	m := filterCondRe.FindStringSubmatch(s)
+	if m == nil {
+		if strings.ContainsAny(s, " \t=!<>~") {
+			return filterCond{}, fmt.Errorf("invalid condition %q", s)
+		}
+		m = []string{s, "href", "=", "*" + s + "*"}
+	}
+	c := filterCond{field: m[1], op: m[2], arg: m[3]}
+	var err error
+	switch _, isString := filterColumns[c.field]; {
+	case isString:
+		switch c.op {
+		case "=", "!=":
+			c.re, err = globRegexp(c.arg)
+		case "~", "!~":
+			c.re, err = regexp.Compile(c.arg)
+		default:
+			err = fmt.Errorf("operator %s is not supported for %s", c.op, c.field)
+		}
+	case c.field == "size":
+		sm := filterSizeRe.FindStringSubmatch(c.arg)
+		if sm == nil || c.op == "~" || c.op == "!~" {
+			return c, fmt.Errorf("invalid size condition %q", s)
+		}
+		c.size, _ = strconv.ParseInt(sm[1], 10, 64)
+		switch strings.ToLower(sm[2]) {
+		case "k":
+			c.size = c.size << 10
+		case "m":
+			c.size = c.size << 20
+		case "g":
+			c.size = c.size << 30
+		}
+	default:
+		// a misspelled field must not become a version comparison of a package with its name
+		if c.op == "~" || c.op == "!~" || !filterEVRRe.MatchString(m[3]) {
+			return c, fmt.Errorf("unknown field %s", c.field)
+		}
+		c.field, c.arg = "evr", m[1]
+		c.evr[0], c.evr[1], c.evr[2] = splitEVR(m[3])
+		c.re, err = globRegexp(c.arg)
+	}
+	return c, err
+}
+
+// parsePkgSpec parses a yum package spec as used by exclude= and includepkgs=. It is a glob
+// matched like yum does against the name and the forms of name, arch, epoch, version and release
+// returned by pkgSpecs.
+func parsePkgSpec(spec string) (filterCond, error) {
+	// yum uses fnmatch, which negates sets with [!...] instead of [^...]
+	glob := strings.Replace(spec, "[!", "[^", -1)
+	re, err := globRegexp(glob)
+	if err != nil {
+		return filterCond{}, fmt.Errorf("invalid package spec %q: %s", spec, err)
+	}
+	return filterCond{field: "pkgspec", op: "=", arg: glob, re: re}, nil
+}
+
+// pkgSpecColumns are the sql expressions of the forms returned by pkgSpecs.
+var pkgSpecColumns = []string{
+	"name",
+	"name || '.' || arch",
+	"name || '-' || version",
+	"name || '-' || version || '-' || release",
+	"name || '-' || version || '-' || release || '.' || arch",
+	"coalesce(epoch, '0') || ':' || name || '-' || version || '-' || release || '.' || arch",
+	"name || '-' || coalesce(epoch, '0') || ':' || version || '-' || release || '.' || arch",
+}
+
+// pkgSpecs returns the forms of a package a yum package spec is matched against: name,
+// name.arch, name-ver, name-ver-rel, name-ver-rel.arch, epoch:name-ver-rel.arch and
+// name-epoch:ver-rel.arch.
+func pkgSpecs(p *pkgMeta) []string {
+	epoch := p.Version.Epoch
+	if len(epoch) == 0 {
+		epoch = "0"
+	}
+	nv := p.Name + "-" + p.Version.Ver
+	nvr := nv + "-" + p.Version.Rel
+	return []string{
+		p.Name,
+		p.Name + "." + p.Arch,
+		nv,
+		nvr,
+		nvr + "." + p.Arch,
+		epoch + ":" + nvr + "." + p.Arch,
+		p.Name + "-" + epoch + ":" + p.Version.Ver + "-" + p.Version.Rel + "." + p.Arch,
+	}
+}
+
+// globRegexp converts a glob with the wildcards *, ? and [...] of the sqlite glob operator to
+// an anchored regular expression.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	b := new(strings.Builder)
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			// a ] directly after [ or [^ is part of the set
+			start := i + 1
+			if start < len(glob) && glob[start] == '^' {
+				start++
+			}
+			if start < len(glob) && glob[start] == ']' {
+				start++
+			}
+			end := strings.IndexByte(glob[start:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in %q", glob)
+			}
+			end = end + start
+			set := strings.NewReplacer(`\`, `\\`, `[`, `\[`).Replace(glob[i+1 : end])
+			if strings.HasPrefix(set, "^]") {
+				set = `^\]` + set[2:]
+			} else if strings.HasPrefix(set, "]") {
+				set = `\]` + set[1:]
+			}
+			b.WriteString("[" + set + "]")
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// match reports whether the package p matches all conditions.
+func (e filterExpr) match(p *pkgMeta) bool {
+	for _, c := range e {
+		if !c.match(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// sql returns the expression as condition for the packages table with its arguments, exact
+// is false if the condition selects more packages than match. An expression without sql
+// conditions is the condition 1.
+func (e filterExpr) sql() (string, []interface{}, bool) {
+	conditions := []string{}
+	args := []interface{}{}
+	exact := true
+	for _, c := range e {
+		condition, a, ok := c.sql()
+		exact = exact && ok
+		if len(condition) > 0 {
+			conditions = append(conditions, condition)
+			args = append(args, a...)
+		}
+	}
+	if len(conditions) == 0 {
+		return "1", nil, exact
+	}
+	return "(" + strings.Join(conditions, " and ") + ")", args, exact
+}
+
+func (c filterCond) match(p *pkgMeta) bool {
+	switch c.field {
+	case "size":
+		return compareResult(c.op, compareInt(p.Size.Package, c.size))
+	case "evr":
+		return c.re.MatchString(p.Name) && compareResult(c.op, evrcmp(p.Version.Epoch, p.Version.Ver, p.Version.Rel, c.evr[0], c.evr[1], c.evr[2]))
+	case "pkgspec":
+		for _, s := range pkgSpecs(p) {
+			if c.re.MatchString(s) {
+				return true
+			}
+		}
+		return false
+	}
+	var value string
+	switch c.field {
+	case "name":
+		value = p.Name
+	case "arch":
+		value = p.Arch
+	case "license":
+		value = p.Format.License
+	case "group":
+		value = p.Format.Group
+	case "href":
+		value = p.Location.Href
+	}
+	if c.op == "!=" || c.op == "!~" {
+		return !c.re.MatchString(value)
+	}
+	return c.re.MatchString(value)
+}
+
+// sql returns the condition for the packages table, missing values are empty strings like
+// in the xml metadata. Regular expressions and version comparisons need functions which the
+// sqlite driver only supports with cgo, exact is false for them: their condition is empty or
+// only compares the name and match has to check the packages.
+func (c filterCond) sql() (string, []interface{}, bool) {
+	switch c.field {
+	case "size":
+		return "size_package " + c.op + " ?", []interface{}{c.size}, true
+	case "evr":
+		return "name glob ?", []interface{}{c.arg}, false
+	case "pkgspec":
+		conditions := []string{}
+		args := []interface{}{}
+		for _, column := range pkgSpecColumns {
+			conditions = append(conditions, column+" glob ?")
+			args = append(args, c.arg)
+		}
+		return "(" + strings.Join(conditions, " or ") + ")", args, true
+	}
+	column := "coalesce(" + filterColumns[c.field] + ", '')"
+	switch c.op {
+	case "!=":
+		return "not " + column + " glob ?", []interface{}{c.arg}, true
+	case "~", "!~":
+		return "", nil, false
+	}
+	return column + " glob ?", []interface{}{c.arg}, true
+}
+
+// compareResult reports whether the result of a comparison (-1, 0 or 1) satisfies op.
+func compareResult(op string, result int) bool {
+	switch op {
+	case "=":
+		return result == 0
+	case "!=":
+		return result != 0
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	}
+	return false
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,214 @@
+package gym
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	for _, expr := range []string{"", "name=kernel and", "name<kernel", "size=10X", "foo~bar", "name=[abc", "name~(", "a b"} {
+		if _, err := parseFilter(expr); err == nil {
+			t.Errorf("expected error for filter %q", expr)
+		}
+	}
+	// misspelled fields are not version comparisons
+	for _, expr := range []string{"nme=kernel", "licence=GPL*", "arhc!=i686", "kernel>=v5"} {
+		if _, err := parseFilter(expr); err == nil || !strings.Contains(err.Error(), "unknown field") {
+			t.Errorf("expected unknown field error for filter %q, got %v", expr, err)
+		}
+	}
+	e, err := parseFilter("kernel >= 1:5.14-1 and size<2M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e) != 2 || e[0].field != "evr" || e[0].arg != "kernel" || e[0].evr != [3]string{"1", "5.14", "1"} || e[1].size != 2<<20 {
+		t.Errorf("unexpected filter %+v", e)
+	}
+	// bare words match the location like the substring filter of earlier versions
+	e, err = parseFilter("el7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e) != 1 || e[0].field != "href" || e[0].arg != "*el7*" {
+		t.Errorf("unexpected filter %+v", e)
+	}
+}
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		s       string
+		matches bool
+	}{
+		{"kernel*", "kernel-core", true},
+		{"kernel*", "akernel", false},
+		{"i?86", "i686", true},
+		{"i[3-6]86", "i786", false},
+		{"[^a]*", "abc", false},
+		{"[]x]", "]", true},
+		{"a.b", "axb", false},
+		{`a\b`, `a\b`, true},
+	}
+	for _, test := range tests {
+		re, err := globRegexp(test.glob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if re.MatchString(test.s) != test.matches {
+			t.Errorf("glob %s on %s: expected %t", test.glob, test.s, test.matches)
+		}
+	}
+}
+
+// testFilterRepo creates a repository with GeoIP-devel and kernel packages in a temporary directory.
+func testFilterRepo(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(dir, "Packages"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile("testdata/repo/Packages/GeoIP-devel-1.5.0-9.el7.i686.rpm", path.Join(dir, "Packages/GeoIP-devel-1.5.0-9.el7.i686.rpm")); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"5.9", "5.14", "5.14~rc1", "6.1"} {
+		testNamedRPM(t, dir, "kernel", v, "1", "x86_64")
+	}
+	testNamedRPM(t, dir, "kernel-tools", "5.14", "2", "x86_64")
+	if err := CreateRepo(dir, DefaultRepodataOptions()); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// testFilteredRPMs returns the rpms of r selected with filter from the sqlite and from the xml metadata.
+func testFilteredRPMs(t *testing.T, r *Repo, filter string) map[string]string {
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := r.rpmFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := map[string]string{}
+	for _, fileType := range []string{"primary_db", "primary"} {
+		primary, _ := metaFiles.get(fileType)
+		if fileType == "primary_db" {
+			err = r.rpmListFromSqlite(f, primary)
+		} else {
+			err = r.rpmListFromXML(f, primary)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for rpm := range r.rpmc {
+			got = append(got, strings.TrimSuffix(path.Base(rpm.relPath), ".rpm"))
+		}
+		if err := <-r.errorc; err != nil {
+			t.Fatal(err)
+		}
+		if r.total != len(got) {
+			t.Errorf("%s: total is %d, but %d rpms are listed", fileType, r.total, len(got))
+		}
+		sort.Strings(got)
+		selected[fileType] = strings.Join(got, " ")
+	}
+	return selected
+}
+
+// TestFilterSqliteXML checks that the filters select the same packages from sqlite and xml metadata.
+func TestFilterSqliteXML(t *testing.T) {
+	dir := testFilterRepo(t)
+	defer os.RemoveAll(dir)
+	r := NewRepo(dir, nil, nil, 0)
+
+	tests := []struct {
+		include  []string
+		exclude  []string
+		filter   string
+		expected string
+	}{
+		{nil, nil, "", "GeoIP-devel-1.5.0-9.el7.i686 kernel-5.14-1.x86_64 kernel-5.14~rc1-1.x86_64 kernel-5.9-1.x86_64 kernel-6.1-1.x86_64 kernel-tools-5.14-2.x86_64"},
+		{[]string{"kernel >= 5.14"}, nil, "", "kernel-5.14-1.x86_64 kernel-6.1-1.x86_64"},
+		{[]string{"kernel* = 5.14"}, nil, "", "kernel-5.14-1.x86_64 kernel-tools-5.14-2.x86_64"},
+		{[]string{"kernel"}, []string{"kernel < 5.14", "name~tools$"}, "", "kernel-5.14-1.x86_64 kernel-6.1-1.x86_64"},
+		{[]string{"license~GPL", "name=kernel and arch=x86_64 and kernel > 6"}, nil, "", "GeoIP-devel-1.5.0-9.el7.i686 kernel-6.1-1.x86_64"},
+		{[]string{"group=Development/*"}, nil, "", "GeoIP-devel-1.5.0-9.el7.i686"},
+		{[]string{"size>10k"}, nil, "", "GeoIP-devel-1.5.0-9.el7.i686"},
+		{[]string{"href=Packages/G*"}, []string{"license!=LGPL*"}, "", "GeoIP-devel-1.5.0-9.el7.i686"},
+		{nil, []string{"group!=Development/*"}, "", "GeoIP-devel-1.5.0-9.el7.i686"},
+		// the filter of Sync narrows the includes
+		{[]string{"kernel", "GeoIP"}, nil, "tools", "kernel-tools-5.14-2.x86_64"},
+		{[]string{"kernel >= 5.14"}, nil, "kernel < 6", "kernel-5.14-1.x86_64"},
+		{nil, nil, "GeoIP", "GeoIP-devel-1.5.0-9.el7.i686"},
+		{nil, nil, "el7", "GeoIP-devel-1.5.0-9.el7.i686"},
+		{[]string{"kernel"}, nil, "x86_64", "kernel-5.14-1.x86_64 kernel-5.14~rc1-1.x86_64 kernel-5.9-1.x86_64 kernel-6.1-1.x86_64 kernel-tools-5.14-2.x86_64"},
+	}
+	for _, test := range tests {
+		r.Include = test.include
+		r.Exclude = test.exclude
+		for fileType, got := range testFilteredRPMs(t, r, test.filter) {
+			if got != test.expected {
+				t.Errorf("%s: include %v exclude %v filter %q: expected %s, got %s", fileType, test.include, test.exclude, test.filter, test.expected, got)
+			}
+		}
+	}
+}
+
+func TestRepoFileExcludes(t *testing.T) {
+	dir := testFilterRepo(t)
+	defer os.RemoveAll(dir)
+	repoFile := path.Join(dir, "test.repo")
+	data := `[repo]
+baseurl=http://mirror.example.com/$releasever/$basearch/
+exclude=kernel-5.9* kernel-[!0-9]*,*.$basearch
+includepkgs=GeoIP* kernel-tools kernel-5.14-1.x86_64 0:kernel-5.9-1.x86_64
+`
+	if err := ioutil.WriteFile(repoFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repos, err := NewRepoList(repoFile, dir, false, "7", "i686", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := repos.Find("repo")
+	if strings.Join(r.ExcludePkgs, " ") != "kernel-5.9* kernel-[!0-9]* *.i686" {
+		t.Errorf("unexpected exclude %v", r.ExcludePkgs)
+	}
+	r.LocalPath = dir
+
+	tests := []struct {
+		include  []string
+		exclude  []string
+		expected string
+	}{
+		{[]string{"GeoIP* kernel-tools kernel-5.14-1.x86_64 0:kernel-5.9-1.x86_64"}, []string{"kernel-5.9* kernel-[!0-9]*"}, "GeoIP-devel-1.5.0-9.el7.i686 kernel-5.14-1.x86_64"},
+		{nil, []string{"kernel-5.9* kernel-[!0-9]* *.i686"}, "kernel-5.14-1.x86_64 kernel-5.14~rc1-1.x86_64 kernel-6.1-1.x86_64"},
+		{[]string{"kernel-5.14-1.x86_64 0:kernel-5.9-1.x86_64 kernel-0:6.1-1.x86_64"}, nil, "kernel-5.14-1.x86_64 kernel-5.9-1.x86_64 kernel-6.1-1.x86_64"},
+		{[]string{"kernel.x86_64 kernel-5.9"}, []string{"kernel-5.14-*"}, "kernel-5.14~rc1-1.x86_64 kernel-5.9-1.x86_64 kernel-6.1-1.x86_64"},
+	}
+	for _, test := range tests {
+		r.IncludePkgs = strings.Fields(strings.Join(test.include, " "))
+		r.ExcludePkgs = strings.Fields(strings.Join(test.exclude, " "))
+		for fileType, got := range testFilteredRPMs(t, r, "") {
+			if got != test.expected {
+				t.Errorf("%s: includepkgs %v exclude %v: expected %s, got %s", fileType, test.include, test.exclude, test.expected, got)
+			}
+		}
+	}
+
+	r.IncludePkgs = []string{"kernel*"}
+	r.ExcludePkgs = nil
+	r.Include = []string{"kernel < 5.14"}
+	if got := testFilteredRPMs(t, r, "")["primary"]; got != "kernel-5.14~rc1-1.x86_64 kernel-5.9-1.x86_64" {
+		t.Errorf("expected filter expressions and includepkgs to apply both, got %s", got)
+	}
+}
@@ -0,0 +1,304 @@
+package gym
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// FilterRepodata rewrites the repodata in LocalPath so that primary, filelists, other and
+// updateinfo contain only the packages present in LocalPath. If the rpms to sync have been
+// selected, e.g. with KeepNewest, only selected packages are kept. Updateinfo contains only the
+// advisories selected by Errata, modules only the streams selected by Modules with kept packages.
+// The comps group file is kept, other metadata types like deltas are dropped. If all packages are
+// present and no advisories or module streams are selected, the repodata is left unchanged.
+func (r *Repo) FilterRepodata() error {
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		return err
+	}
+	pkgs, total, err := r.presentPackages(metaFiles)
+	if err != nil {
+		return err
+	}
+	if len(pkgs) == total && r.Errata.empty() && len(r.Modules) == 0 {
+		Log.Debug("all packages present, repodata not filtered", "name", r.Name, "packages", total)
+		return nil
+	}
+	kept := map[string]bool{}
+	for _, p := range pkgs {
+		kept[path.Base(p.Location.Href)] = true
+	}
+	extra := map[string][]byte{}
+	updateinfo, err := r.filteredUpdateinfo(metaFiles, kept)
+	if err != nil {
+		return err
+	}
+	if updateinfo != nil {
+		extra["updateinfo"] = updateinfo
+	}
+	modules, err := r.filteredModules(metaFiles, pkgs)
+	if err != nil {
+		return err
+	}
+	if modules != nil {
+		extra["modules"] = modules
+	}
+	opts := r.Repodata
+	if meta, ok := metaFiles.get("group"); ok {
+		opts.GroupFile = path.Join(r.LocalPath, meta.href)
+	}
+	if err := writeRepodata(r.LocalPath, pkgs, opts, extra); err != nil {
+		return err
+	}
+	Log.Info("filtered repodata", "name", r.Name, "packages", len(pkgs), "removed", total-len(pkgs))
+	return nil
+}
+
+// filtersRepodata reports whether the repodata of synced repositories and snapshots is filtered.
+func (r *Repo) filtersRepodata() bool {
+	return r.FilterMeta || r.KeepNewest > 0 || !r.Errata.empty() || len(r.Modules) > 0
+}
+
+// presentPackages reads the packages from the xml metadata and returns the packages whose
+// rpm exists in LocalPath and which are selected together with the total number of packages.
+func (r *Repo) presentPackages(metaFiles metaFiles) ([]*pkgMeta, int, error) {
+	primary, ok := metaFiles.get("primary")
+	if !ok {
+		return nil, 0, errors.New("no primary xml file found")
+	}
+	selected := r.selectedRPMs()
+	pkgs := []*pkgMeta{}
+	byID := map[string]*pkgMeta{}
+	total := 0
+	err := r.decodePackages(primary, func(d *xml.Decoder, se *xml.StartElement) error {
+		p := &pkgMeta{}
+		if err := d.DecodeElement(p, se); err != nil {
+			return err
+		}
+		total++
+		if selected != nil && !selected[p.Location.Href] {
+			return nil
+		}
+		if fi, err := os.Stat(path.Join(r.LocalPath, p.Location.Href)); err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		pkgs = append(pkgs, p)
+		byID[p.Checksum.Value] = p
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if filelists, ok := metaFiles.get("filelists"); ok {
+		err := r.decodePackages(filelists, func(d *xml.Decoder, se *xml.StartElement) error {
+			var fl struct {
+				PkgID string    `xml:"pkgid,attr"`
+				Files []pkgFile `xml:"file"`
+			}
+			if err := d.DecodeElement(&fl, se); err != nil {
+				return err
+			}
+			if p, ok := byID[fl.PkgID]; ok {
+				p.Files = fl.Files
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if other, ok := metaFiles.get("other"); ok {
+		err := r.decodePackages(other, func(d *xml.Decoder, se *xml.StartElement) error {
+			var o struct {
+				PkgID      string         `xml:"pkgid,attr"`
+				Changelogs []pkgChangelog `xml:"changelog"`
+			}
+			if err := d.DecodeElement(&o, se); err != nil {
+				return err
+			}
+			if p, ok := byID[o.PkgID]; ok {
+				p.Changelogs = o.Changelogs
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return pkgs, total, nil
+}
+
+// decodePackages calls fn for every package element of a compressed xml metadata file.
+func (r *Repo) decodePackages(meta metaFile, fn func(*xml.Decoder, *xml.StartElement) error) error {
+	tmpFile, err := uncompress(r.metaPath(meta))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	return processXML(tmpFile.Name(), func(decoder *xml.Decoder) error {
+		for {
+			t, err := decoder.Token()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if se, ok := t.(xml.StartElement); ok && se.Name.Local == "package" {
+				if err := fn(decoder, &se); err != nil {
+					return err
+				}
+			}
+		}
+	})
+}
+
+// xmlNode is a generic xml element, it is used to filter documents without knowing all elements.
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Content string     `xml:",chardata"`
+	Nodes   []xmlNode  `xml:",any"`
+}
+
+// child returns the first child element with name.
+func (n *xmlNode) child(name string) *xmlNode {
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == name {
+			return &n.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// trim removes whitespace only content of elements with children, the encoder indents the output.
+func (n *xmlNode) trim() {
+	if len(n.Nodes) > 0 && len(strings.TrimSpace(n.Content)) == 0 {
+		n.Content = ""
+	}
+	for i := range n.Nodes {
+		n.Nodes[i].trim()
+	}
+}
+
+// readUpdateinfo reads the updates of the repository's updateinfo, it returns nil if the
+// repository has no updateinfo.
+func (r *Repo) readUpdateinfo(metaFiles metaFiles) ([]xmlNode, error) {
+	meta, ok := metaFiles.get("updateinfo")
+	if !ok {
+		return nil, nil
+	}
+	tmpFile, err := uncompress(path.Join(r.LocalPath, meta.href))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+	updates := []xmlNode{}
+	err = processXML(tmpFile.Name(), func(decoder *xml.Decoder) error {
+		for {
+			t, err := decoder.Token()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if se, ok := t.(xml.StartElement); ok && se.Name.Local == "update" {
+				var u xmlNode
+				if err := decoder.DecodeElement(&u, &se); err != nil {
+					return err
+				}
+				updates = append(updates, u)
+			}
+		}
+	})
+	return updates, err
+}
+
+// filteredUpdateinfo returns the updateinfo with only the advisories selected by Errata and
+// only the packages whose file name is in kept. Collections and updates without packages are
+// removed. It returns nil if the repository has no updateinfo.
+func (r *Repo) filteredUpdateinfo(metaFiles metaFiles, kept map[string]bool) ([]byte, error) {
+	updates, err := r.readUpdateinfo(metaFiles)
+	if err != nil || updates == nil {
+		return nil, err
+	}
+	filtered := []xmlNode{}
+	for _, u := range updates {
+		if r.Errata.match(&u) && filterUpdate(&u, kept) {
+			filtered = append(filtered, u)
+		}
+	}
+	return marshalUpdateinfo(filtered)
+}
+
+// filterUpdate removes the packages not in kept from an update and reports whether the
+// update still contains packages.
+func filterUpdate(u *xmlNode, kept map[string]bool) bool {
+	pkglist := u.child("pkglist")
+	if pkglist == nil {
+		return false
+	}
+	collections := []xmlNode{}
+	for _, c := range pkglist.Nodes {
+		if c.XMLName.Local != "collection" {
+			continue
+		}
+		nodes := []xmlNode{}
+		found := false
+		for _, n := range c.Nodes {
+			if n.XMLName.Local == "package" {
+				filename := n.child("filename")
+				if filename == nil || !kept[path.Base(strings.TrimSpace(filename.Content))] {
+					continue
+				}
+				found = true
+			}
+			nodes = append(nodes, n)
+		}
+		if found {
+			c.Nodes = nodes
+			collections = append(collections, c)
+		}
+	}
+	pkglist.Nodes = collections
+	return len(collections) > 0
+}
+
+// marshalUpdateinfo encodes updates as updateinfo document.
+func marshalUpdateinfo(updates []xmlNode) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteString(xmlHeader)
+	root := xmlNode{XMLName: xml.Name{Local: "updates"}, Nodes: updates}
+	root.trim()
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(root); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// snapshotUpdateinfo returns the updateinfo of the repository filtered to the rpms in dir.
+func (r *Repo) snapshotUpdateinfo(dir string) ([]byte, error) {
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		return nil, err
+	}
+	rpms, err := findRPMs(dir)
+	if err != nil {
+		return nil, err
+	}
+	kept := map[string]bool{}
+	for _, rpm := range rpms {
+		kept[path.Base(rpm)] = true
+	}
+	return r.filteredUpdateinfo(metaFiles, kept)
+}
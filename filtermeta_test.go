@@ -0,0 +1,96 @@
+package gym
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testUpdateinfo = `<?xml version="1.0" encoding="UTF-8"?>
+<updates>
+  <update from="centos@centos.org" status="final" type="security" version="1">
+    <id>CESA-2015:0001</id>
+    <title>GeoIP update</title>
+    <pkglist>
+      <collection short="el7">
+        <name>CentOS 7</name>
+        <package name="GeoIP-devel" version="1.5.0" release="9.el7" epoch="0" arch="i686" src="GeoIP-1.5.0-9.el7.src.rpm">
+          <filename>GeoIP-devel-1.5.0-9.el7.i686.rpm</filename>
+        </package>
+        <package name="GeoIP-missing" version="1.5.0" release="9.el7" epoch="0" arch="i686" src="GeoIP-1.5.0-9.el7.src.rpm">
+          <filename>missing.rpm</filename>
+        </package>
+      </collection>
+    </pkglist>
+  </update>
+  <update from="centos@centos.org" status="final" type="bugfix" version="1">
+    <id>CEBA-2015:0002</id>
+    <pkglist>
+      <collection short="el7">
+        <package name="GeoIP-missing" version="1.5.0" release="9.el7" epoch="0" arch="i686">
+          <filename>missing.rpm</filename>
+        </package>
+      </collection>
+    </pkglist>
+  </update>
+</updates>
+`
+
+func TestFilterRepodata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(path.Join(dir, "Packages"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"GeoIP-devel-1.5.0-9.el7.i686.rpm", "missing.rpm"} {
+		if err := copyFile("testdata/repo/Packages/GeoIP-devel-1.5.0-9.el7.i686.rpm", path.Join(dir, "Packages", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := createRepodata(dir, DefaultRepodataOptions(), map[string][]byte{"updateinfo": []byte(testUpdateinfo)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(dir, "Packages/missing.rpm")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRepo(dir, nil, nil, 0)
+	if err := r.FilterRepodata(); err != nil {
+		t.Fatal(err)
+	}
+	pkgs := readPrimaryXML(t, dir)
+	if len(pkgs) != 1 || pkgs[0].Location.Href != "Packages/GeoIP-devel-1.5.0-9.el7.i686.rpm" {
+		t.Fatalf("expected only GeoIP-devel in primary, got %+v", pkgs)
+	}
+
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, total, err := r.presentPackages(metaFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(kept[0].Files) == 0 || len(kept[0].Changelogs) == 0 {
+		t.Errorf("filelists and other are not rewritten correctly: %d packages, %d files, %d changelogs", total, len(kept[0].Files), len(kept[0].Changelogs))
+	}
+	updates, err := r.readUpdateinfo(metaFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 {
+		t.Fatalf("expected 1 update, got %d", len(updates))
+	}
+	if id := updates[0].child("id").Content; id != "CESA-2015:0001" {
+		t.Errorf("expected update CESA-2015:0001, got %s", id)
+	}
+	collection := updates[0].child("pkglist").child("collection")
+	if len(collection.Nodes) != 2 || strings.TrimSpace(collection.child("package").child("filename").Content) != "GeoIP-devel-1.5.0-9.el7.i686.rpm" {
+		t.Errorf("unexpected collection after filtering: %+v", collection.Nodes)
+	}
+}
@@ -1,14 +1,21 @@
 module github.com/zbindenren/gym
 
-go 1.12
+go 1.22
 
 require (
-	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/jawher/mow.cli v1.0.4
-	github.com/mattn/go-colorable v0.0.9 // indirect
-	github.com/mattn/go-isatty v0.0.4 // indirect
+	github.com/klauspost/compress v1.18.0
 	github.com/mattn/go-sqlite3 v1.10.0
-	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
 	gopkg.in/inconshreveable/log15.v2 v2.0.0-20180818164646-67afb5ed74ec
 	gopkg.in/ini.v1 v1.41.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/go-stack/stack v1.8.0 // indirect
+	github.com/mattn/go-colorable v0.0.9 // indirect
+	github.com/mattn/go-isatty v0.0.4 // indirect
 )
@@ -0,0 +1,275 @@
+package gym
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+)
+
+// Signature verification results of an rpm.
+const (
+	SigSigned     = "signed"
+	SigUnsigned   = "unsigned"
+	SigBad        = "bad-signature"
+	SigUnknownKey = "unknown-key"
+	SigHeaderOnly = "header-only" // the header is signed, but the payload has no digest in it
+)
+
+// verifyRPMSignature verifies the OpenPGP signatures of an rpm against keyring. Header
+// only signatures are verified together with the payload digest of the signed header,
+// header and payload signatures over the whole header and payload. Header only signatures
+// of rpms without payload digest (built before rpm 4.14) do not cover the payload, the md5
+// of the signature header is not signed, SigHeaderOnly is returned for them. It returns one
+// of the Sig constants, for bad signatures and unknown keys also an error.
+func verifyRPMSignature(pathToRPM string, keyring openpgp.KeyRing) (string, error) {
+	f, err := os.Open(pathToRPM)
+	if err != nil {
+		return SigBad, err
+	}
+	defer f.Close()
+	rpmf, err := readRPMFile(f)
+	if err != nil {
+		return SigBad, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return SigBad, err
+	}
+
+	headerSigs := [][]byte{}
+	for _, tag := range []int{sigTagRSA, sigTagDSA} {
+		if sig := rpmf.signature.bytes(tag); sig != nil {
+			headerSigs = append(headerSigs, sig)
+		}
+	}
+	payloadSigs := [][]byte{}
+	for _, tag := range []int{sigTagPGP, sigTagGPG} {
+		if sig := rpmf.signature.bytes(tag); sig != nil {
+			payloadSigs = append(payloadSigs, sig)
+		}
+	}
+	if len(headerSigs) == 0 && len(payloadSigs) == 0 {
+		return SigUnsigned, nil
+	}
+
+	for _, sig := range headerSigs {
+		signed := io.NewSectionReader(f, rpmf.headerStart, rpmf.headerEnd-rpmf.headerStart)
+		if status, err := checkSignature(keyring, signed, sig); err != nil {
+			return status, err
+		}
+	}
+	for _, sig := range payloadSigs {
+		signed := io.NewSectionReader(f, rpmf.headerStart, fi.Size()-rpmf.headerStart)
+		if status, err := checkSignature(keyring, signed, sig); err != nil {
+			return status, err
+		}
+	}
+	if len(payloadSigs) == 0 {
+		if !rpmf.header.has(rpmTagPayloadDigest) {
+			return SigHeaderOnly, nil
+		}
+		payload := io.NewSectionReader(f, rpmf.headerEnd, fi.Size()-rpmf.headerEnd)
+		if err := checkPayloadDigest(rpmf.header, payload); err != nil {
+			return SigBad, err
+		}
+	}
+	return SigSigned, nil
+}
+
+// verifyDownload verifies the signature of a downloaded rpm. Packages with bad signatures,
+// unknown keys and, unless KeepUnsigned is set, without signature are removed.
+func (r *Repo) verifyDownload(pathToRPM string) (string, error) {
+	status, err := verifyRPMSignature(pathToRPM, r.keyring)
+	if err = r.acceptSignature(status, err); err != nil {
+		if rerr := os.Remove(pathToRPM); rerr != nil {
+			Log.Warn("could not remove rpm", "path", pathToRPM, "err", rerr)
+		}
+	}
+	return status, err
+}
+
+// acceptSignature returns an error if an rpm with the signature status must not be kept. An rpm
+// whose payload is not covered by the signature is treated like an unsigned rpm.
+func (r *Repo) acceptSignature(status string, err error) error {
+	if err != nil || r.KeepUnsigned {
+		return err
+	}
+	switch status {
+	case SigUnsigned:
+		return errors.New("package is not signed")
+	case SigHeaderOnly:
+		return errors.New("payload of package is not covered by its signature")
+	}
+	return nil
+}
+
+// checkSignature verifies the signature of the local rpm with verifyDownload, unless a signature
+// accepted by the repository has been recorded for the unchanged rpm. The status is recorded in
+// the state of the verified rpms.
+func (r *Repo) checkSignature(rpm *rpm, dest string) (string, error) {
+	if status := r.verified.signature(rpm.relPath, rpm.checksumType, rpm.checksum); !r.Reverify && status != "" && r.acceptSignature(status, nil) == nil {
+		return status, nil
+	}
+	status, err := r.verifyDownload(dest)
+	if err != nil {
+		r.verified.forget(rpm.relPath)
+		return status, err
+	}
+	r.verified.record(rpm.relPath, rpm.checksumType, rpm.checksum, status)
+	return status, nil
+}
+
+// verifyRepomdSignature verifies repomd.xml against its armored detached signature.
+func verifyRepomdSignature(pathToRepomd string, pathToSignature string, keyring openpgp.KeyRing) error {
+	repomd, err := os.Open(pathToRepomd)
+	if err != nil {
+		return err
+	}
+	defer repomd.Close()
+	sig, err := os.Open(pathToSignature)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, repomd, sig)
+	if err == pgperrors.ErrUnknownIssuer {
+		return errors.New("repomd.xml is signed with an unknown key")
+	}
+	if err != nil {
+		return fmt.Errorf("bad repomd.xml signature: %s", err)
+	}
+	return nil
+}
+
+// checkSignature verifies a binary detached signature of signed.
+func checkSignature(keyring openpgp.KeyRing, signed io.Reader, sig []byte) (string, error) {
+	_, err := openpgp.CheckDetachedSignature(keyring, signed, bytes.NewReader(sig))
+	if err == pgperrors.ErrUnknownIssuer {
+		return SigUnknownKey, errors.New("signed with unknown key")
+	}
+	if err != nil {
+		return SigBad, fmt.Errorf("bad signature: %s", err)
+	}
+	return SigSigned, nil
+}
+
+// checkPayloadDigest compares the payload with the payload digest of the header.
+func checkPayloadDigest(header *rpmHeader, payload io.Reader) error {
+	var h hash.Hash
+	// hash algorithms are numbered according to RFC 4880
+	switch header.int(rpmTagPayloadDigestAlgo) {
+	case 2:
+		h = sha1.New()
+	case 0, 8:
+		h = sha256.New()
+	case 10:
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported payload digest algorithm %d", header.int(rpmTagPayloadDigestAlgo))
+	}
+	if _, err := io.Copy(h, payload); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != header.string(rpmTagPayloadDigest) {
+		return errors.New("payload digest missmatch")
+	}
+	return nil
+}
+
+// initKeyring loads the keyring once for signature verification.
+func (r *Repo) initKeyring() error {
+	if r.keyring != nil {
+		return nil
+	}
+	keyring, err := r.loadKeyring()
+	if err != nil {
+		return err
+	}
+	r.keyring = keyring
+	return nil
+}
+
+// loadKeyring reads the public keys from the urls in GPGKeys and from all files in KeyringDir.
+func (r *Repo) loadKeyring() (openpgp.EntityList, error) {
+	keyring := openpgp.EntityList{}
+	for _, keyURL := range r.GPGKeys {
+		var data []byte
+		u, err := url.Parse(keyURL)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "http", "https":
+			data, err = r.get(keyURL)
+		case "file", "":
+			data, err = ioutil.ReadFile(u.Path)
+		default:
+			err = fmt.Errorf("unsupported url scheme %s", u.Scheme)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read gpg key %s: %s", keyURL, err)
+		}
+		keys, err := readKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not read gpg key %s: %s", keyURL, err)
+		}
+		keyring = append(keyring, keys...)
+	}
+	if len(r.KeyringDir) > 0 {
+		files, err := ioutil.ReadDir(r.KeyringDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(r.KeyringDir, fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+			keys, err := readKeys(data)
+			if err != nil {
+				Log.Warn("skipping keyring file", "file", fi.Name(), "err", err)
+				continue
+			}
+			keyring = append(keyring, keys...)
+		}
+	}
+	if len(keyring) == 0 {
+		return nil, errors.New("no gpg keys found")
+	}
+	Log.Debug("loaded gpg keys", "name", r.Name, "keys", len(keyring))
+	return keyring, nil
+}
+
+// readKeys reads binary or armored public keys, a file can contain several armored key blocks.
+func readKeys(data []byte) (openpgp.EntityList, error) {
+	const armorStart = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	if !bytes.Contains(data, []byte(armorStart)) {
+		return openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	keys := openpgp.EntityList{}
+	for _, block := range strings.Split(string(data), armorStart)[1:] {
+		k, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armorStart + block))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k...)
+	}
+	return keys, nil
+}
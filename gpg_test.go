@@ -0,0 +1,328 @@
+package gym
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+type testHeaderEntry struct {
+	tag  int32
+	typ  int32
+	data []byte
+}
+
+// testRPMHeader serializes a header structure.
+func testRPMHeader(entries []testHeaderEntry) []byte {
+	index := new(bytes.Buffer)
+	store := new(bytes.Buffer)
+	for _, e := range entries {
+		count := int32(1)
+		if e.typ == rpmTypeBin {
+			count = int32(len(e.data))
+		}
+		binary.Write(index, binary.BigEndian, rpmHeaderEntry{Tag: e.tag, Type: e.typ, Offset: int32(store.Len()), Count: count})
+		store.Write(e.data)
+	}
+	h := new(bytes.Buffer)
+	h.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	binary.Write(h, binary.BigEndian, uint32(len(entries)))
+	binary.Write(h, binary.BigEndian, uint32(store.Len()))
+	h.Write(index.Bytes())
+	h.Write(store.Bytes())
+	return h.Bytes()
+}
+
+// testRPM writes a minimal rpm with a header only signature of signer (if not nil).
+func testRPM(t *testing.T, dest string, signer *openpgp.Entity, payload []byte) {
+	digest := sha256.Sum256(payload)
+	algo := make([]byte, 4)
+	binary.BigEndian.PutUint32(algo, 8)
+	testRPMWithHeader(t, dest, signer, []testHeaderEntry{
+		{rpmTagPayloadDigest, rpmTypeStringArray, []byte(hex.EncodeToString(digest[:]) + "\x00")},
+		{rpmTagPayloadDigestAlgo, rpmTypeInt32, algo},
+	}, payload)
+}
+
+// testRPMWithHeader writes a minimal rpm with the header entries and a header only signature of
+// signer (if not nil).
+func testRPMWithHeader(t *testing.T, dest string, signer *openpgp.Entity, entries []testHeaderEntry, payload []byte) {
+	header := testRPMHeader(entries)
+	sigEntries := []testHeaderEntry{}
+	if signer != nil {
+		sig := new(bytes.Buffer)
+		if err := openpgp.DetachSign(sig, signer, bytes.NewReader(header), nil); err != nil {
+			t.Fatal(err)
+		}
+		sigEntries = append(sigEntries, testHeaderEntry{sigTagRSA, rpmTypeBin, sig.Bytes()})
+	}
+	sigHeader := testRPMHeader(sigEntries)
+
+	data := new(bytes.Buffer)
+	data.Write(rpmLeadMagic)
+	data.Write(make([]byte, rpmLeadSize-len(rpmLeadMagic)))
+	data.Write(sigHeader)
+	data.Write(make([]byte, (8-len(sigHeader)%8)%8))
+	data.Write(header)
+	data.Write(payload)
+	if err := ioutil.WriteFile(dest, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyRPMSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	signer, err := openpgp.NewEntity("gym", "test", "gym@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("other", "test", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the keyring is read from an armored key file
+	keyFile := path.Join(dir, "RPM-GPG-KEY-gym")
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := ioutil.WriteFile(keyFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepo(dir, nil, nil, 0)
+	r.GPGKeys = []string{"file://" + keyFile}
+	keyring, err := r.loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := path.Join(dir, "signed.rpm")
+	testRPM(t, signed, signer, []byte("payload"))
+	unsigned := path.Join(dir, "unsigned.rpm")
+	testRPM(t, unsigned, nil, []byte("payload"))
+	unknown := path.Join(dir, "unknown.rpm")
+	testRPM(t, unknown, other, []byte("payload"))
+	tampered := path.Join(dir, "tampered.rpm")
+	testRPM(t, tampered, signer, []byte("payload"))
+	f, err := os.OpenFile(tampered, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("evil"))
+	f.Close()
+
+	// without payload digest a header only signature does not cover the payload
+	legacy := path.Join(dir, "legacy.rpm")
+	testRPMWithHeader(t, legacy, signer, []testHeaderEntry{{rpmTagName, rpmTypeString, []byte("legacy\x00")}}, []byte("payload"))
+	legacyTampered := path.Join(dir, "legacy-tampered.rpm")
+	testRPMWithHeader(t, legacyTampered, signer, []testHeaderEntry{{rpmTagName, rpmTypeString, []byte("legacy\x00")}}, []byte("evil"))
+
+	tests := []struct {
+		rpm      string
+		expected string
+	}{
+		{signed, SigSigned},
+		{legacy, SigHeaderOnly},
+		{legacyTampered, SigHeaderOnly},
+		{unsigned, SigUnsigned},
+		{unknown, SigUnknownKey},
+		{tampered, SigBad},
+		{"testdata/repo/Packages/GeoIP-devel-1.5.0-9.el7.i686.rpm", SigUnknownKey},
+	}
+	for _, test := range tests {
+		status, err := verifyRPMSignature(test.rpm, keyring)
+		if status != test.expected {
+			t.Errorf("%s: expected %s, got %s (err: %v)", path.Base(test.rpm), test.expected, status, err)
+		}
+	}
+
+	r.keyring = keyring
+	if _, err := r.verifyDownload(unsigned); err == nil {
+		t.Error("unsigned rpm should be rejected")
+	}
+	if _, err := os.Stat(unsigned); !os.IsNotExist(err) {
+		t.Error("rejected rpm should be removed")
+	}
+	testRPM(t, unsigned, nil, []byte("payload"))
+	if _, err := r.verifyDownload(legacyTampered); err == nil {
+		t.Error("rpm with unsigned payload should be rejected")
+	}
+	r.KeepUnsigned = true
+	if _, err := r.verifyDownload(unsigned); err != nil {
+		t.Errorf("unsigned rpm should be kept: %s", err)
+	}
+}
+
+func TestSyncMetaRepoGPGCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := copyDir("testdata/repo", dir); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := openpgp.NewEntity("gym", "test", "gym@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "RPM-GPG-KEY-gym")
+	kf, err := os.Create(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Serialize(kf); err != nil {
+		t.Fatal(err)
+	}
+	kf.Close()
+	ts := httptest.NewServer(http.FileServer(http.Dir(path.Join(dir, "repo"))))
+	defer ts.Close()
+
+	sign := func(data []byte) {
+		asc, err := os.Create(path.Join(dir, "repo/repodata/repomd.xml.asc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer asc.Close()
+		if err := openpgp.ArmoredDetachSign(asc, signer, bytes.NewReader(data), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		signed    []byte
+		expectErr bool
+	}{
+		{"bad signature", []byte("something else"), true},
+		{"valid signature", nil, false},
+	}
+	for _, test := range tests {
+		repomd, err := ioutil.ReadFile(path.Join(dir, "repo/repodata/repomd.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.signed == nil {
+			test.signed = repomd
+		}
+		sign(test.signed)
+		dest := path.Join(dir, "mirror")
+		r := NewRepo(dest, []string{ts.URL}, nil, 0)
+		r.RepoGPGCheck = true
+		r.GPGKeys = []string{keyFile}
+		err = r.SyncMeta()
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			if _, err := os.Stat(path.Join(dest, "repodata")); !os.IsNotExist(err) {
+				t.Errorf("%s: repodata should not exist", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if _, err := os.Stat(path.Join(dest, "repodata/repomd.xml.asc")); err != nil {
+			t.Errorf("%s: repomd.xml.asc is not mirrored", test.name)
+		}
+	}
+}
+
+func TestReadRPMHeaderInvalidCount(t *testing.T) {
+	for _, count := range []int32{-1, -0x80000000, 3, 0x7fffffff} {
+		index := new(bytes.Buffer)
+		binary.Write(index, binary.BigEndian, rpmHeaderEntry{Tag: rpmTagPayloadDigestAlgo, Type: rpmTypeInt32, Offset: 4, Count: count})
+		h := new(bytes.Buffer)
+		h.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+		binary.Write(h, binary.BigEndian, uint32(1))
+		binary.Write(h, binary.BigEndian, uint32(12))
+		h.Write(index.Bytes())
+		h.Write(make([]byte, 12))
+		if _, _, err := readRPMHeader(h); err == nil {
+			t.Errorf("count %d: expected error for entry exceeding the store", count)
+		}
+	}
+}
+
+func TestSyncGPGCheckCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := path.Join(dir, "upstream")
+	testNamedRPM(t, upstream, "foo", "1.0", "1", "x86_64")
+	if err := CreateRepo(upstream, DefaultRepodataOptions()); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.FileServer(http.Dir(upstream)))
+	defer ts.Close()
+	signer, err := openpgp.NewEntity("gym", "test", "gym@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "RPM-GPG-KEY-gym")
+	kf, err := os.Create(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Serialize(kf); err != nil {
+		t.Fatal(err)
+	}
+	kf.Close()
+
+	local := path.Join(dir, "local")
+	relPath := "Packages/foo-1.0-1.x86_64.rpm"
+	syncRepo := func(gpgCheck, keepUnsigned bool) {
+		r := NewRepo(local, []string{ts.URL}, nil, 0)
+		r.GPGCheck = gpgCheck
+		r.GPGKeys = []string{keyFile}
+		r.KeepUnsigned = keepUnsigned
+		if err := r.SyncMeta(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Sync("", 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	syncRepo(false, false)
+	if _, err := os.Stat(path.Join(local, relPath)); err != nil {
+		t.Fatal(err)
+	}
+	// enabling gpgcheck verifies the rpms synced before
+	syncRepo(true, false)
+	if _, err := os.Stat(path.Join(local, relPath)); !os.IsNotExist(err) {
+		t.Error("unsigned rpm synced without gpgcheck should be removed")
+	}
+	syncRepo(true, true)
+	db := openVerifiedDB(local)
+	if p, ok := db.packages[relPath]; !ok || p.Signature != SigUnsigned {
+		t.Errorf("expected recorded signature status %s, got %+v", SigUnsigned, p)
+	}
+	// a kept unsigned rpm is rejected once unsigned rpms are no longer accepted
+	syncRepo(true, false)
+	if _, err := os.Stat(path.Join(local, relPath)); !os.IsNotExist(err) {
+		t.Error("recorded unsigned rpm should be removed without keep-unsigned")
+	}
+}
@@ -0,0 +1,322 @@
+package gym
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Merge conflict policies decide which rpm is used if several sources contain the same package
+// (name, epoch, version, release and arch) with different checksums.
+const (
+	MergeFirst = "first" // the rpm of the first source is used
+	MergeLast  = "last"  // the rpm of the last source is used
+	MergeFail  = "fail"  // the merge fails
+)
+
+// mergedPkg is an rpm of a source of a merged snapshot.
+type mergedPkg struct {
+	source *Repo
+	pkg    *pkgMeta
+}
+
+// MergeSnapshot creates a single snapshot of all sources in dest/name. The rpms of every source are
+// placed in a directory named like the source, packages contained in several sources are included
+// once, conflicts are resolved according to conflict. The repodata is generated for all rpms with
+// the groups, updateinfo and modules of all sources. The filters of the sources are applied and the
+// repodata options of the first source are used. If the merge fails, the partial snapshot is removed.
+func MergeSnapshot(sources []*Repo, dest, name string, timestamp bool, mode, conflict string, numWorkers int) (err error) {
+	if !validSnapshotMode(mode) {
+		return fmt.Errorf("invalid snapshot mode %s", mode)
+	}
+	if conflict != MergeFirst && conflict != MergeLast && conflict != MergeFail {
+		return fmt.Errorf("invalid merge conflict policy %s", conflict)
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("no sources to merge")
+	}
+	destination := path.Join(dest, name)
+	if timestamp {
+		destination = path.Join(destination, time.Now().Format("20060102"))
+	}
+	if _, err := os.Stat(destination); err == nil {
+		return fmt.Errorf("destination %s already exists", destination)
+	}
+	dirs := map[string]bool{}
+	for _, r := range sources {
+		if _, err := os.Stat(path.Join(r.LocalPath, "repodata/repomd.xml")); err != nil {
+			return fmt.Errorf("%s is not a valid repository, repomd.xml does not exist", r.LocalPath)
+		}
+		if dirs[path.Base(r.LocalPath)] {
+			return fmt.Errorf("sources with the same directory name %s cannot be merged", path.Base(r.LocalPath))
+		}
+		dirs[path.Base(r.LocalPath)] = true
+	}
+
+	pkgs, err := mergePkgs(sources, conflict)
+	if err != nil {
+		return err
+	}
+	Log.Info("creating merged snapshot", "name", name, "sources", len(sources), "packages", len(pkgs), "dest", destination)
+	defer func() {
+		// a partial snapshot would prevent a retry, destination must not exist
+		if err == nil {
+			return
+		}
+		if rerr := os.RemoveAll(destination); rerr != nil {
+			Log.Warn("could not remove partial merged snapshot", "dest", destination, "err", rerr)
+		}
+	}()
+	info, err := mergeRPMs(pkgs, destination, mode, numWorkers)
+	if err != nil {
+		return err
+	}
+	info.Name = name
+	paths := []string{}
+	for _, r := range sources {
+		paths = append(paths, r.LocalPath)
+	}
+	info.Source = strings.Join(paths, ",")
+	if info.Copied > 0 {
+		Log.Warn("rpms copied instead of linked", "name", name, "mode", mode, "copied", info.Copied)
+	}
+
+	opts := sources[0].Repodata
+	extra, groupFile, err := mergeMetadata(sources, destination)
+	if groupFile != "" {
+		defer os.Remove(groupFile)
+		opts.GroupFile = groupFile
+	}
+	if err != nil {
+		return err
+	}
+	if err := createRepodata(destination, opts, extra); err != nil {
+		return err
+	}
+	return writeSnapshotInfo(destination, info)
+}
+
+// mergePkgs returns the rpms of the snapshot of all sources, a package contained in several sources
+// is only returned once.
+func mergePkgs(sources []*Repo, conflict string) ([]mergedPkg, error) {
+	merged := map[string]int{}
+	pkgs := []mergedPkg{}
+	for _, r := range sources {
+		if err := r.selectSnapshot(); err != nil {
+			return nil, err
+		}
+		f, err := r.rpmFilter("")
+		if err != nil {
+			return nil, err
+		}
+		all, err := r.loadPrimary()
+		if err != nil {
+			return nil, err
+		}
+		selected := r.selectedRPMs()
+		for _, p := range all {
+			if selected != nil && !selected[p.Location.Href] || !f.match(p) {
+				continue
+			}
+			if _, err := os.Stat(path.Join(r.LocalPath, p.Location.Href)); os.IsNotExist(err) && r.FilterMeta {
+				// rpms missing in a filtered mirror are not part of the snapshot
+				continue
+			}
+			nevra := pkgNEVRA(p)
+			i, ok := merged[nevra]
+			if !ok {
+				merged[nevra] = len(pkgs)
+				pkgs = append(pkgs, mergedPkg{source: r, pkg: p})
+				continue
+			}
+			existing := pkgs[i]
+			if strings.EqualFold(existing.pkg.Checksum.Value, p.Checksum.Value) {
+				Log.Debug("skipping duplicate package", "package", nevra, "source", r.LocalPath, "kept", existing.source.LocalPath)
+				continue
+			}
+			switch conflict {
+			case MergeFail:
+				return nil, fmt.Errorf("package %s differs in %s and %s", nevra, existing.source.LocalPath, r.LocalPath)
+			case MergeLast:
+				pkgs[i] = mergedPkg{source: r, pkg: p}
+			}
+			Log.Warn("conflicting package", "package", nevra, "sources", existing.source.LocalPath+","+r.LocalPath, "used", pkgs[i].source.LocalPath)
+		}
+	}
+	return pkgs, nil
+}
+
+// mergeRPMs creates the rpms in destination/<source directory> according to mode.
+func mergeRPMs(pkgs []mergedPkg, destination, mode string, numWorkers int) (snapshotInfo, error) {
+	info := snapshotInfo{Created: time.Now(), Mode: mode}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	jobs := make(chan mergedPkg)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for m := range jobs {
+				rpm := m.pkg.rpm()
+				used, err := m.source.copyOrLink(path.Join(destination, path.Base(m.source.LocalPath)), rpm, mode)
+				mu.Lock()
+				if err != nil {
+					Log.Error(path.Base(rpm.relPath), "status", "failed", "err", err)
+					if firstErr == nil {
+						firstErr = fmt.Errorf("could not add %s: %s", rpm.relPath, err)
+					}
+				} else {
+					Log.Debug(ellipsis(path.Base(rpm.relPath), 40), "mode", used)
+					info.Packages++
+					if used != mode {
+						info.Copied++
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, m := range pkgs {
+		jobs <- m
+	}
+	close(jobs)
+	wg.Wait()
+	return info, firstErr
+}
+
+// mergeMetadata returns the merged updateinfo and modules of the sources and a temporary file
+// with the merged groups.
+func mergeMetadata(sources []*Repo, destination string) (map[string][]byte, string, error) {
+	rpms, err := findRPMs(destination)
+	if err != nil {
+		return nil, "", err
+	}
+	kept := map[string]bool{}
+	for _, rpm := range rpms {
+		kept[path.Base(rpm)] = true
+	}
+	extra := map[string][]byte{}
+	updates := []xmlNode{}
+	ids := map[string]bool{}
+	modules := new(bytes.Buffer)
+	groups := []xmlNode{}
+	groupIDs := map[string]bool{}
+	for _, r := range sources {
+		metaFiles, err := r.lsMeta()
+		if err != nil {
+			return nil, "", err
+		}
+		sourceUpdates, err := r.readUpdateinfo(metaFiles)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, u := range sourceUpdates {
+			id := u.child("id")
+			if id == nil || ids[strings.TrimSpace(id.Content)] || !r.Errata.match(&u) || !filterUpdate(&u, kept) {
+				continue
+			}
+			ids[strings.TrimSpace(id.Content)] = true
+			updates = append(updates, u)
+		}
+		sourceModules, err := r.snapshotModules(destination)
+		if err != nil {
+			return nil, "", err
+		}
+		modules.Write(sourceModules)
+		if meta, ok := metaFiles.get("group"); ok {
+			comps, err := readComps(path.Join(r.LocalPath, meta.href))
+			if err != nil {
+				return nil, "", err
+			}
+			for _, n := range comps.Nodes {
+				// groups, categories and environments are identified by their id, the first one is used
+				key := n.XMLName.Local
+				if id := n.child("id"); id != nil {
+					key = key + "/" + strings.TrimSpace(id.Content)
+				}
+				if groupIDs[key] {
+					continue
+				}
+				groupIDs[key] = true
+				groups = append(groups, n)
+			}
+		}
+	}
+	if len(updates) > 0 {
+		if extra["updateinfo"], err = marshalUpdateinfo(updates); err != nil {
+			return nil, "", err
+		}
+	}
+	if modules.Len() > 0 {
+		extra["modules"] = modules.Bytes()
+	}
+	if len(groups) == 0 {
+		return extra, "", nil
+	}
+	groupFile, err := writeComps(groups)
+	return extra, groupFile, err
+}
+
+// readComps reads a comps group file.
+func readComps(file string) (*xmlNode, error) {
+	data, err := readMetadataFile(file)
+	if err != nil {
+		return nil, err
+	}
+	comps := &xmlNode{}
+	if err := xml.Unmarshal(data, comps); err != nil {
+		return nil, fmt.Errorf("invalid group file %s: %s", path.Base(file), err)
+	}
+	return comps, nil
+}
+
+// writeComps writes nodes as comps document to a temporary file.
+func writeComps(nodes []xmlNode) (string, error) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return compsOrder(nodes[i].XMLName.Local) < compsOrder(nodes[j].XMLName.Local)
+	})
+	buf := new(bytes.Buffer)
+	buf.WriteString(xmlHeader)
+	root := xmlNode{XMLName: xml.Name{Local: "comps"}, Nodes: nodes}
+	root.trim()
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(root); err != nil {
+		return "", err
+	}
+	buf.WriteString("\n")
+	f, err := ioutil.TempFile("", "gym-comps")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// compsOrder returns the position of a comps element, groups are listed first.
+func compsOrder(element string) int {
+	switch element {
+	case "group":
+		return 0
+	case "environment":
+		return 1
+	case "category":
+		return 2
+	}
+	return 3
+}
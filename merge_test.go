@@ -0,0 +1,132 @@
+package gym
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// testMergeSource creates a repository with the packages, a group file with the groups and testErrata.
+func testMergeSource(t *testing.T, dir string, pkgs []string, groups []string) {
+	for _, name := range pkgs {
+		testNamedRPM(t, dir, name, "2.0", "1", "x86_64")
+	}
+	comps := xmlHeader + "<comps>\n"
+	for _, g := range groups {
+		comps = comps + "  <group>\n    <id>" + g + "</id>\n    <name>" + g + "</name>\n  </group>\n"
+	}
+	groupFile := path.Join(dir, "comps.xml")
+	if err := ioutil.WriteFile(groupFile, []byte(comps+"</comps>\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultRepodataOptions()
+	opts.GroupFile = groupFile
+	if err := createRepodata(dir, opts, map[string][]byte{"updateinfo": []byte(testErrata)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b := path.Join(dir, "a"), path.Join(dir, "b")
+	testMergeSource(t, a, []string{"foo", "same", "common"}, []string{"core"})
+	// common differs in b, same is identical in both sources
+	testNamedRPM(t, b, "common", "2.0", "1", "x86_64")
+	f, err := os.OpenFile(path.Join(b, "Packages/common-2.0-1.x86_64.rpm"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("payload of b"))
+	f.Close()
+	testMergeSource(t, b, []string{"bar", "same"}, []string{"core", "extra"})
+
+	sources := func() []*Repo {
+		return []*Repo{NewRepo(a, nil, nil, 0), NewRepo(b, nil, nil, 0)}
+	}
+	dest := path.Join(dir, "merged")
+	if err := MergeSnapshot(sources(), dest, "platform", false, SnapshotHardlink, MergeFail, 2); err == nil {
+		t.Error("expected error for conflicting package")
+	}
+
+	// a failed merge leaves no partial snapshot, which would prevent a retry
+	foo := path.Join(a, "Packages/foo-2.0-1.x86_64.rpm")
+	if err := os.Rename(foo, foo+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := MergeSnapshot(sources(), dest, "platform", false, SnapshotHardlink, MergeFirst, 2); err == nil {
+		t.Error("expected error for missing rpm")
+	}
+	if _, err := os.Stat(path.Join(dest, "platform")); !os.IsNotExist(err) {
+		t.Error("partial merged snapshot has not been removed")
+	}
+	if err := os.Rename(foo+".moved", foo); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		conflict string
+		rpms     string
+	}{
+		{MergeFirst, "a/Packages/common-2.0-1.x86_64.rpm a/Packages/foo-2.0-1.x86_64.rpm a/Packages/same-2.0-1.x86_64.rpm b/Packages/bar-2.0-1.x86_64.rpm"},
+		{MergeLast, "a/Packages/foo-2.0-1.x86_64.rpm a/Packages/same-2.0-1.x86_64.rpm b/Packages/bar-2.0-1.x86_64.rpm b/Packages/common-2.0-1.x86_64.rpm"},
+	}
+	for _, test := range tests {
+		if err := os.RemoveAll(dest); err != nil {
+			t.Fatal(err)
+		}
+		if err := MergeSnapshot(sources(), dest, "platform", false, SnapshotHardlink, test.conflict, 2); err != nil {
+			t.Fatal(err)
+		}
+		snapshot := NewRepo(path.Join(dest, "platform"), nil, nil, 0)
+		rpms, err := findRPMs(snapshot.LocalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(rpms, " ") != test.rpms {
+			t.Errorf("%s: unexpected rpms %v", test.conflict, rpms)
+		}
+		if len(readPrimaryXML(t, snapshot.LocalPath)) != 4 {
+			t.Errorf("%s: primary does not list the merged rpms", test.conflict)
+		}
+
+		metaFiles, err := snapshot.lsMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		updates, err := snapshot.readUpdateinfo(metaFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// only EXSA-2026:0001 lists a merged rpm
+		if len(updates) != 1 || strings.TrimSpace(updates[0].child("id").Content) != "EXSA-2026:0001" {
+			t.Errorf("%s: expected advisory EXSA-2026:0001 once, got %d advisories", test.conflict, len(updates))
+		}
+		group, ok := metaFiles.get("group")
+		if !ok {
+			t.Fatalf("%s: merged snapshot has no groups", test.conflict)
+		}
+		comps, err := readComps(path.Join(snapshot.LocalPath, group.href))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, n := range comps.Nodes {
+			ids = append(ids, n.child("id").Content)
+		}
+		if strings.Join(ids, " ") != "core extra" {
+			t.Errorf("%s: expected groups core and extra, got %v", test.conflict, ids)
+		}
+		info, err := readSnapshotInfo(snapshot.LocalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != "platform" || info.Mode != SnapshotHardlink || info.Packages != 4 {
+			t.Errorf("%s: unexpected snapshot info %+v", test.conflict, info)
+		}
+	}
+}
@@ -51,8 +51,9 @@ func newMetafiles(pathToXML string) (metaFiles, error) {
 
 // following types are needed for xml parsing
 type repomd struct {
-	XMLName xml.Name `xml:"repomd"`
-	Data    []data   `xml:"data"`
+	XMLName  xml.Name `xml:"repomd"`
+	Revision string   `xml:"revision"`
+	Data     []data   `xml:"data"`
 }
 
 type data struct {
@@ -72,6 +73,7 @@ type checksum struct {
 }
 
 type rpmPackage struct {
+	Arch     string   `xml:"arch"`
 	Checksum checksum `xml:"checksum"`
 	Location location `xml:"location"`
 	Size     size     `xml:"size"`
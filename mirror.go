@@ -0,0 +1,194 @@
+package gym
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// repomdHash is a checksum of repomd.xml announced by a metalink.
+type repomdHash struct {
+	checksumType string
+	checksum     string
+}
+
+// resolveMirrors returns the base urls of the repository. The mirrors of a configured
+// metalink or mirrorlist come first, followed by RemoteURLs. For a metalink also the
+// valid repomd.xml checksums are returned.
+func (r *Repo) resolveMirrors() ([]string, []repomdHash, error) {
+	mirrors := []string{}
+	var hashes []repomdHash
+	switch {
+	case len(r.Metalink) > 0:
+		data, err := r.get(r.Metalink)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not get metalink %s: %s", r.Metalink, err)
+		}
+		mirrors, hashes, err = parseMetalink(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse metalink %s: %s", r.Metalink, err)
+		}
+	case len(r.MirrorList) > 0:
+		data, err := r.get(r.MirrorList)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not get mirrorlist %s: %s", r.MirrorList, err)
+		}
+		// some mirrorlist urls answer with a metalink
+		if bytes.Contains(data, []byte("<metalink")) {
+			mirrors, hashes, err = parseMetalink(data)
+		} else {
+			mirrors, err = parseMirrorList(data)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse mirrorlist %s: %s", r.MirrorList, err)
+		}
+	}
+	mirrors = append(mirrors, r.RemoteURLs...)
+	if len(mirrors) == 0 {
+		return nil, nil, errors.New("no baseurl, mirrorlist or metalink mirrors found")
+	}
+	Log.Debug("resolved mirrors", "name", r.Name, "mirrors", strings.Join(mirrors, ","))
+	return mirrors, hashes, nil
+}
+
+// get returns the body of url, transient errors are retried according to the retry policy.
+func (r *Repo) get(url string) ([]byte, error) {
+	var data []byte
+	_, err := r.Retry.retry(url, func() error {
+		resp, err := r.Client.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode > 299 {
+			return &httpStatusError{code: resp.StatusCode, status: resp.Status}
+		}
+		data, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	return data, err
+}
+
+// parseMirrorList returns the base urls of a mirrorlist, one url per line, lines starting
+// with # are comments.
+func parseMirrorList(data []byte) ([]string, error) {
+	mirrors := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "http://") && !strings.HasPrefix(line, "https://") {
+			continue
+		}
+		mirrors = append(mirrors, strings.TrimRight(line, "/"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(mirrors) == 0 {
+		return nil, errors.New("mirrorlist contains no http mirrors")
+	}
+	return mirrors, nil
+}
+
+// parseMetalink returns the base urls sorted by preference and the checksums of
+// repomd.xml (including the alternates) of a metalink.
+func parseMetalink(data []byte) ([]string, []repomdHash, error) {
+	var ml metalink
+	if err := xml.Unmarshal(data, &ml); err != nil {
+		return nil, nil, err
+	}
+	for _, f := range ml.Files {
+		if f.Name != "repomd.xml" {
+			continue
+		}
+		hashes := []repomdHash{}
+		for _, h := range f.Hashes {
+			hashes = append(hashes, repomdHash{checksumType: h.Type, checksum: strings.TrimSpace(h.Value)})
+		}
+		for _, a := range f.Alternates {
+			for _, h := range a.Hashes {
+				hashes = append(hashes, repomdHash{checksumType: h.Type, checksum: strings.TrimSpace(h.Value)})
+			}
+		}
+		urls := []metalinkURL{}
+		for _, u := range f.URLs {
+			if u.Protocol != "http" && u.Protocol != "https" {
+				continue
+			}
+			if !strings.HasSuffix(strings.TrimSpace(u.Value), "/repodata/repomd.xml") {
+				continue
+			}
+			urls = append(urls, u)
+		}
+		sort.SliceStable(urls, func(i, j int) bool {
+			return urls[i].Preference > urls[j].Preference
+		})
+		mirrors := []string{}
+		for _, u := range urls {
+			mirrors = append(mirrors, strings.TrimSuffix(strings.TrimSpace(u.Value), "/repodata/repomd.xml"))
+		}
+		if len(mirrors) == 0 {
+			return nil, nil, errors.New("metalink contains no http mirrors")
+		}
+		return mirrors, hashes, nil
+	}
+	return nil, nil, errors.New("metalink contains no repomd.xml")
+}
+
+// verifyRepomd checks repomd.xml against the checksums of a metalink. Checksum types
+// that are not supported are ignored, if there are no usable checksums at all, the
+// file is considered valid.
+func verifyRepomd(pathToFile string, hashes []repomdHash) error {
+	checked := false
+	for _, h := range hashes {
+		switch h.checksumType {
+		case "sha1", "sha256", "sha512":
+		default:
+			continue
+		}
+		checked = true
+		if checksumOK(pathToFile, h.checksumType, h.checksum) {
+			return nil
+		}
+	}
+	if checked {
+		return errors.New("repomd.xml checksum does not match metalink")
+	}
+	return nil
+}
+
+// following types are needed for metalink parsing
+type metalink struct {
+	XMLName xml.Name       `xml:"metalink"`
+	Files   []metalinkFile `xml:"files>file"`
+}
+
+type metalinkFile struct {
+	Name       string              `xml:"name,attr"`
+	Hashes     []metalinkHash      `xml:"verification>hash"`
+	Alternates []metalinkAlternate `xml:"alternates>alternate"`
+	URLs       []metalinkURL       `xml:"resources>url"`
+}
+
+type metalinkAlternate struct {
+	Hashes []metalinkHash `xml:"verification>hash"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkURL struct {
+	Protocol   string `xml:"protocol,attr"`
+	Preference int    `xml:"preference,attr"`
+	Value      string `xml:",chardata"`
+}
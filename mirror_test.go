@@ -0,0 +1,171 @@
+package gym
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMetalink = `<?xml version="1.0" encoding="utf-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/" xmlns:mm0="http://fedorahosted.org/mirrormanager">
+ <files>
+  <file name="repomd.xml">
+   <mm0:alternates>
+    <mm0:alternate>
+     <verification>
+      <hash type="sha256">%s</hash>
+     </verification>
+    </mm0:alternate>
+   </mm0:alternates>
+   <verification>
+    <hash type="md5">d41d8cd98f00b204e9800998ecf8427e</hash>
+    <hash type="sha256">%s</hash>
+   </verification>
+   <resources maxconnections="1">
+    <url protocol="rsync" type="rsync" location="CH" preference="100">rsync://mirror.example.com/repodata/repomd.xml</url>
+    <url protocol="http" type="http" location="CH" preference="90">%s/repodata/repomd.xml</url>
+    <url protocol="https" type="https" location="CH" preference="99">%s/repodata/repomd.xml</url>
+   </resources>
+  </file>
+ </files>
+</metalink>`
+
+func TestParseMirrorList(t *testing.T) {
+	data := "# repo = epel-7 arch = x86_64\nhttp://mirror1.example.com/epel/7/x86_64/\n\nhttps://mirror2.example.com/epel/7/x86_64\n"
+	mirrors, err := parseMirrorList([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "http://mirror1.example.com/epel/7/x86_64,https://mirror2.example.com/epel/7/x86_64"
+	if strings.Join(mirrors, ",") != expected {
+		t.Errorf("expected mirrors %s, got %s", expected, strings.Join(mirrors, ","))
+	}
+	if _, err := parseMirrorList([]byte("# no mirrors")); err == nil {
+		t.Error("expected an error for an empty mirrorlist")
+	}
+}
+
+func TestSyncMetaMetalink(t *testing.T) {
+	good := httptest.NewServer(http.FileServer(http.Dir("testdata/repo")))
+	defer good.Close()
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+	checksum := "a01b0c688562aa24821a531353cede6ec5aa4fdd640ccbd91ab72b895d13b2ac"
+
+	mirrors, hashes, err := parseMetalink([]byte(fmt.Sprintf(testMetalink, "old", checksum, good.URL, broken.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(mirrors, ",") != broken.URL+","+good.URL {
+		t.Errorf("mirrors are not sorted by preference: %v", mirrors)
+	}
+	if len(hashes) != 3 {
+		t.Errorf("expected 3 hashes, got %d", len(hashes))
+	}
+
+	tests := []struct {
+		name      string
+		checksum  string
+		expectErr bool
+	}{
+		{"valid checksum", checksum, false},
+		{"invalid checksum", "invalid", true},
+	}
+	for _, test := range tests {
+		ml := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, testMetalink, "old", test.checksum, good.URL, broken.URL)
+		}))
+		dir, err := ioutil.TempDir("", "gym")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewRepo(path.Join(dir, "repo"), nil, nil, time.Second)
+		r.Metalink = ml.URL
+		r.Retry.Attempts = 1
+		err = r.SyncMeta()
+		switch {
+		case test.expectErr && err == nil:
+			t.Errorf("%s: expected an error", test.name)
+		case !test.expectErr && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case !test.expectErr && r.mirrorURLs()[0] != good.URL:
+			t.Errorf("%s: expected mirror %s, got %s", test.name, good.URL, r.mirrorURLs()[0])
+		}
+		ml.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewRepoListBaseURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repoFile := path.Join(dir, "test.repo")
+	data := `[base]
+baseurl=http://mirror1.example.com/$releasever/$basearch/
+        http://mirror2.example.com/$releasever/$basearch/,http://mirror3.example.com/$releasever/$basearch/
+enabled=1
+
+[epel]
+metalink=https://mirrors.example.com/metalink?repo=epel-$releasever&arch=$basearch
+
+[broken]
+enabled=1
+`
+	if err := ioutil.WriteFile(repoFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRepoList(repoFile, dir, false, "7", "x86_64", time.Second); err == nil {
+		t.Error("expected an error for a section without baseurl, mirrorlist and metalink")
+	}
+	if err := ioutil.WriteFile(repoFile, []byte(strings.Split(data, "[broken]")[0]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repos, err := NewRepoList(repoFile, dir, false, "7", "x86_64", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "http://mirror1.example.com/7/x86_64,http://mirror2.example.com/7/x86_64,http://mirror3.example.com/7/x86_64"
+	if strings.Join(repos.Find("base").RemoteURLs, ",") != expected {
+		t.Errorf("expected base urls %s, got %v", expected, repos.Find("base").RemoteURLs)
+	}
+	expected = "https://mirrors.example.com/metalink?repo=epel-7&arch=x86_64"
+	if repos.Find("epel").Metalink != expected {
+		t.Errorf("expected metalink %s, got %s", expected, repos.Find("epel").Metalink)
+	}
+}
+
+func TestSyncMirrorFailover(t *testing.T) {
+	good := httptest.NewServer(http.FileServer(http.Dir("testdata/repo")))
+	defer good.Close()
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(path.Join(dir, "repo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyDir("testdata/repo/repodata", path.Join(dir, "repo")); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepo(path.Join(dir, "repo"), []string{broken.URL, good.URL}, nil, time.Second)
+	r.Retry.Attempts = 1
+	if err := r.Sync("", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "repo/Packages/GeoIP-devel-1.5.0-9.el7.i686.rpm")); err != nil {
+		t.Error("package has not been downloaded from the second mirror")
+	}
+}
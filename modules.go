@@ -0,0 +1,258 @@
+package gym
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// moduleDoc is a document of the modules metadata: a module stream (modulemd) or the defaults,
+// obsoletes or translations of a module. The yaml node is kept to write the document unchanged.
+type moduleDoc struct {
+	node     *yaml.Node
+	Document string `yaml:"document"`
+	Data     struct {
+		Name      string `yaml:"name"`
+		Stream    string `yaml:"stream"`
+		Module    string `yaml:"module"`
+		Artifacts struct {
+			RPMs []string `yaml:"rpms"`
+		} `yaml:"artifacts"`
+	} `yaml:"data"`
+}
+
+// isStream reports whether the document is a module stream.
+func (d *moduleDoc) isStream() bool {
+	return d.Document == "modulemd"
+}
+
+// module returns the name of the module the document belongs to.
+func (d *moduleDoc) module() string {
+	if len(d.Data.Name) > 0 {
+		return d.Data.Name
+	}
+	return d.Data.Module
+}
+
+// readModules reads all documents of a modules.yaml file.
+func readModules(r io.Reader) ([]*moduleDoc, error) {
+	docs := []*moduleDoc{}
+	dec := yaml.NewDecoder(r)
+	for {
+		node := &yaml.Node{}
+		err := dec.Decode(node)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		d := &moduleDoc{node: node}
+		if err := node.Decode(d); err != nil {
+			return nil, err
+		}
+		docs = append(docs, d)
+	}
+}
+
+// marshalModules encodes docs as modules.yaml stream, every document is enclosed in --- and ...
+func marshalModules(docs []*moduleDoc) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, d := range docs {
+		data, err := yaml.Marshal(d.node)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+		buf.WriteString("...\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// readModulesMeta reads the modules metadata of the repository, it returns nil if the
+// repository has no modules metadata.
+func (r *Repo) readModulesMeta(metaFiles metaFiles) ([]*moduleDoc, error) {
+	meta, ok := metaFiles.get("modules")
+	if !ok {
+		return nil, nil
+	}
+	data, err := readMetadataFile(path.Join(r.LocalPath, meta.href))
+	if err != nil {
+		return nil, err
+	}
+	return readModules(bytes.NewReader(data))
+}
+
+// streamSelected reports whether the module stream name:stream matches one of patterns, a
+// pattern is a glob of name:stream or of the name only. All streams match if patterns is empty.
+func streamSelected(patterns []string, name, stream string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		s := name + ":" + stream
+		if !strings.Contains(pattern, ":") {
+			s = name
+		}
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pkgNEVRA returns name-epoch:version-release.arch of a package as listed in module artifacts.
+func pkgNEVRA(p *pkgMeta) string {
+	epoch := p.Version.Epoch
+	if len(epoch) == 0 {
+		epoch = "0"
+	}
+	return p.Name + "-" + epoch + ":" + p.Version.Ver + "-" + p.Version.Rel + "." + p.Arch
+}
+
+// filterModules returns the module streams selected by patterns with at least one artifact
+// in pkgs together with the defaults, obsoletes and translations of their modules.
+func filterModules(docs []*moduleDoc, pkgs []*pkgMeta, patterns []string) []*moduleDoc {
+	kept := map[string]bool{}
+	for _, p := range pkgs {
+		kept[pkgNEVRA(p)] = true
+	}
+	modules := map[string]bool{}
+	streams := map[*moduleDoc]bool{}
+	for _, d := range docs {
+		if !d.isStream() || !streamSelected(patterns, d.Data.Name, d.Data.Stream) {
+			continue
+		}
+		for _, a := range d.Data.Artifacts.RPMs {
+			if kept[a] {
+				streams[d] = true
+				modules[d.Data.Name] = true
+				break
+			}
+		}
+	}
+	filtered := []*moduleDoc{}
+	for _, d := range docs {
+		if d.isStream() && streams[d] || !d.isStream() && (len(d.module()) == 0 || modules[d.module()]) {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// filteredModules returns the modules metadata with only the module streams selected by Modules
+// that contain one of pkgs. It returns nil if the repository has no modules metadata.
+func (r *Repo) filteredModules(metaFiles metaFiles, pkgs []*pkgMeta) ([]byte, error) {
+	docs, err := r.readModulesMeta(metaFiles)
+	if err != nil || docs == nil {
+		return nil, err
+	}
+	return marshalModules(filterModules(docs, pkgs, r.Modules))
+}
+
+// snapshotModules returns the modules metadata of the repository filtered to the rpms in dir.
+func (r *Repo) snapshotModules(dir string) ([]byte, error) {
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := metaFiles.get("modules"); !ok {
+		return nil, nil
+	}
+	rpms, err := findRPMs(dir)
+	if err != nil {
+		return nil, err
+	}
+	present := map[string]bool{}
+	for _, rpm := range rpms {
+		present[path.Base(rpm)] = true
+	}
+	all, err := r.loadPrimary()
+	if err != nil {
+		return nil, err
+	}
+	pkgs := []*pkgMeta{}
+	for _, p := range all {
+		if present[path.Base(p.Location.Href)] {
+			pkgs = append(pkgs, p)
+		}
+	}
+	return r.filteredModules(metaFiles, pkgs)
+}
+
+// selectModules restricts the rpms to sync to the non modular packages and the packages of
+// the module streams selected by Modules. An existing selection, e.g. from ResolvePackages, is
+// restricted further. Packages not matching the repository's filters and filter are not considered.
+func (r *Repo) selectModules(filter string) error {
+	f, err := r.rpmFilter(filter)
+	if err != nil {
+		return err
+	}
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		return err
+	}
+	docs, err := r.readModulesMeta(metaFiles)
+	if err != nil {
+		return err
+	}
+	// an rpm can be an artifact of several streams, it is synced if one of them is selected
+	included := map[string]bool{}
+	excluded := map[string]bool{}
+	streams := 0
+	for _, d := range docs {
+		if !d.isStream() {
+			continue
+		}
+		artifacts := excluded
+		if streamSelected(r.Modules, d.Data.Name, d.Data.Stream) {
+			artifacts = included
+			streams++
+		}
+		for _, a := range d.Data.Artifacts.RPMs {
+			artifacts[a] = true
+		}
+	}
+	pkgs, err := r.loadPrimary()
+	if err != nil {
+		return err
+	}
+	selected := r.selectedRPMs()
+	selection := []*rpm{}
+	for _, p := range pkgs {
+		if selected != nil && !selected[p.Location.Href] || !f.match(p) {
+			continue
+		}
+		if nevra := pkgNEVRA(p); excluded[nevra] && !included[nevra] {
+			continue
+		}
+		selection = append(selection, p.rpm())
+	}
+	sort.Slice(selection, func(i, j int) bool {
+		return selection[i].relPath < selection[j].relPath
+	})
+	r.selection = selection
+	Log.Info("selected module streams", "name", r.Name, "modules", strings.Join(r.Modules, ","), "streams", streams, "packages", len(selection))
+	return nil
+}
+
+// readMetadataFile returns the content of a metadata file, it is uncompressed if necessary.
+func readMetadataFile(file string) ([]byte, error) {
+	switch path.Ext(file) {
+	case ".gz", ".bz2", ".xz", ".zst":
+		tmpFile, err := uncompress(file)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmpFile.Name())
+		file = tmpFile.Name()
+	}
+	return ioutil.ReadFile(file)
+}
@@ -0,0 +1,195 @@
+package gym
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testModules = `---
+document: modulemd
+version: 2
+data:
+  name: foo
+  stream: "1.0"
+  version: 820190101000000
+  context: 9edba152
+  arch: x86_64
+  summary: foo 1
+  description: foo stream 1
+  license:
+    module: [MIT]
+  artifacts:
+    rpms:
+    - foo-0:1.0-1.x86_64
+...
+---
+document: modulemd
+version: 2
+data:
+  name: foo
+  stream: "2.0"
+  version: 820190201000000
+  context: 9edba152
+  arch: x86_64
+  summary: foo 2
+  description: foo stream 2
+  license:
+    module: [MIT]
+  artifacts:
+    rpms:
+    - foo-0:2.0-1.x86_64
+...
+---
+document: modulemd-defaults
+version: 1
+data:
+  module: foo
+  stream: "2.0"
+  profiles:
+    "2.0": [default]
+...
+---
+document: modulemd
+version: 2
+data:
+  name: bar
+  stream: master
+  version: 1
+  context: 9edba152
+  arch: x86_64
+  summary: bar
+  description: bar without rpms in the repository
+  license:
+    module: [MIT]
+  artifacts:
+    rpms:
+    - bar-0:1.0-1.x86_64
+...
+`
+
+// testModulesRepo creates a repository with the module streams of testModules and the non modular package baz.
+func testModulesRepo(t *testing.T, dir string) {
+	testNamedRPM(t, dir, "foo", "1.0", "1", "x86_64")
+	testNamedRPM(t, dir, "foo", "2.0", "1", "x86_64")
+	testNamedRPM(t, dir, "baz", "1.0", "1", "noarch")
+	modulesFile := path.Join(dir, "modules.yaml")
+	if err := ioutil.WriteFile(modulesFile, []byte(testModules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultRepodataOptions()
+	opts.ModulesFile = modulesFile
+	if err := CreateRepo(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(modulesFile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testModuleStreams returns name:stream of the module streams and the documents of the repository in dir.
+func testModuleStreams(t *testing.T, dir string) (string, int) {
+	r := NewRepo(dir, nil, nil, 0)
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := r.readModulesMeta(metaFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := []string{}
+	for _, d := range docs {
+		if d.isStream() {
+			streams = append(streams, d.Data.Name+":"+d.Data.Stream)
+		}
+	}
+	return strings.Join(streams, " "), len(docs)
+}
+
+func TestCreateRepoModules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testModulesRepo(t, dir)
+	if streams, docs := testModuleStreams(t, dir); streams != "foo:1.0 foo:2.0 bar:master" || docs != 4 {
+		t.Errorf("expected all module documents, got %d documents with streams %s", docs, streams)
+	}
+	repomd, err := ioutil.ReadFile(path.Join(dir, "repodata/repomd.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(repomd, []byte(`<data type="modules">`)) || !bytes.Contains(repomd, []byte(`-modules.yaml.gz"/>`)) {
+		t.Errorf("no modules record in repomd.xml:\n%s", repomd)
+	}
+
+	r := NewRepo(dir, nil, nil, 0)
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := r.readModulesMeta(metaFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := marshalModules(docs[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("---\ndocument: modulemd\n")) || !bytes.Contains(data, []byte(`stream: "1.0"`)) || !bytes.HasSuffix(data, []byte("\n...\n")) {
+		t.Errorf("module document not written unchanged:\n%s", data)
+	}
+}
+
+func TestSnapshotModules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := path.Join(dir, "source")
+	testModulesRepo(t, source)
+
+	tests := []struct {
+		modules    []string
+		createRepo bool
+		rpms       string
+		streams    string
+		docs       int
+	}{
+		{[]string{"foo:2*"}, false, "Packages/baz-1.0-1.noarch.rpm Packages/foo-2.0-1.x86_64.rpm", "foo:2.0", 2},
+		{[]string{"foo:1.0"}, true, "Packages/baz-1.0-1.noarch.rpm Packages/foo-1.0-1.x86_64.rpm", "foo:1.0", 2},
+		{[]string{"bar"}, false, "Packages/baz-1.0-1.noarch.rpm", "", 0},
+		{nil, true, "Packages/baz-1.0-1.noarch.rpm Packages/foo-1.0-1.x86_64.rpm Packages/foo-2.0-1.x86_64.rpm", "foo:1.0 foo:2.0", 3},
+	}
+	for _, test := range tests {
+		r := NewRepo(source, nil, nil, 0)
+		r.Modules = test.modules
+		dest := path.Join(dir, "snapshot")
+		if err := r.Snapshot(dest, false, SnapshotCopy, test.createRepo, 1); err != nil {
+			t.Fatal(err)
+		}
+		snapshot := path.Join(dest, "source")
+		rpms, err := findRPMs(snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(rpms, " ") != test.rpms {
+			t.Errorf("modules %v: expected rpms %s, got %v", test.modules, test.rpms, rpms)
+		}
+		if len(readPrimaryXML(t, snapshot)) != len(rpms) {
+			t.Errorf("modules %v: primary does not list the rpms of the snapshot", test.modules)
+		}
+		if streams, docs := testModuleStreams(t, snapshot); streams != test.streams || docs != test.docs {
+			t.Errorf("modules %v: expected %d documents with streams %s, got %d with %s", test.modules, test.docs, test.streams, docs, streams)
+		}
+		if err := os.RemoveAll(dest); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
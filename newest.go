@@ -0,0 +1,74 @@
+package gym
+
+import (
+	"sort"
+)
+
+// selectNewest restricts the rpms to sync to the newest KeepNewest versions of every package
+// name and architecture. An existing selection, e.g. from ResolvePackages, is restricted further.
+// Packages not matching the repository's filters and filter are not considered.
+func (r *Repo) selectNewest(filter string) error {
+	f, err := r.rpmFilter(filter)
+	if err != nil {
+		return err
+	}
+	pkgs, err := r.loadPrimary()
+	if err != nil {
+		return err
+	}
+	selected := r.selectedRPMs()
+	groups := map[string][]*pkgMeta{}
+	total := 0
+	for _, p := range pkgs {
+		if selected != nil && !selected[p.Location.Href] || !f.match(p) {
+			continue
+		}
+		total++
+		key := p.Name + "." + p.Arch
+		groups[key] = append(groups[key], p)
+	}
+
+	selection := []*rpm{}
+	for _, group := range groups {
+		for _, p := range newestPkgs(group, r.KeepNewest) {
+			selection = append(selection, p.rpm())
+		}
+	}
+	sort.Slice(selection, func(i, j int) bool {
+		return selection[i].relPath < selection[j].relPath
+	})
+	r.selection = selection
+	Log.Info("selected newest packages", "name", r.Name, "keep", r.KeepNewest, "packages", len(selection), "skipped", total-len(selection))
+	return nil
+}
+
+// newestPkgs returns the packages with the n newest versions of pkgs, all packages must have
+// the same name and architecture.
+func newestPkgs(pkgs []*pkgMeta, n int) []*pkgMeta {
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		return comparePkgs(pkgs[i], pkgs[j]) > 0
+	})
+	versions := 0
+	for i, p := range pkgs {
+		// the same version can be listed more than once, e.g. in different directories
+		if i == 0 || comparePkgs(p, pkgs[i-1]) != 0 {
+			versions++
+		}
+		if versions > n {
+			return pkgs[:i]
+		}
+	}
+	return pkgs
+}
+
+// selectedRPMs returns the relative paths of the selected rpms or nil if there is no selection.
+func (r *Repo) selectedRPMs() map[string]bool {
+	if r.selection == nil {
+		return nil
+	}
+	selected := map[string]bool{}
+	for _, rpm := range r.selection {
+		selected[rpm.relPath] = true
+	}
+	return selected
+}
@@ -0,0 +1,98 @@
+package gym
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testNamedRPM writes an unsigned rpm with name, version, release and arch to dir/Packages.
+func testNamedRPM(t *testing.T, dir, name, version, release, arch string) {
+	str := func(s string) []byte { return []byte(s + "\x00") }
+	header := testRPMHeader([]testHeaderEntry{
+		{rpmTagName, rpmTypeString, str(name)},
+		{rpmTagVersion, rpmTypeString, str(version)},
+		{rpmTagRelease, rpmTypeString, str(release)},
+		{rpmTagArch, rpmTypeString, str(arch)},
+		{rpmTagSourceRPM, rpmTypeString, str(name + "-" + version + "-" + release + ".src.rpm")},
+	})
+	sigHeader := testRPMHeader(nil)
+	data := new(bytes.Buffer)
+	data.Write(rpmLeadMagic)
+	data.Write(make([]byte, rpmLeadSize-len(rpmLeadMagic)))
+	data.Write(sigHeader)
+	data.Write(make([]byte, (8-len(sigHeader)%8)%8))
+	data.Write(header)
+	dest := path.Join(dir, "Packages", name+"-"+version+"-"+release+"."+arch+".rpm")
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dest, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewestPkgs(t *testing.T) {
+	pkgs := []*pkgMeta{}
+	for _, evr := range []string{"1.0-1", "1.10-1", "1.9-1", "1:0.5-1", "1.10-1", "1.10~rc1-1"} {
+		p := &pkgMeta{Name: "foo", Arch: "x86_64"}
+		p.Version.Epoch, p.Version.Ver, p.Version.Rel = splitEVR(evr)
+		pkgs = append(pkgs, p)
+	}
+	got := []string{}
+	for _, p := range newestPkgs(pkgs, 2) {
+		got = append(got, p.Version.Epoch+":"+p.Version.Ver+"-"+p.Version.Rel)
+	}
+	expected := "1:0.5-1 0:1.10-1 0:1.10-1"
+	if strings.Join(got, " ") != expected {
+		t.Errorf("expected %s, got %s", expected, strings.Join(got, " "))
+	}
+}
+
+func TestSnapshotKeepNewest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := path.Join(dir, "source")
+	for _, v := range []string{"1.0", "2.0", "10.0"} {
+		testNamedRPM(t, source, "foo", v, "1", "x86_64")
+	}
+	testNamedRPM(t, source, "foo", "1.0", "1", "i686")
+	testNamedRPM(t, source, "bar", "1.0", "1", "noarch")
+	if err := CreateRepo(source, DefaultRepodataOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRepo(source, nil, nil, 0)
+	r.KeepNewest = 2
+	if err := r.Snapshot(path.Join(dir, "snapshot"), false, SnapshotCopy, false, 1); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"Packages/bar-1.0-1.noarch.rpm",
+		"Packages/foo-1.0-1.i686.rpm",
+		"Packages/foo-10.0-1.x86_64.rpm",
+		"Packages/foo-2.0-1.x86_64.rpm",
+	}
+	rpms, err := findRPMs(path.Join(dir, "snapshot/source"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(rpms, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected rpms %v, got %v", expected, rpms)
+	}
+	hrefs := []string{}
+	for _, p := range readPrimaryXML(t, path.Join(dir, "snapshot/source")) {
+		hrefs = append(hrefs, p.Location.Href)
+	}
+	sort.Strings(hrefs)
+	if strings.Join(hrefs, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected packages %v in primary, got %v", expected, hrefs)
+	}
+}
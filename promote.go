@@ -0,0 +1,213 @@
+package gym
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Promotion is an entry of the promotion history of a repository in a channel. A channel is a
+// directory <root>/<channel> with a symlink for each repository to its current snapshot.
+type Promotion struct {
+	Channel  string    `json:"channel"`
+	Repo     string    `json:"repo"`
+	Snapshot string    `json:"snapshot"` // snapshot directory relative to root e.g: rhel8-baseos/20261016
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"` // promote or rollback
+}
+
+// historyFile returns the file with the promotion history of repo in channel.
+func historyFile(root, channel, repo string) string {
+	return path.Join(root, channel, ".gym", repo+".history.json")
+}
+
+// PromotionHistory returns the promotion history of repo in channel, oldest first.
+func PromotionHistory(root, channel, repo string) ([]Promotion, error) {
+	history := []Promotion{}
+	data, err := ioutil.ReadFile(historyFile(root, channel, repo))
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("invalid promotion history of %s in channel %s: %s", repo, channel, err)
+	}
+	return history, nil
+}
+
+// promoted returns the stack of promoted snapshots of history, a rollback removes the top.
+func promoted(history []Promotion) []string {
+	stack := []string{}
+	for _, p := range history {
+		if p.Action == "rollback" && len(stack) > 0 {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		stack = append(stack, p.Snapshot)
+	}
+	return stack
+}
+
+// Promote atomically switches repo in channel to snapshot. The snapshot is a directory or the name
+// of a snapshot in <root>/<repo> e.g: 20261016 of snapshot -t.
+func Promote(root, repo, snapshot, channel string) error {
+	if err := checkChannel(repo, channel); err != nil {
+		return err
+	}
+	if !strings.Contains(snapshot, "/") {
+		snapshot = path.Join(root, repo, snapshot)
+	}
+	rel, err := snapshotRelPath(root, snapshot)
+	if err != nil {
+		return err
+	}
+	history, err := PromotionHistory(root, channel, repo)
+	if err != nil {
+		return err
+	}
+	if stack := promoted(history); len(stack) > 0 && stack[len(stack)-1] == rel {
+		Log.Info("snapshot already promoted", "repo", repo, "channel", channel, "snapshot", rel)
+		return nil
+	}
+	return switchChannel(root, Promotion{Channel: channel, Repo: repo, Snapshot: rel, Time: time.Now(), Action: "promote"}, history)
+}
+
+// Rollback switches repo in channel back to the snapshot promoted before the current one and
+// returns it.
+func Rollback(root, repo, channel string) (string, error) {
+	if err := checkChannel(repo, channel); err != nil {
+		return "", err
+	}
+	history, err := PromotionHistory(root, channel, repo)
+	if err != nil {
+		return "", err
+	}
+	stack := promoted(history)
+	if len(stack) < 2 {
+		return "", fmt.Errorf("no previous snapshot of %s in channel %s", repo, channel)
+	}
+	previous := stack[len(stack)-2]
+	if _, err := os.Stat(path.Join(root, previous, "repodata/repomd.xml")); err != nil {
+		return "", fmt.Errorf("previous snapshot %s of %s in channel %s does not exist anymore", previous, repo, channel)
+	}
+	return previous, switchChannel(root, Promotion{Channel: channel, Repo: repo, Snapshot: previous, Time: time.Now(), Action: "rollback"}, history)
+}
+
+// ListChannels returns the current promotion of every repository in all channels of root.
+func ListChannels(root string) ([]Promotion, error) {
+	channels, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	current := []Promotion{}
+	for _, c := range channels {
+		if !c.IsDir() || strings.HasPrefix(c.Name(), ".") {
+			continue
+		}
+		files, err := filepath.Glob(historyFile(root, c.Name(), "*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			repo := strings.TrimSuffix(path.Base(file), ".history.json")
+			history, err := PromotionHistory(root, c.Name(), repo)
+			if err != nil {
+				return nil, err
+			}
+			if len(history) > 0 {
+				current = append(current, history[len(history)-1])
+			}
+		}
+	}
+	sort.Slice(current, func(i, j int) bool {
+		if current[i].Channel == current[j].Channel {
+			return current[i].Repo < current[j].Repo
+		}
+		return current[i].Channel < current[j].Channel
+	})
+	return current, nil
+}
+
+// checkChannel verifies the names of the repository and the channel, the channel must not be
+// the snapshot directory of the repository.
+func checkChannel(repo, channel string) error {
+	for _, name := range []string{repo, channel} {
+		if len(name) == 0 || strings.ContainsAny(name, "/*?[") || strings.HasPrefix(name, ".") {
+			return fmt.Errorf("invalid repository or channel name '%s'", name)
+		}
+	}
+	if repo == channel {
+		return fmt.Errorf("channel %s must not be named like the repository", channel)
+	}
+	return nil
+}
+
+// switchChannel replaces the symlink of the promoted repository with a relative symlink to the
+// snapshot and appends p to the history.
+func switchChannel(root string, p Promotion, history []Promotion) error {
+	link := path.Join(root, p.Channel, p.Repo)
+	if fi, err := os.Lstat(link); err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s is not a symlink", link)
+	}
+	if err := os.MkdirAll(path.Dir(historyFile(root, p.Channel, p.Repo)), 0755); err != nil {
+		return err
+	}
+	// the symlink is relative to stay valid when root is exported or mounted elsewhere
+	target, err := filepath.Rel(path.Join(root, p.Channel), path.Join(root, p.Snapshot))
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(root, p.Channel, "."+p.Repo+".tmp")
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	data, err := json.MarshalIndent(append(history, p), "", "  ")
+	if err != nil {
+		return err
+	}
+	file := historyFile(root, p.Channel, p.Repo)
+	if err := ioutil.WriteFile(file+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+	Log.Info("switched channel", "channel", p.Channel, "repo", p.Repo, "snapshot", p.Snapshot, "action", p.Action)
+	return nil
+}
+
+// snapshotRelPath returns the path of the snapshot relative to root, the snapshot must be below root.
+func snapshotRelPath(root, snapshot string) (string, error) {
+	if _, err := os.Stat(path.Join(snapshot, "repodata/repomd.xml")); err != nil {
+		return "", fmt.Errorf("%s is not a valid snapshot, repomd.xml does not exist", snapshot)
+	}
+	rootAbs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	snapshotAbs, err := filepath.Abs(snapshot)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(rootAbs, snapshotAbs)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("snapshot %s is not below %s", snapshot, root)
+	}
+	return filepath.ToSlash(rel), nil
+}
@@ -0,0 +1,105 @@
+package gym
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPromote(t *testing.T) {
+	root, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, name := range []string{"20261001", "20261016"} {
+		if err := os.MkdirAll(path.Join(root, "repo", name, "repodata"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(root, "repo", name, "repodata/repomd.xml"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := func() string {
+		target, err := os.Readlink(path.Join(root, "prod/repo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.IsAbs(target) {
+			t.Errorf("expected relative symlink, got %s", target)
+		}
+		data, err := ioutil.ReadFile(path.Join(root, "prod/repo/repodata/repomd.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if err := Promote(root, "repo", "20261231", "prod"); err == nil {
+		t.Error("expected error for missing snapshot")
+	}
+	if err := Promote(root, "repo", "20261001", "repo"); err == nil {
+		t.Error("expected error for channel named like the repository")
+	}
+	if err := Promote(root, "repo", "20261001", "prod"); err != nil {
+		t.Fatal(err)
+	}
+	if current() != "20261001" {
+		t.Errorf("expected prod to point to 20261001, got %s", current())
+	}
+	if err := Promote(root, "repo", path.Join(root, "repo/20261016"), "prod"); err != nil {
+		t.Fatal(err)
+	}
+	if current() != "20261016" {
+		t.Errorf("expected prod to point to 20261016, got %s", current())
+	}
+	channels, err := ListChannels(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].Channel != "prod" || channels[0].Repo != "repo" || channels[0].Snapshot != "repo/20261016" {
+		t.Errorf("unexpected channels %+v", channels)
+	}
+
+	// the rollback target is kept by retention although no channel points to it
+	res, err := ApplyRetention(path.Join(root, "repo"), RetentionPolicy{Last: 1}, root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Removed) != 0 {
+		t.Errorf("rollback target has been removed: %v", res.Removed)
+	}
+	previous, err := Rollback(root, "repo", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous != "repo/20261001" || current() != "20261001" {
+		t.Errorf("expected rollback to 20261001, got %s", current())
+	}
+
+	// the promoted older snapshot is kept by retention
+	res, err = ApplyRetention(path.Join(root, "repo"), RetentionPolicy{Last: 1}, root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Removed) != 0 {
+		t.Errorf("promoted snapshot would be removed: %v", res.Removed)
+	}
+	if _, err := Rollback(root, "repo", "prod"); err == nil {
+		t.Error("expected error for rollback without previous snapshot")
+	}
+	history, err := PromotionHistory(root, "prod", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := []string{}
+	for _, p := range history {
+		actions = append(actions, p.Action+" "+p.Snapshot)
+	}
+	if strings.Join(actions, ", ") != "promote repo/20261001, promote repo/20261016, rollback repo/20261001" {
+		t.Errorf("unexpected history %v", actions)
+	}
+}
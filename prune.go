@@ -0,0 +1,162 @@
+package gym
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// PruneResult summarizes the outcome of a prune run.
+type PruneResult struct {
+	Files  []string // pruned (or, on a dry-run, prunable) rpms relative to LocalPath
+	Bytes  int64    // bytes reclaimed, rpms still linked from the store or a snapshot free nothing
+	Total  int      // number of local rpms found
+	DryRun bool
+}
+
+// Prune removes local rpms that are no longer referenced by the repository's
+// primary metadata. Prune refuses to delete anything if more than maxPercent of
+// the local rpms would be removed. A maxPercent of 100 or more disables this safety
+// limit. With dryRun set, nothing is deleted and the prunable rpms are only reported.
+func (r *Repo) Prune(maxPercent int, dryRun bool) (*PruneResult, error) {
+	referenced, err := r.referencedRPMs()
+	if err != nil {
+		return nil, err
+	}
+	local, err := r.localRPMs()
+	if err != nil {
+		return nil, err
+	}
+	res := &PruneResult{Total: len(local), DryRun: dryRun}
+	candidates := []string{}
+	for _, relPath := range local {
+		if !referenced[relPath] {
+			candidates = append(candidates, relPath)
+		}
+	}
+	if len(candidates) == 0 {
+		Log.Info("finished prune", "name", r.Name, "prunedPackages", 0, "reclaimedBytes", 0, "dryRun", dryRun)
+		return res, nil
+	}
+	percent := float64(len(candidates)) * 100 / float64(len(local))
+	if maxPercent < 100 && percent > float64(maxPercent) {
+		return nil, fmt.Errorf("refusing to prune %d of %d packages (%.2f%%), limit is %d%%", len(candidates), len(local), percent, maxPercent)
+	}
+	verified := openVerifiedDB(r.LocalPath)
+	for _, relPath := range candidates {
+		p := path.Join(r.LocalPath, relPath)
+		fi, err := os.Stat(p)
+		if err != nil {
+			return res, err
+		}
+		if dryRun {
+			Log.Info(ellipsis(path.Base(relPath), 40), "status", "prunable", "numBytes", fi.Size())
+		} else {
+			if err := os.Remove(p); err != nil {
+				return res, err
+			}
+			verified.forget(relPath)
+			Log.Info(ellipsis(path.Base(relPath), 40), "status", "pruned", "numBytes", fi.Size())
+		}
+		res.Files = append(res.Files, relPath)
+		if stat, ok := fi.Sys().(*syscall.Stat_t); !ok || stat.Nlink <= 1 {
+			res.Bytes = res.Bytes + fi.Size()
+		}
+	}
+	if !dryRun {
+		if err := verified.save(); err != nil {
+			Log.Warn("could not write verified packages state", "name", r.Name, "err", err)
+		}
+	}
+	Log.Info("finished prune", "name", r.Name, "prunedPackages", len(res.Files), "reclaimedBytes", res.Bytes, "dryRun", dryRun)
+	return res, nil
+}
+
+// localRPMs returns all rpm files below LocalPath relative to LocalPath. Hidden
+// directories like .newrepodata are skipped.
+func (r *Repo) localRPMs() ([]string, error) {
+	rpms := []string{}
+	err := filepath.Walk(r.LocalPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != r.LocalPath && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || filepath.Ext(p) != ".rpm" {
+			return nil
+		}
+		rel, err := filepath.Rel(r.LocalPath, p)
+		if err != nil {
+			return err
+		}
+		rpms = append(rpms, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(rpms)
+	return rpms, err
+}
+
+// referencedRPMs returns the location hrefs of all packages in the primary metadata.
+func (r *Repo) referencedRPMs() (map[string]bool, error) {
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		return nil, err
+	}
+	hrefs := map[string]bool{}
+	if primary, ok := metaFiles.get("primary_db"); ok {
+		tmpFile, err := uncompress(r.metaPath(primary))
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmpFile.Name())
+		return hrefs, processSqlite(tmpFile.Name(), "select location_href from packages", func(rows *sql.Rows) error {
+			for rows.Next() {
+				var locationHref string
+				if err := rows.Scan(&locationHref); err != nil {
+					return err
+				}
+				hrefs[path.Clean(locationHref)] = true
+			}
+			return rows.Err()
+		})
+	}
+	primary, ok := metaFiles.get("primary")
+	if !ok {
+		return nil, errors.New("no primary db sqlite or xml file found")
+	}
+	tmpFile, err := uncompress(r.metaPath(primary))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+	return hrefs, processXML(tmpFile.Name(), func(decoder *xml.Decoder) error {
+		for {
+			t, err := decoder.Token()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if se, ok := t.(xml.StartElement); ok && se.Name.Local == "package" {
+				var p rpmPackage
+				if err := decoder.DecodeElement(&p, &se); err != nil {
+					return err
+				}
+				hrefs[path.Clean(p.Location.Href)] = true
+			}
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package gym
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := copyDir("testdata/repo", dir); err != nil {
+		t.Fatal(err)
+	}
+	orphan := path.Join(dir, "repo/Packages/orphan-1.0-1.noarch.rpm")
+	if err := ioutil.WriteFile(orphan, []byte("orphan"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// an rpm linked from the store reclaims no space
+	linked := path.Join(dir, "repo/Packages/linked-1.0-1.noarch.rpm")
+	if err := ioutil.WriteFile(linked, []byte("linked"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(linked, path.Join(dir, "blob")); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepo(path.Join(dir, "repo"), nil, nil, time.Second)
+
+	if _, err := r.Prune(10, false); err == nil {
+		t.Error("pruning 67% of the packages should fail with a limit of 10%")
+	}
+
+	res, err := r.Prune(70, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 2 || res.Bytes != 6 {
+		t.Errorf("expected 2 prunable files with 6 bytes, got %d files with %d bytes", len(res.Files), res.Bytes)
+	}
+	if _, err := os.Stat(orphan); err != nil {
+		t.Errorf("dry-run must not delete %s", orphan)
+	}
+	if _, err := os.Stat(path.Join(r.LocalPath, verifiedFile)); !os.IsNotExist(err) {
+		t.Error("dry-run must not write the verified packages state")
+	}
+
+	if _, err := r.Prune(100, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("%s should have been pruned", orphan)
+	}
+	if _, err := os.Stat(path.Join(dir, "repo/Packages/GeoIP-devel-1.5.0-9.el7.i686.rpm")); err != nil {
+		t.Error("referenced package has been pruned")
+	}
+}
@@ -0,0 +1,26 @@
+package gym
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink creates dest as a copy on write clone of source with the FICLONE ioctl.
+func reflink(source, dest string) error {
+	s, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	d, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(d.Fd()), int(s.Fd())); err != nil {
+		d.Close()
+		os.Remove(dest)
+		return err
+	}
+	return d.Close()
+}
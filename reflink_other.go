@@ -0,0 +1,8 @@
+//go:build !linux
+
+package gym
+
+// reflink is only supported on linux, the rpm is copied instead.
+func reflink(source, dest string) error {
+	return errReflinkNotSupported
+}
@@ -0,0 +1,572 @@
+package gym
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RepodataOptions configure the repository metadata written by gym.
+type RepodataOptions struct {
+	Compression  string // compression of the metadata files: gz, xz or zstd
+	ChecksumType string // checksum type for packages and metadata files: sha1, sha256 or sha512
+	GroupFile    string // optional comps file added as group metadata, it may be compressed
+	ModulesFile  string // optional modules.yaml added as modules metadata, it may be compressed
+}
+
+// DefaultRepodataOptions returns the repodata options used by NewRepo.
+func DefaultRepodataOptions() RepodataOptions {
+	return RepodataOptions{
+		Compression:  "gz",
+		ChecksumType: "sha256",
+	}
+}
+
+// pkgMeta holds the metadata of a package as found in primary, filelists and other.
+// The xml tags are used to read the metadata, writing is done by the write functions.
+type pkgMeta struct {
+	Type        string         `xml:"type,attr"`
+	Name        string         `xml:"name"`
+	Arch        string         `xml:"arch"`
+	Version     pkgVersion     `xml:"version"`
+	Checksum    pkgChecksum    `xml:"checksum"`
+	Summary     string         `xml:"summary"`
+	Description string         `xml:"description"`
+	Packager    string         `xml:"packager"`
+	URL         string         `xml:"url"`
+	Time        pkgTime        `xml:"time"`
+	Size        pkgSize        `xml:"size"`
+	Location    pkgLocation    `xml:"location"`
+	Format      pkgFormat      `xml:"format"`
+	Files       []pkgFile      `xml:"-"` // all files from filelists
+	Changelogs  []pkgChangelog `xml:"-"`
+}
+
+type pkgVersion struct {
+	Epoch string `xml:"epoch,attr"`
+	Ver   string `xml:"ver,attr"`
+	Rel   string `xml:"rel,attr"`
+}
+
+type pkgChecksum struct {
+	Type  string `xml:"type,attr"`
+	PkgID string `xml:"pkgid,attr"`
+	Value string `xml:",chardata"`
+}
+
+type pkgTime struct {
+	File  int64 `xml:"file,attr"`
+	Build int64 `xml:"build,attr"`
+}
+
+type pkgSize struct {
+	Package   int64 `xml:"package,attr"`
+	Installed int64 `xml:"installed,attr"`
+	Archive   int64 `xml:"archive,attr"`
+}
+
+type pkgLocation struct {
+	Base string `xml:"base,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type pkgFormat struct {
+	License     string         `xml:"license"`
+	Vendor      string         `xml:"vendor"`
+	Group       string         `xml:"group"`
+	BuildHost   string         `xml:"buildhost"`
+	SourceRPM   string         `xml:"sourcerpm"`
+	HeaderRange pkgHeaderRange `xml:"header-range"`
+	Provides    []pkgEntry     `xml:"provides>entry"`
+	Requires    []pkgEntry     `xml:"requires>entry"`
+	Conflicts   []pkgEntry     `xml:"conflicts>entry"`
+	Obsoletes   []pkgEntry     `xml:"obsoletes>entry"`
+	Suggests    []pkgEntry     `xml:"suggests>entry"`
+	Enhances    []pkgEntry     `xml:"enhances>entry"`
+	Recommends  []pkgEntry     `xml:"recommends>entry"`
+	Supplements []pkgEntry     `xml:"supplements>entry"`
+	Files       []pkgFile      `xml:"file"` // primary files only
+}
+
+type pkgHeaderRange struct {
+	Start int64 `xml:"start,attr"`
+	End   int64 `xml:"end,attr"`
+}
+
+// pkgEntry is a dependency entry like a provide or require.
+type pkgEntry struct {
+	Name  string `xml:"name,attr"`
+	Flags string `xml:"flags,attr"`
+	Epoch string `xml:"epoch,attr"`
+	Ver   string `xml:"ver,attr"`
+	Rel   string `xml:"rel,attr"`
+	Pre   string `xml:"pre,attr"`
+}
+
+type pkgFile struct {
+	Type string `xml:"type,attr"`
+	Path string `xml:",chardata"`
+}
+
+type pkgChangelog struct {
+	Author string `xml:"author,attr"`
+	Date   int64  `xml:"date,attr"`
+	Text   string `xml:",chardata"`
+}
+
+// rpm returns the rpm to sync for the package.
+func (p *pkgMeta) rpm() *rpm {
+	r := newRPM(p.Location.Href, p.Checksum.Value, p.Checksum.Type, int(p.Size.Archive))
+	r.arch = p.Arch
+	r.pkg = p
+	return r
+}
+
+// dependencies returns the dependency lists of a package with their primary element name.
+func (p *pkgMeta) dependencies() []struct {
+	name    string
+	entries []pkgEntry
+} {
+	return []struct {
+		name    string
+		entries []pkgEntry
+	}{
+		{"provides", p.Format.Provides},
+		{"requires", p.Format.Requires},
+		{"conflicts", p.Format.Conflicts},
+		{"obsoletes", p.Format.Obsoletes},
+		{"suggests", p.Format.Suggests},
+		{"enhances", p.Format.Enhances},
+		{"recommends", p.Format.Recommends},
+		{"supplements", p.Format.Supplements},
+	}
+}
+
+// isPrimaryFile reports whether a file is listed in primary in addition to filelists.
+func isPrimaryFile(name string) bool {
+	return strings.HasPrefix(name, "/etc/") || strings.Contains(name, "bin/") || name == "/usr/lib/sendmail"
+}
+
+// repodataRecord is a metadata file referenced in repomd.xml.
+type repodataRecord struct {
+	fileType     string
+	href         string
+	checksum     string
+	openChecksum string
+	size         int64
+	openSize     int64
+	timestamp    int64
+	dbVersion    int
+}
+
+// repodataWriter writes metadata files into a repodata directory and collects the
+// records for repomd.xml.
+type repodataWriter struct {
+	dir     string
+	opts    RepodataOptions
+	records []repodataRecord
+}
+
+// writeFile writes a metadata file produced by fn. If compress is set, the file is
+// compressed with the configured compression. The file name is prefixed with its checksum.
+func (w *repodataWriter) writeFile(fileType string, name string, compress bool, fn func(io.Writer) error) (repodataRecord, error) {
+	rec := repodataRecord{fileType: fileType, timestamp: time.Now().Unix()}
+	tmp, err := ioutil.TempFile(w.dir, ".tmp-")
+	if err != nil {
+		return rec, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	fileHash, err := newHash(w.opts.ChecksumType)
+	if err != nil {
+		return rec, err
+	}
+	openHash, _ := newHash(w.opts.ChecksumType)
+	fileCounter := &countWriter{w: io.MultiWriter(tmp, fileHash)}
+	var out io.Writer = fileCounter
+	var cw io.WriteCloser
+	if compress {
+		var ext string
+		cw, ext, err = compressor(fileCounter, w.opts.Compression)
+		if err != nil {
+			return rec, err
+		}
+		name = name + ext
+		out = cw
+	}
+	openCounter := &countWriter{w: io.MultiWriter(out, openHash)}
+	bw := bufio.NewWriter(openCounter)
+	if err := fn(bw); err != nil {
+		return rec, err
+	}
+	if err := bw.Flush(); err != nil {
+		return rec, err
+	}
+	if cw != nil {
+		if err := cw.Close(); err != nil {
+			return rec, err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return rec, err
+	}
+	rec.checksum = hex.EncodeToString(fileHash.Sum(nil))
+	rec.size = fileCounter.n
+	if compress {
+		rec.openChecksum = hex.EncodeToString(openHash.Sum(nil))
+		rec.openSize = openCounter.n
+	}
+	fileName := rec.checksum + "-" + name
+	rec.href = "repodata/" + fileName
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return rec, err
+	}
+	if err := os.Rename(tmp.Name(), path.Join(w.dir, fileName)); err != nil {
+		return rec, err
+	}
+	w.records = append(w.records, rec)
+	return rec, nil
+}
+
+// writeRepomd writes repomd.xml with all records written so far.
+func (w *repodataWriter) writeRepomd(revision int64) error {
+	buf := new(bytes.Buffer)
+	buf.WriteString(xmlHeader)
+	buf.WriteString(`<repomd xmlns="http://linux.duke.edu/metadata/repo" xmlns:rpm="http://linux.duke.edu/metadata/rpm">` + "\n")
+	fmt.Fprintf(buf, "  <revision>%d</revision>\n", revision)
+	for _, rec := range w.records {
+		fmt.Fprintf(buf, "  <data type=\"%s\">\n", escapeXML(rec.fileType))
+		fmt.Fprintf(buf, "    <checksum type=\"%s\">%s</checksum>\n", w.opts.ChecksumType, rec.checksum)
+		if len(rec.openChecksum) > 0 {
+			fmt.Fprintf(buf, "    <open-checksum type=\"%s\">%s</open-checksum>\n", w.opts.ChecksumType, rec.openChecksum)
+		}
+		fmt.Fprintf(buf, "    <location href=\"%s\"/>\n", escapeXML(rec.href))
+		fmt.Fprintf(buf, "    <timestamp>%d</timestamp>\n", rec.timestamp)
+		fmt.Fprintf(buf, "    <size>%d</size>\n", rec.size)
+		if rec.openSize > 0 {
+			fmt.Fprintf(buf, "    <open-size>%d</open-size>\n", rec.openSize)
+		}
+		if rec.dbVersion > 0 {
+			fmt.Fprintf(buf, "    <database_version>%d</database_version>\n", rec.dbVersion)
+		}
+		buf.WriteString("  </data>\n")
+	}
+	buf.WriteString("</repomd>\n")
+	return ioutil.WriteFile(path.Join(w.dir, "repomd.xml"), buf.Bytes(), 0644)
+}
+
+// writeRepodata writes the metadata for pkgs into dir/repodata. The metadata is written
+// to dir/.repodata first and replaces an existing repodata directory when complete.
+// The extra records (like updateinfo) are written compressed, modules from opts.ModulesFile are
+// only added if extra has no modules.
+func writeRepodata(dir string, pkgs []*pkgMeta, opts RepodataOptions, extra map[string][]byte) error {
+	if len(opts.Compression) == 0 {
+		opts.Compression = "gz"
+	}
+	if len(opts.ChecksumType) == 0 {
+		opts.ChecksumType = "sha256"
+	}
+	tmpDir := path.Join(dir, ".repodata")
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	w := &repodataWriter{dir: tmpDir, opts: opts}
+
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		return pkgs[i].Location.Href < pkgs[j].Location.Href
+	})
+	xmlFiles := []struct {
+		fileType string
+		fn       func(io.Writer, []*pkgMeta) error
+	}{
+		{"primary", writePrimaryXML},
+		{"filelists", writeFilelistsXML},
+		{"other", writeOtherXML},
+	}
+	for _, x := range xmlFiles {
+		fn := x.fn
+		rec, err := w.writeFile(x.fileType, x.fileType+".xml", true, func(out io.Writer) error {
+			return fn(out, pkgs)
+		})
+		if err != nil {
+			return fmt.Errorf("could not write %s: %s", x.fileType, err)
+		}
+		db, err := createSqlite(x.fileType, pkgs, rec.openChecksum)
+		if err != nil {
+			return fmt.Errorf("could not create %s database: %s", x.fileType, err)
+		}
+		_, err = w.writeFile(x.fileType+"_db", x.fileType+".sqlite", true, func(out io.Writer) error {
+			f, err := os.Open(db)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(out, f)
+			return err
+		})
+		os.Remove(db)
+		if err != nil {
+			return fmt.Errorf("could not write %s database: %s", x.fileType, err)
+		}
+		w.records[len(w.records)-1].dbVersion = sqliteDBVersion
+	}
+
+	if len(opts.GroupFile) > 0 {
+		if err := w.writeGroup(opts.GroupFile); err != nil {
+			return fmt.Errorf("could not write group file: %s", err)
+		}
+	}
+	if _, ok := extra["modules"]; !ok && len(opts.ModulesFile) > 0 {
+		data, err := readMetadataFile(opts.ModulesFile)
+		if err != nil {
+			return fmt.Errorf("could not read modules file: %s", err)
+		}
+		if _, err := readModules(bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("invalid modules file %s: %s", opts.ModulesFile, err)
+		}
+		all := map[string][]byte{"modules": data}
+		for fileType, data := range extra {
+			all[fileType] = data
+		}
+		extra = all
+	}
+	types := []string{}
+	for fileType := range extra {
+		types = append(types, fileType)
+	}
+	sort.Strings(types)
+	for _, fileType := range types {
+		data := extra[fileType]
+		if _, err := w.writeFile(fileType, fileType+extraFileSuffix(fileType), true, func(out io.Writer) error {
+			_, err := out.Write(data)
+			return err
+		}); err != nil {
+			return fmt.Errorf("could not write %s: %s", fileType, err)
+		}
+	}
+	if err := w.writeRepomd(time.Now().Unix()); err != nil {
+		return err
+	}
+
+	repodata := path.Join(dir, "repodata")
+	if err := os.RemoveAll(repodata); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, repodata)
+}
+
+// extraFileSuffix returns the file name suffix of an additional metadata file type.
+func extraFileSuffix(fileType string) string {
+	if fileType == "modules" {
+		return ".yaml"
+	}
+	return ".xml"
+}
+
+// writeGroup adds the comps file as uncompressed group and as compressed group_<compression> record.
+func (w *repodataWriter) writeGroup(groupFile string) error {
+	data, err := readMetadataFile(groupFile)
+	if err != nil {
+		return err
+	}
+	write := func(out io.Writer) error {
+		_, err := out.Write(data)
+		return err
+	}
+	if _, err := w.writeFile("group", "comps.xml", false, write); err != nil {
+		return err
+	}
+	groupType := "group_gz"
+	switch w.opts.Compression {
+	case "xz":
+		groupType = "group_xz"
+	case "zstd":
+		groupType = "group_zst"
+	}
+	_, err = w.writeFile(groupType, "comps.xml", true, write)
+	return err
+}
+
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8"?>` + "\n"
+
+// writePrimaryXML writes primary.xml for pkgs.
+func writePrimaryXML(out io.Writer, pkgs []*pkgMeta) error {
+	w := &xmlWriter{w: out}
+	w.printf(xmlHeader)
+	w.printf("<metadata xmlns=\"http://linux.duke.edu/metadata/common\" xmlns:rpm=\"http://linux.duke.edu/metadata/rpm\" packages=\"%d\">\n", len(pkgs))
+	for _, p := range pkgs {
+		w.printf("<package type=\"rpm\">\n")
+		w.element("  ", "name", p.Name)
+		w.element("  ", "arch", p.Arch)
+		w.printf("  <version epoch=\"%s\" ver=\"%s\" rel=\"%s\"/>\n", escapeXML(p.Version.Epoch), escapeXML(p.Version.Ver), escapeXML(p.Version.Rel))
+		w.printf("  <checksum type=\"%s\" pkgid=\"YES\">%s</checksum>\n", escapeXML(p.Checksum.Type), escapeXML(p.Checksum.Value))
+		w.element("  ", "summary", p.Summary)
+		w.element("  ", "description", p.Description)
+		w.element("  ", "packager", p.Packager)
+		w.element("  ", "url", p.URL)
+		w.printf("  <time file=\"%d\" build=\"%d\"/>\n", p.Time.File, p.Time.Build)
+		w.printf("  <size package=\"%d\" installed=\"%d\" archive=\"%d\"/>\n", p.Size.Package, p.Size.Installed, p.Size.Archive)
+		if len(p.Location.Base) > 0 {
+			w.printf("  <location xml:base=\"%s\" href=\"%s\"/>\n", escapeXML(p.Location.Base), escapeXML(p.Location.Href))
+		} else {
+			w.printf("  <location href=\"%s\"/>\n", escapeXML(p.Location.Href))
+		}
+		w.printf("  <format>\n")
+		w.element("    ", "rpm:license", p.Format.License)
+		w.element("    ", "rpm:vendor", p.Format.Vendor)
+		w.element("    ", "rpm:group", p.Format.Group)
+		w.element("    ", "rpm:buildhost", p.Format.BuildHost)
+		w.element("    ", "rpm:sourcerpm", p.Format.SourceRPM)
+		w.printf("    <rpm:header-range start=\"%d\" end=\"%d\"/>\n", p.Format.HeaderRange.Start, p.Format.HeaderRange.End)
+		for _, dep := range p.dependencies() {
+			if len(dep.entries) == 0 {
+				continue
+			}
+			w.printf("    <rpm:%s>\n", dep.name)
+			for _, e := range dep.entries {
+				w.printf("      <rpm:entry name=\"%s\"", escapeXML(e.Name))
+				if len(e.Flags) > 0 {
+					w.printf(" flags=\"%s\" epoch=\"%s\" ver=\"%s\"", escapeXML(e.Flags), escapeXML(e.Epoch), escapeXML(e.Ver))
+					if len(e.Rel) > 0 {
+						w.printf(" rel=\"%s\"", escapeXML(e.Rel))
+					}
+				}
+				if len(e.Pre) > 0 && e.Pre != "0" {
+					w.printf(" pre=\"1\"")
+				}
+				w.printf("/>\n")
+			}
+			w.printf("    </rpm:%s>\n", dep.name)
+		}
+		for _, f := range p.Format.Files {
+			w.file("    ", f)
+		}
+		w.printf("  </format>\n")
+		w.printf("</package>\n")
+	}
+	w.printf("</metadata>\n")
+	return w.err
+}
+
+// writeFilelistsXML writes filelists.xml for pkgs.
+func writeFilelistsXML(out io.Writer, pkgs []*pkgMeta) error {
+	w := &xmlWriter{w: out}
+	w.printf(xmlHeader)
+	w.printf("<filelists xmlns=\"http://linux.duke.edu/metadata/filelists\" packages=\"%d\">\n", len(pkgs))
+	for _, p := range pkgs {
+		w.packageStart(p)
+		for _, f := range p.Files {
+			w.file("  ", f)
+		}
+		w.printf("</package>\n")
+	}
+	w.printf("</filelists>\n")
+	return w.err
+}
+
+// writeOtherXML writes other.xml for pkgs.
+func writeOtherXML(out io.Writer, pkgs []*pkgMeta) error {
+	w := &xmlWriter{w: out}
+	w.printf(xmlHeader)
+	w.printf("<otherdata xmlns=\"http://linux.duke.edu/metadata/other\" packages=\"%d\">\n", len(pkgs))
+	for _, p := range pkgs {
+		w.packageStart(p)
+		for _, c := range p.Changelogs {
+			w.printf("  <changelog author=\"%s\" date=\"%d\">%s</changelog>\n", escapeXML(c.Author), c.Date, escapeXML(c.Text))
+		}
+		w.printf("</package>\n")
+	}
+	w.printf("</otherdata>\n")
+	return w.err
+}
+
+// xmlWriter is a small helper to write metadata xml, it remembers the first error.
+type xmlWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *xmlWriter) printf(format string, a ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, a...)
+}
+
+// element writes a simple element, empty values result in an empty element.
+func (w *xmlWriter) element(indent string, name string, value string) {
+	if len(value) == 0 {
+		w.printf("%s<%s/>\n", indent, name)
+		return
+	}
+	w.printf("%s<%s>%s</%s>\n", indent, name, escapeXML(value), name)
+}
+
+func (w *xmlWriter) file(indent string, f pkgFile) {
+	if len(f.Type) > 0 && f.Type != "file" {
+		w.printf("%s<file type=\"%s\">%s</file>\n", indent, escapeXML(f.Type), escapeXML(f.Path))
+		return
+	}
+	w.printf("%s<file>%s</file>\n", indent, escapeXML(f.Path))
+}
+
+// packageStart writes the package element and version used by filelists and other.
+func (w *xmlWriter) packageStart(p *pkgMeta) {
+	w.printf("<package pkgid=\"%s\" name=\"%s\" arch=\"%s\">\n", escapeXML(p.Checksum.Value), escapeXML(p.Name), escapeXML(p.Arch))
+	w.printf("  <version epoch=\"%s\" ver=\"%s\" rel=\"%s\"/>\n", escapeXML(p.Version.Epoch), escapeXML(p.Version.Ver), escapeXML(p.Version.Rel))
+}
+
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+// escapeXML escapes s for xml text and attributes and drops characters not allowed in xml.
+func escapeXML(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || r >= 0x20 && r != 0xfffe && r != 0xffff {
+			return r
+		}
+		return -1
+	}, s)
+	return xmlEscaper.Replace(s)
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n = c.n + int64(n)
+	return n, err
+}
+
+// splitEVR splits [epoch:]version[-release] into its parts.
+func splitEVR(evr string) (epoch, version, release string) {
+	if i := strings.Index(evr, ":"); i >= 0 {
+		epoch = evr[:i]
+		evr = evr[i+1:]
+	}
+	version = evr
+	if i := strings.LastIndex(evr, "-"); i >= 0 {
+		version = evr[:i]
+		release = evr[i+1:]
+	}
+	if len(epoch) == 0 && len(version) > 0 {
+		epoch = "0"
+	}
+	return epoch, version, release
+}
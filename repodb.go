@@ -0,0 +1,202 @@
+package gym
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// sqliteDBVersion is the database version of the generated sqlite metadata.
+const sqliteDBVersion = 10
+
+var sqliteSchema = map[string][]string{
+	"primary": {
+		`CREATE TABLE packages (pkgKey INTEGER PRIMARY KEY, pkgId TEXT, name TEXT, arch TEXT, version TEXT, epoch TEXT, release TEXT, summary TEXT, description TEXT, url TEXT, time_file INTEGER, time_build INTEGER, rpm_license TEXT, rpm_vendor TEXT, rpm_group TEXT, rpm_buildhost TEXT, rpm_sourcerpm TEXT, rpm_header_start INTEGER, rpm_header_end INTEGER, rpm_packager TEXT, size_package INTEGER, size_installed INTEGER, size_archive INTEGER, location_href TEXT, location_base TEXT, checksum_type TEXT)`,
+		`CREATE TABLE files (name TEXT, type TEXT, pkgKey INTEGER)`,
+		`CREATE TABLE requires (name TEXT, flags TEXT, epoch TEXT, version TEXT, release TEXT, pkgKey INTEGER, pre BOOLEAN DEFAULT FALSE)`,
+		`CREATE TABLE provides (name TEXT, flags TEXT, epoch TEXT, version TEXT, release TEXT, pkgKey INTEGER)`,
+		`CREATE TABLE conflicts (name TEXT, flags TEXT, epoch TEXT, version TEXT, release TEXT, pkgKey INTEGER)`,
+		`CREATE TABLE obsoletes (name TEXT, flags TEXT, epoch TEXT, version TEXT, release TEXT, pkgKey INTEGER)`,
+		`CREATE TABLE suggests (name TEXT, flags TEXT, epoch TEXT, version TEXT, release TEXT, pkgKey INTEGER)`,
+		`CREATE TABLE enhances (name TEXT, flags TEXT, epoch TEXT, version TEXT, release TEXT, pkgKey INTEGER)`,
+		`CREATE TABLE recommends (name TEXT, flags TEXT, epoch TEXT, version TEXT, release TEXT, pkgKey INTEGER)`,
+		`CREATE TABLE supplements (name TEXT, flags TEXT, epoch TEXT, version TEXT, release TEXT, pkgKey INTEGER)`,
+		`CREATE INDEX packagename ON packages (name)`,
+		`CREATE INDEX packageId ON packages (pkgId)`,
+		`CREATE INDEX filenames ON files (name)`,
+		`CREATE INDEX pkgfiles ON files (pkgKey)`,
+		`CREATE INDEX pkgrequires ON requires (pkgKey)`,
+		`CREATE INDEX requiresname ON requires (name)`,
+		`CREATE INDEX pkgprovides ON provides (pkgKey)`,
+		`CREATE INDEX providesname ON provides (name)`,
+		`CREATE INDEX pkgconflicts ON conflicts (pkgKey)`,
+		`CREATE INDEX pkgobsoletes ON obsoletes (pkgKey)`,
+	},
+	"filelists": {
+		`CREATE TABLE packages (pkgKey INTEGER PRIMARY KEY, pkgId TEXT)`,
+		`CREATE TABLE filelist (pkgKey INTEGER, dirname TEXT, filenames TEXT, filetypes TEXT)`,
+		`CREATE INDEX keyfile ON filelist (pkgKey)`,
+		`CREATE INDEX pkgId ON packages (pkgId)`,
+		`CREATE INDEX dirnames ON filelist (dirname)`,
+	},
+	"other": {
+		`CREATE TABLE packages (pkgKey INTEGER PRIMARY KEY, pkgId TEXT)`,
+		`CREATE TABLE changelog (pkgKey INTEGER, author TEXT, date INTEGER, changelog TEXT)`,
+		`CREATE INDEX keychange ON changelog (pkgKey)`,
+		`CREATE INDEX pkgId ON packages (pkgId)`,
+	},
+}
+
+// createSqlite creates the sqlite database of a metadata type (primary, filelists or other)
+// in a temporary file and returns its path. xmlChecksum is the open checksum of the
+// corresponding xml file.
+func createSqlite(fileType string, pkgs []*pkgMeta, xmlChecksum string) (string, error) {
+	schema, ok := sqliteSchema[fileType]
+	if !ok {
+		return "", fmt.Errorf("unknown metadata type %s", fileType)
+	}
+	f, err := ioutil.TempFile("", "gym-"+fileType+"-")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	db, err := sql.Open("sqlite3", f.Name())
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	err = fillSqlite(db, fileType, schema, pkgs, xmlChecksum)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func fillSqlite(db *sql.DB, fileType string, schema []string, pkgs []*pkgMeta, xmlChecksum string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmts := append([]string{`CREATE TABLE db_info (dbversion INTEGER, checksum TEXT)`}, schema...)
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO db_info (dbversion, checksum) VALUES (?, ?)`, sqliteDBVersion, xmlChecksum); err != nil {
+		return err
+	}
+	var insert func(*sql.Tx, int, *pkgMeta) error
+	switch fileType {
+	case "primary":
+		insert = insertPrimary
+	case "filelists":
+		insert = insertFilelists
+	case "other":
+		insert = insertOther
+	}
+	for i, p := range pkgs {
+		if err := insert(tx, i+1, p); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func insertPrimary(tx *sql.Tx, pkgKey int, p *pkgMeta) error {
+	_, err := tx.Exec(`INSERT INTO packages (pkgKey, pkgId, name, arch, version, epoch, release, summary, description, url, time_file, time_build, rpm_license, rpm_vendor, rpm_group, rpm_buildhost, rpm_sourcerpm, rpm_header_start, rpm_header_end, rpm_packager, size_package, size_installed, size_archive, location_href, location_base, checksum_type) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		pkgKey, p.Checksum.Value, p.Name, p.Arch, p.Version.Ver, p.Version.Epoch, p.Version.Rel, p.Summary, p.Description, p.URL,
+		p.Time.File, p.Time.Build, p.Format.License, p.Format.Vendor, p.Format.Group, p.Format.BuildHost, p.Format.SourceRPM,
+		p.Format.HeaderRange.Start, p.Format.HeaderRange.End, p.Packager, p.Size.Package, p.Size.Installed, p.Size.Archive,
+		p.Location.Href, nullString(p.Location.Base), p.Checksum.Type)
+	if err != nil {
+		return err
+	}
+	for _, f := range p.Format.Files {
+		fileType := f.Type
+		if len(fileType) == 0 {
+			fileType = "file"
+		}
+		if _, err := tx.Exec(`INSERT INTO files (name, type, pkgKey) VALUES (?, ?, ?)`, f.Path, fileType, pkgKey); err != nil {
+			return err
+		}
+	}
+	for _, dep := range p.dependencies() {
+		for _, e := range dep.entries {
+			if dep.name == "requires" {
+				_, err = tx.Exec(`INSERT INTO requires (name, flags, epoch, version, release, pkgKey, pre) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+					e.Name, nullString(e.Flags), nullString(e.Epoch), nullString(e.Ver), nullString(e.Rel), pkgKey, e.Pre == "1")
+			} else {
+				_, err = tx.Exec(`INSERT INTO `+dep.name+` (name, flags, epoch, version, release, pkgKey) VALUES (?, ?, ?, ?, ?, ?)`,
+					e.Name, nullString(e.Flags), nullString(e.Epoch), nullString(e.Ver), nullString(e.Rel), pkgKey)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func insertFilelists(tx *sql.Tx, pkgKey int, p *pkgMeta) error {
+	if _, err := tx.Exec(`INSERT INTO packages (pkgKey, pkgId) VALUES (?, ?)`, pkgKey, p.Checksum.Value); err != nil {
+		return err
+	}
+	// files are grouped by directory, names are separated by / and types are encoded as f, d or g
+	dirs := []string{}
+	names := map[string][]string{}
+	types := map[string]string{}
+	for _, f := range p.Files {
+		dir, name := path.Split(f.Path)
+		dir = strings.TrimSuffix(dir, "/")
+		if len(dir) == 0 {
+			dir = "/"
+		}
+		if _, ok := names[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		names[dir] = append(names[dir], name)
+		switch f.Type {
+		case "dir":
+			types[dir] += "d"
+		case "ghost":
+			types[dir] += "g"
+		default:
+			types[dir] += "f"
+		}
+	}
+	for _, dir := range dirs {
+		if _, err := tx.Exec(`INSERT INTO filelist (pkgKey, dirname, filenames, filetypes) VALUES (?, ?, ?, ?)`, pkgKey, dir, strings.Join(names[dir], "/"), types[dir]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertOther(tx *sql.Tx, pkgKey int, p *pkgMeta) error {
+	if _, err := tx.Exec(`INSERT INTO packages (pkgKey, pkgId) VALUES (?, ?)`, pkgKey, p.Checksum.Value); err != nil {
+		return err
+	}
+	for _, c := range p.Changelogs {
+		if _, err := tx.Exec(`INSERT INTO changelog (pkgKey, author, date, changelog) VALUES (?, ?, ?, ?)`, pkgKey, c.Author, c.Date, c.Text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nullString returns nil for empty strings to store them as NULL.
+func nullString(s string) interface{} {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
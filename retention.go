@@ -0,0 +1,315 @@
+package gym
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RetentionPolicy defines which snapshots of a repository are kept. The buckets count only days,
+// weeks or months with snapshots, the newest snapshot of a bucket is kept.
+type RetentionPolicy struct {
+	Last    int // keep the newest N snapshots
+	Daily   int // keep one snapshot for each of the last N days
+	Weekly  int // keep one snapshot for each of the last N weeks
+	Monthly int // keep one snapshot for each of the last N months
+}
+
+// empty reports whether the policy keeps no snapshots at all.
+func (p RetentionPolicy) empty() bool {
+	return p.Last <= 0 && p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0
+}
+
+// RetentionResult summarizes the outcome of a retention run.
+type RetentionResult struct {
+	Kept       []string // kept snapshots relative to the snapshot directory
+	Removed    []string // removed (or, on a dry-run, removable) snapshots
+	Bytes      int64    // size of the removed snapshots
+	FreedBytes int64    // bytes actually freed, files still linked from elsewhere are not counted
+	DryRun     bool
+}
+
+// snapshotDir is a snapshot of a repository found by listSnapshots.
+type snapshotDir struct {
+	name    string
+	path    string
+	created time.Time
+	pinned  bool
+}
+
+// ApplyRetention removes the snapshots in dir (a snapshot destination of a repository with the
+// timestamped snapshots YYYYMMDD) which are not kept by policy. Pinned snapshots, snapshots
+// referenced by a symlink below aliasRoot, e.g. a promotion channel, and the snapshots a channel
+// below aliasRoot can be rolled back to are never removed. With dryRun set, nothing is deleted and
+// the removable snapshots are only reported.
+func ApplyRetention(dir string, policy RetentionPolicy, aliasRoot string, dryRun bool) (*RetentionResult, error) {
+	if policy.empty() {
+		return nil, errors.New("no retention policy, refusing to remove all snapshots")
+	}
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+	referenced, err := aliasedSnapshots(aliasRoot, snapshots)
+	if err != nil {
+		return nil, err
+	}
+	keep := policy.keep(snapshots)
+	res := &RetentionResult{DryRun: dryRun}
+	removed := []snapshotDir{}
+	for _, s := range snapshots {
+		reason, ok := keep[s.name]
+		if s.pinned {
+			reason, ok = "pinned", true
+		}
+		if r, found := referenced[s.path]; found {
+			reason, ok = r, true
+		}
+		if ok {
+			Log.Debug(s.name, "status", "kept", "reason", reason)
+			res.Kept = append(res.Kept, s.name)
+			continue
+		}
+		removed = append(removed, s)
+		res.Removed = append(res.Removed, s.name)
+	}
+	res.Bytes, res.FreedBytes, err = snapshotsSize(removed)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range removed {
+		status := "removable"
+		if !dryRun {
+			if err := os.RemoveAll(s.path); err != nil {
+				return res, err
+			}
+			status = "removed"
+		}
+		Log.Info(s.name, "status", status, "created", s.created.Format("2006-01-02 15:04:05"))
+	}
+	Log.Info("finished retention", "dir", dir, "keptSnapshots", len(res.Kept), "removedSnapshots", len(res.Removed), "bytes", res.Bytes, "freedBytes", res.FreedBytes, "dryRun", dryRun)
+	return res, nil
+}
+
+// keep returns the names of the snapshots kept by the policy together with the reason,
+// snapshots must be ordered newest first.
+func (p RetentionPolicy) keep(snapshots []snapshotDir) map[string]string {
+	keep := map[string]string{}
+	for i := 0; i < p.Last && i < len(snapshots); i++ {
+		keep[snapshots[i].name] = "last"
+	}
+	buckets := []struct {
+		reason string
+		n      int
+		key    func(time.Time) string
+	}{
+		{"daily", p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{"monthly", p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, b := range buckets {
+		seen := map[string]bool{}
+		for _, s := range snapshots {
+			if len(seen) >= b.n {
+				break
+			}
+			key := b.key(s.created)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if _, ok := keep[s.name]; !ok {
+				keep[s.name] = b.reason
+			}
+		}
+	}
+	return keep
+}
+
+// listSnapshots returns the snapshots in dir ordered newest first. The creation time is taken from
+// the snapshot info or from the timestamp in the directory name.
+func listSnapshots(dir string) ([]snapshotDir, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []snapshotDir{}
+	for _, e := range entries {
+		p := path.Join(dir, e.Name())
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if _, err := os.Stat(path.Join(p, "repodata/repomd.xml")); err != nil {
+			continue
+		}
+		s := snapshotDir{name: e.Name(), path: p}
+		if info, err := readSnapshotInfo(p); err == nil {
+			s.created = info.Created
+			s.pinned = info.Pinned
+		} else if s.created, err = time.ParseInLocation("20060102", e.Name(), time.Local); err != nil {
+			Log.Debug("skipping directory without timestamp", "dir", p)
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		if snapshots[i].created.Equal(snapshots[j].created) {
+			return snapshots[i].name > snapshots[j].name
+		}
+		return snapshots[i].created.After(snapshots[j].created)
+	})
+	return snapshots, nil
+}
+
+// rollbackDepth is the number of snapshots on top of the promotion stack of a channel which are
+// kept by retention, the current one and the rollback target.
+const rollbackDepth = 2
+
+// aliasedSnapshots returns the paths of the snapshots referenced by a symlink below root and of
+// the snapshots a channel below root can be rolled back to, together with the reason to keep them.
+// The symlinks within the snapshots are ignored.
+func aliasedSnapshots(root string, snapshots []snapshotDir) (map[string]string, error) {
+	referenced := map[string]string{}
+	if len(root) == 0 {
+		return referenced, nil
+	}
+	own := map[string]bool{}
+	for _, s := range snapshots {
+		own[s.path] = true
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && own[p] {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), ".history.json") && path.Base(path.Dir(p)) == ".gym" {
+			return rollbackSnapshots(p, snapshots, referenced)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			// dangling symlinks reference nothing
+			return nil
+		}
+		for _, s := range snapshots {
+			if target == s.path || strings.HasPrefix(target, s.path+"/") {
+				referenced[s.path] = "aliased"
+			}
+		}
+		return nil
+	})
+	return referenced, err
+}
+
+// rollbackSnapshots adds the snapshots on top of the promotion stack of the history file to
+// referenced, a history file is <root>/<channel>/.gym/<repo>.history.json.
+func rollbackSnapshots(historyFile string, snapshots []snapshotDir, referenced map[string]string) error {
+	channelDir := path.Dir(path.Dir(historyFile))
+	history, err := PromotionHistory(path.Dir(channelDir), path.Base(channelDir), strings.TrimSuffix(path.Base(historyFile), ".history.json"))
+	if err != nil {
+		return err
+	}
+	stack := promoted(history)
+	for i := len(stack) - 1; i >= 0 && i >= len(stack)-rollbackDepth; i-- {
+		target, err := filepath.EvalSymlinks(path.Join(path.Dir(channelDir), stack[i]))
+		if err != nil {
+			// removed snapshots reference nothing
+			continue
+		}
+		for _, s := range snapshots {
+			if target == s.path {
+				if _, ok := referenced[s.path]; !ok {
+					referenced[s.path] = "promoted"
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// snapshotsSize returns the size of all files of the snapshots and the bytes freed by removing
+// them. A file with hardlinks outside of the snapshots, e.g. in the repository or a blob store,
+// does not free any space.
+func snapshotsSize(snapshots []snapshotDir) (int64, int64, error) {
+	type inode struct {
+		dev, ino uint64
+	}
+	links := map[inode]uint64{}
+	var size, freed int64
+	for _, s := range snapshots {
+		err := filepath.Walk(s.path, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			size = size + info.Size()
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok || stat.Nlink <= 1 {
+				freed = freed + info.Size()
+				return nil
+			}
+			i := inode{uint64(stat.Dev), uint64(stat.Ino)}
+			links[i]++
+			// the space is freed when the last link is removed
+			if links[i] == uint64(stat.Nlink) {
+				freed = freed + info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return size, freed, nil
+}
+
+// PinSnapshot pins or unpins the snapshot in dir, pinned snapshots are never removed by
+// ApplyRetention.
+func PinSnapshot(dir string, pinned bool) error {
+	if _, err := os.Stat(path.Join(dir, "repodata/repomd.xml")); err != nil {
+		return fmt.Errorf("%s is not a valid snapshot, repomd.xml does not exist", dir)
+	}
+	info, err := readSnapshotInfo(dir)
+	if os.IsNotExist(err) {
+		// snapshots created by older versions have no snapshot info
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		info = snapshotInfo{Name: path.Base(path.Dir(dir)), Created: fi.ModTime()}
+		if created, err := time.ParseInLocation("20060102", path.Base(dir), time.Local); err == nil {
+			info.Created = created
+		}
+	} else if err != nil {
+		return err
+	}
+	info.Pinned = pinned
+	return writeSnapshotInfo(dir, info)
+}
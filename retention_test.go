@@ -0,0 +1,77 @@
+package gym
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestApplyRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshots := path.Join(dir, "repo")
+	sizes := map[string]int{"20261016": 100, "20261015": 10, "20261001": 0, "20260915": 10, "20260908": 50, "20260902": 10, "20260901": 10}
+	for name, size := range sizes {
+		snapshot := path.Join(snapshots, name)
+		if err := os.MkdirAll(path.Join(snapshot, "repodata"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(path.Join(snapshot, "Packages"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(snapshot, "repodata/repomd.xml"), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if size > 0 {
+			if err := ioutil.WriteFile(path.Join(snapshot, "Packages/a.rpm"), bytes.Repeat([]byte("a"), size), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the rpm of 20261001 is shared with 20261016, removing it frees no space
+	if err := os.Link(path.Join(snapshots, "20261016/Packages/a.rpm"), path.Join(snapshots, "20261001/Packages/a.rpm")); err != nil {
+		t.Fatal(err)
+	}
+	if err := PinSnapshot(path.Join(snapshots, "20260901"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(dir, "prod"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../repo/20260902", path.Join(dir, "prod/repo")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ApplyRetention(snapshots, RetentionPolicy{}, dir, true); err == nil {
+		t.Error("expected error for empty retention policy")
+	}
+	policy := RetentionPolicy{Last: 1, Daily: 2, Monthly: 2}
+	for _, dryRun := range []bool{true, false} {
+		res, err := ApplyRetention(snapshots, policy, dir, dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(res.Kept, " ") != "20261016 20261015 20260915 20260902 20260901" {
+			t.Errorf("dry-run %t: unexpected kept snapshots %v", dryRun, res.Kept)
+		}
+		if strings.Join(res.Removed, " ") != "20261001 20260908" {
+			t.Errorf("dry-run %t: unexpected removed snapshots %v", dryRun, res.Removed)
+		}
+		if res.Bytes != 152 || res.FreedBytes != 52 {
+			t.Errorf("dry-run %t: expected 152 bytes and 52 freed bytes, got %d and %d", dryRun, res.Bytes, res.FreedBytes)
+		}
+		_, err = os.Stat(path.Join(snapshots, "20260908"))
+		if dryRun && err != nil || !dryRun && !os.IsNotExist(err) {
+			t.Errorf("dry-run %t: unexpected state of removed snapshot: %v", dryRun, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(snapshots, "20261016/Packages/a.rpm")); err != nil {
+		t.Error("rpm of kept snapshot has been removed")
+	}
+}
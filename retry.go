@@ -0,0 +1,140 @@
+package gym
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// Network error classes which can be used in RetryPolicy.NetErrors.
+const (
+	NetErrTimeout = "timeout"
+	NetErrReset   = "reset"
+	NetErrRefused = "refused"
+	NetErrEOF     = "eof"
+	NetErrDNS     = "dns"
+)
+
+// RetryPolicy configures how failed downloads are retried. The delay between two
+// attempts starts with BaseDelay and is doubled for every further retry up to MaxDelay.
+type RetryPolicy struct {
+	Attempts    int           // maximum number of attempts, values smaller than 1 mean one attempt
+	BaseDelay   time.Duration // delay before the first retry
+	MaxDelay    time.Duration // upper bound for the delay between two attempts
+	Jitter      float64       // fraction (0-1) of the delay that is randomly added or subtracted
+	StatusCodes []int         // http status codes that are retried
+	NetErrors   []string      // network error classes that are retried, see NetErr constants
+}
+
+// DefaultRetryPolicy returns the retry policy used by NewRepo.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:    3,
+		BaseDelay:   time.Second,
+		MaxDelay:    30 * time.Second,
+		Jitter:      0.2,
+		StatusCodes: []int{408, 429, 500, 502, 503, 504},
+		NetErrors:   []string{NetErrTimeout, NetErrReset, NetErrRefused, NetErrEOF},
+	}
+}
+
+// retryable reports whether err is a transient error according to the policy.
+func (p RetryPolicy) retryable(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		for _, code := range p.StatusCodes {
+			if code == statusErr.code {
+				return true
+			}
+		}
+		return false
+	}
+	class := netErrorClass(err)
+	if len(class) == 0 {
+		return false
+	}
+	for _, c := range p.NetErrors {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the time to wait before the given retry (starting with 1).
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d = d * 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d = d + time.Duration(float64(d)*p.Jitter*(rand.Float64()*2-1))
+	}
+	return d
+}
+
+// retry calls fn until it succeeds, returns a non transient error or the maximum
+// number of attempts is reached. It returns the number of retries done.
+func (p RetryPolicy) retry(name string, fn func() error) (int, error) {
+	retries := 0
+	for {
+		err := fn()
+		if err == nil || retries+1 >= p.Attempts || !p.retryable(err) {
+			return retries, err
+		}
+		retries++
+		d := p.delay(retries)
+		Log.Warn("retry download", "name", name, "retry", retries, "delay", d, "err", err)
+		time.Sleep(d)
+	}
+}
+
+// errChecksumMismatch is returned if a downloaded file does not match its checksum.
+var errChecksumMismatch = errors.New("checksum missmatch")
+
+// mirrorFailover reports whether err justifies switching to the next mirror.
+func mirrorFailover(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code == http.StatusNotFound || statusErr.code >= 500
+	}
+	return err == errChecksumMismatch || len(netErrorClass(err)) > 0
+}
+
+// httpStatusError is returned if a server answers with an unexpected status code.
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("http status: %s", e.status)
+}
+
+// netErrorClass maps network errors to one of the NetErr classes, for other
+// errors an empty string is returned.
+func netErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return NetErrEOF
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return NetErrReset
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return NetErrRefused
+	case errors.As(err, &dnsErr):
+		return NetErrDNS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return NetErrTimeout
+	}
+	return ""
+}
@@ -1,10 +1,14 @@
 package gym
 
+import "strings"
+
 type rpm struct {
 	relPath      string
 	checksumType string
 	checksum     string
+	arch         string
 	size         int
+	pkg          *pkgMeta // package metadata if the rpm was selected from the primary metadata
 	downloadID   int
 }
 
@@ -16,3 +20,89 @@ func newRPM(relPath string, checksum string, checksumType string, size int) *rpm
 		size:         size,
 	}
 }
+
+// rpmFilter selects the rpms to sync by filter expressions and by architecture.
+type rpmFilter struct {
+	include       []filterExpr // a package must match one of these if not empty
+	exclude       []filterExpr // a package must not match any of these
+	arches        []string     // only these architectures if not empty
+	excludeArches []string
+}
+
+// where returns the sql where clause with its arguments for the packages table, it is empty
+// if all packages match. Conditions without sql equivalent are left out, the clause may
+// select more packages than match, but never less.
+func (f rpmFilter) where() (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	exprList := func(exprs []filterExpr) string {
+		list := []string{}
+		for _, e := range exprs {
+			condition, a, _ := e.sql()
+			list = append(list, condition)
+			args = append(args, a...)
+		}
+		return "(" + strings.Join(list, " or ") + ")"
+	}
+	archList := func(arches []string) string {
+		for _, a := range arches {
+			args = append(args, a)
+		}
+		return "(" + strings.TrimSuffix(strings.Repeat("?, ", len(arches)), ", ") + ")"
+	}
+	if len(f.include) > 0 {
+		conditions = append(conditions, exprList(f.include))
+	}
+	// an exclude expression can only be left out, a condition selecting more packages than
+	// the expression would exclude too much
+	exclude := []filterExpr{}
+	for _, e := range f.exclude {
+		if _, _, exact := e.sql(); exact {
+			exclude = append(exclude, e)
+		}
+	}
+	if len(exclude) > 0 {
+		conditions = append(conditions, "not "+exprList(exclude))
+	}
+	if len(f.arches) > 0 {
+		conditions = append(conditions, "arch in "+archList(f.arches))
+	}
+	if len(f.excludeArches) > 0 {
+		conditions = append(conditions, "arch not in "+archList(f.excludeArches))
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " where " + strings.Join(conditions, " and "), args
+}
+
+// match reports whether the package p matches the filter, the packages selected by where have
+// to be checked with match.
+func (f rpmFilter) match(p *pkgMeta) bool {
+	if len(f.arches) > 0 && !containsString(f.arches, p.Arch) || containsString(f.excludeArches, p.Arch) {
+		return false
+	}
+	for _, e := range f.exclude {
+		if e.match(p) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, e := range f.include {
+		if e.match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package gym
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRPMFilterWhere(t *testing.T) {
+	include, err := parseFilters([]string{"zsh", "size>1k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclude, err := parseFilters([]string{"arch=i?86"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := rpmFilter{include: include, exclude: exclude, arches: []string{"x86_64", "noarch"}, excludeArches: []string{"src"}}
+	where, args := f.where()
+	expected := " where ((coalesce(location_href, '') glob ?) or (size_package > ?)) and not ((coalesce(arch, '') glob ?)) and arch in (?, ?) and arch not in (?)"
+	if where != expected {
+		t.Errorf("expected %q, got %q", expected, where)
+	}
+	if len(args) != 6 || args[0] != "*zsh*" || args[1] != int64(1024) || args[5] != "src" {
+		t.Errorf("unexpected arguments %v", args)
+	}
+	if where, args := (rpmFilter{}).where(); len(where) != 0 || len(args) != 0 {
+		t.Errorf("expected empty where clause, got %q %v", where, args)
+	}
+	zsh := &pkgMeta{Name: "zsh", Arch: "x86_64", Location: pkgLocation{Href: "Packages/zsh-5.0.2-34.el7.x86_64.rpm"}}
+	if !f.match(zsh) {
+		t.Error("expected zsh.x86_64 to match")
+	}
+	for _, p := range []*pkgMeta{{Name: "zsh", Arch: "i686"}, {Name: "bash", Arch: "x86_64"}} {
+		if f.match(p) {
+			t.Errorf("expected %s.%s not to match", p.Name, p.Arch)
+		}
+	}
+}
+
+func TestRPMListArches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, arch := range []string{"x86_64", "i686", "noarch", "src"} {
+		testNamedRPM(t, dir, "foo", "1.0", "1", arch)
+	}
+	if err := CreateRepo(dir, DefaultRepodataOptions()); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepo(dir, nil, nil, 0)
+	r.ExcludeArches = []string{"i686"}
+	metaFiles, err := r.lsMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Packages/foo-1.0-1.noarch.rpm Packages/foo-1.0-1.src.rpm Packages/foo-1.0-1.x86_64.rpm"
+	for _, fileType := range []string{"primary_db", "primary"} {
+		primary, ok := metaFiles.get(fileType)
+		if !ok {
+			t.Fatalf("%s not found", fileType)
+		}
+		f, err := r.rpmFilter("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileType == "primary_db" {
+			err = r.rpmListFromSqlite(f, primary)
+		} else {
+			err = r.rpmListFromXML(f, primary)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for rpm := range r.rpmc {
+			got = append(got, rpm.relPath)
+		}
+		if err := <-r.errorc; err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if r.total != 3 || strings.Join(got, " ") != expected {
+			t.Errorf("%s: expected %s, got %d rpms: %v", fileType, expected, r.total, got)
+		}
+	}
+
+	r.Arches = []string{"x86_64", "noarch"}
+	if err := r.rpmList(""); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for rpm := range r.rpmc {
+		got = append(got, rpm.relPath)
+	}
+	sort.Strings(got)
+	if r.total != 2 || strings.Join(got, " ") != "Packages/foo-1.0-1.noarch.rpm Packages/foo-1.0-1.x86_64.rpm" {
+		t.Errorf("expected noarch and x86_64 rpms, got %d rpms: %v", r.total, got)
+	}
+}
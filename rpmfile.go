@@ -0,0 +1,319 @@
+package gym
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// rpm header entry types
+const (
+	rpmTypeNull = iota
+	rpmTypeChar
+	rpmTypeInt8
+	rpmTypeInt16
+	rpmTypeInt32
+	rpmTypeInt64
+	rpmTypeString
+	rpmTypeBin
+	rpmTypeStringArray
+	rpmTypeI18NString
+)
+
+// signature header tags
+const (
+	sigTagDSA    = 267 // DSA signature of the header
+	sigTagRSA    = 268 // RSA signature of the header
+	sigTagSHA1   = 269
+	sigTagSHA256 = 273
+	sigTagSize   = 1000
+	sigTagPGP    = 1002 // RSA signature of header and payload
+	sigTagMD5    = 1004
+	sigTagGPG    = 1005 // DSA signature of header and payload
+)
+
+// signature header tags used for repodata
+const (
+	sigTagPayloadSize = 1007
+)
+
+// header tags
+const (
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagEpoch             = 1003
+	rpmTagSummary           = 1004
+	rpmTagDescription       = 1005
+	rpmTagBuildTime         = 1006
+	rpmTagBuildHost         = 1007
+	rpmTagSize              = 1009
+	rpmTagVendor            = 1011
+	rpmTagLicense           = 1014
+	rpmTagPackager          = 1015
+	rpmTagGroup             = 1016
+	rpmTagURL               = 1020
+	rpmTagArch              = 1022
+	rpmTagOldFilenames      = 1027
+	rpmTagFileModes         = 1030
+	rpmTagFileFlags         = 1037
+	rpmTagSourceRPM         = 1044
+	rpmTagArchiveSize       = 1046
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagConflictFlags     = 1053
+	rpmTagConflictName      = 1054
+	rpmTagConflictVersion   = 1055
+	rpmTagChangelogTime     = 1080
+	rpmTagChangelogName     = 1081
+	rpmTagChangelogText     = 1082
+	rpmTagObsoleteName      = 1090
+	rpmTagSourcePackage     = 1106
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagObsoleteFlags     = 1114
+	rpmTagObsoleteVersion   = 1115
+	rpmTagDirIndexes        = 1116
+	rpmTagBasenames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagLongSize          = 5009
+	rpmTagRecommendName     = 5046
+	rpmTagRecommendVersion  = 5047
+	rpmTagRecommendFlags    = 5048
+	rpmTagSuggestName       = 5049
+	rpmTagSuggestVersion    = 5050
+	rpmTagSuggestFlags      = 5051
+	rpmTagSupplementName    = 5052
+	rpmTagSupplementVersion = 5053
+	rpmTagSupplementFlags   = 5054
+	rpmTagEnhanceName       = 5055
+	rpmTagEnhanceVersion    = 5056
+	rpmTagEnhanceFlags      = 5057
+	rpmTagPayloadDigest     = 5092
+	rpmTagPayloadDigestAlgo = 5093
+)
+
+// dependency and file flags
+const (
+	rpmSenseLess       = 2
+	rpmSenseGreater    = 4
+	rpmSenseEqual      = 8
+	rpmSensePrereq     = 64
+	rpmSenseScriptPre  = 512
+	rpmSenseScriptPost = 1024
+	rpmFileGhost       = 64
+)
+
+var (
+	rpmLeadMagic   = []byte{0xed, 0xab, 0xee, 0xdb}
+	rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8}
+)
+
+const rpmLeadSize = 96
+
+// rpmFile holds the signature and main header of an rpm file. headerStart and headerEnd
+// are the offsets of the main header in the file, the payload starts at headerEnd.
+type rpmFile struct {
+	signature   *rpmHeader
+	header      *rpmHeader
+	headerStart int64
+	headerEnd   int64
+}
+
+// rpmHeader is a parsed rpm header structure.
+type rpmHeader struct {
+	entries map[int]rpmHeaderEntry
+	store   []byte
+}
+
+type rpmHeaderEntry struct {
+	Tag    int32
+	Type   int32
+	Offset int32
+	Count  int32
+}
+
+// readRPMFile reads the lead, the signature header and the main header of an rpm.
+func readRPMFile(r io.Reader) (*rpmFile, error) {
+	lead := make([]byte, rpmLeadSize)
+	if _, err := io.ReadFull(r, lead); err != nil {
+		return nil, fmt.Errorf("could not read rpm lead: %s", err)
+	}
+	if !bytes.Equal(lead[:4], rpmLeadMagic) {
+		return nil, errors.New("not an rpm file")
+	}
+	sig, sigSize, err := readRPMHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signature header: %s", err)
+	}
+	// the signature header is padded to a multiple of 8 bytes
+	padding := (8 - sigSize%8) % 8
+	if _, err := io.CopyN(io.Discard, r, padding); err != nil {
+		return nil, err
+	}
+	header, headerSize, err := readRPMHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read header: %s", err)
+	}
+	start := rpmLeadSize + sigSize + padding
+	return &rpmFile{
+		signature:   sig,
+		header:      header,
+		headerStart: start,
+		headerEnd:   start + headerSize,
+	}, nil
+}
+
+// readRPMHeader reads a header structure and returns it together with its size in bytes.
+func readRPMHeader(r io.Reader) (*rpmHeader, int64, error) {
+	intro := make([]byte, 16)
+	if _, err := io.ReadFull(r, intro); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(intro[:3], rpmHeaderMagic) {
+		return nil, 0, errors.New("invalid header magic")
+	}
+	count := binary.BigEndian.Uint32(intro[8:12])
+	size := binary.BigEndian.Uint32(intro[12:16])
+	if count > 0xffff || size > 256<<20 {
+		return nil, 0, fmt.Errorf("header too big: %d entries, %d bytes", count, size)
+	}
+	index := make([]rpmHeaderEntry, count)
+	if err := binary.Read(r, binary.BigEndian, index); err != nil {
+		return nil, 0, err
+	}
+	h := &rpmHeader{
+		entries: make(map[int]rpmHeaderEntry, count),
+		store:   make([]byte, size),
+	}
+	if _, err := io.ReadFull(r, h.store); err != nil {
+		return nil, 0, err
+	}
+	for _, e := range index {
+		if e.Offset < 0 || int(e.Offset) > len(h.store) {
+			return nil, 0, fmt.Errorf("invalid offset %d for tag %d", e.Offset, e.Tag)
+		}
+		// the values of every entry have to fit into the store, strings need at least one byte
+		if e.Count < 0 || int64(e.Offset)+int64(e.Count)*rpmTypeSize(e.Type) > int64(len(h.store)) {
+			return nil, 0, fmt.Errorf("invalid count %d for tag %d", e.Count, e.Tag)
+		}
+		h.entries[int(e.Tag)] = e
+	}
+	return h, 16 + int64(count)*16 + int64(size), nil
+}
+
+// rpmTypeSize returns the minimal size in bytes of a value of an entry type.
+func rpmTypeSize(typ int32) int64 {
+	switch typ {
+	case rpmTypeChar, rpmTypeInt8, rpmTypeString, rpmTypeBin, rpmTypeStringArray, rpmTypeI18NString:
+		return 1
+	case rpmTypeInt16:
+		return 2
+	case rpmTypeInt32:
+		return 4
+	case rpmTypeInt64:
+		return 8
+	}
+	return 0
+}
+
+// has reports whether the header contains tag.
+func (h *rpmHeader) has(tag int) bool {
+	_, ok := h.entries[tag]
+	return ok
+}
+
+// bytes returns the raw data of a BIN entry.
+func (h *rpmHeader) bytes(tag int) []byte {
+	e, ok := h.entries[tag]
+	if !ok || e.Type != rpmTypeBin || e.Count < 0 || int64(e.Offset)+int64(e.Count) > int64(len(h.store)) {
+		return nil
+	}
+	return h.store[e.Offset : e.Offset+e.Count]
+}
+
+// strings returns the values of a STRING, STRING_ARRAY or I18NSTRING entry. For
+// I18NSTRING entries all translations are returned, the first one is the default.
+func (h *rpmHeader) strings(tag int) []string {
+	e, ok := h.entries[tag]
+	if !ok {
+		return nil
+	}
+	switch e.Type {
+	case rpmTypeString, rpmTypeStringArray, rpmTypeI18NString:
+	default:
+		return nil
+	}
+	values := []string{}
+	data := h.store[e.Offset:]
+	for i := 0; i < int(e.Count); i++ {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			break
+		}
+		values = append(values, string(data[:end]))
+		data = data[end+1:]
+	}
+	return values
+}
+
+// string returns the first value of a string entry.
+func (h *rpmHeader) string(tag int) string {
+	values := h.strings(tag)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// ints returns the values of an integer entry.
+func (h *rpmHeader) ints(tag int) []int64 {
+	e, ok := h.entries[tag]
+	if !ok {
+		return nil
+	}
+	size := 0
+	switch e.Type {
+	case rpmTypeChar, rpmTypeInt8:
+		size = 1
+	case rpmTypeInt16:
+		size = 2
+	case rpmTypeInt32:
+		size = 4
+	case rpmTypeInt64:
+		size = 8
+	default:
+		return nil
+	}
+	if e.Count < 0 || int64(e.Offset)+int64(e.Count)*int64(size) > int64(len(h.store)) {
+		return nil
+	}
+	values := make([]int64, e.Count)
+	data := h.store[e.Offset:]
+	for i := range values {
+		switch size {
+		case 1:
+			values[i] = int64(data[i])
+		case 2:
+			values[i] = int64(binary.BigEndian.Uint16(data[i*2:]))
+		case 4:
+			values[i] = int64(binary.BigEndian.Uint32(data[i*4:]))
+		case 8:
+			values[i] = int64(binary.BigEndian.Uint64(data[i*8:]))
+		}
+	}
+	return values
+}
+
+// int returns the first value of an integer entry.
+func (h *rpmHeader) int(tag int) int64 {
+	values := h.ints(tag)
+	if len(values) == 0 {
+		return 0
+	}
+	return values[0]
+}
@@ -0,0 +1,128 @@
+package gym
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Snapshot modes define how the rpms of a snapshot are created from the rpms of the repository.
+const (
+	SnapshotCopy       = "copy"       // copy the rpms
+	SnapshotSymlink    = "symlink"    // absolute symlinks to the rpms of the repository
+	SnapshotRelSymlink = "relsymlink" // relative symlinks, they stay valid in a chroot or a bind mount of a common parent
+	SnapshotHardlink   = "hardlink"   // hardlinks, rpms are copied if the snapshot is on another filesystem
+	SnapshotReflink    = "reflink"    // copy on write clones (btrfs, xfs), rpms are copied if cloning is not supported
+)
+
+// snapshotInfoFile is the file in a snapshot describing how it was created.
+const snapshotInfoFile = ".gym/snapshot.json"
+
+var errReflinkNotSupported = errors.New("reflinks are not supported on this platform")
+
+// snapshotInfo describes a snapshot, it is stored as json in snapshotInfoFile.
+type snapshotInfo struct {
+	Name     string    `json:"name"`
+	Source   string    `json:"source"`
+	Created  time.Time `json:"created"`
+	Mode     string    `json:"mode"`
+	Packages int       `json:"packages"`
+	Copied   int       `json:"copied"`           // rpms copied because the mode was not possible
+	Pinned   bool      `json:"pinned,omitempty"` // pinned snapshots are never removed by ApplyRetention
+}
+
+// validSnapshotMode reports whether mode is one of the snapshot modes.
+func validSnapshotMode(mode string) bool {
+	switch mode {
+	case SnapshotCopy, SnapshotSymlink, SnapshotRelSymlink, SnapshotHardlink, SnapshotReflink:
+		return true
+	}
+	return false
+}
+
+// writeSnapshotInfo writes info to the snapshot in dir.
+func writeSnapshotInfo(dir string, info snapshotInfo) error {
+	file := path.Join(dir, snapshotInfoFile)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(data, '\n'), 0644)
+}
+
+// readSnapshotInfo reads the description of the snapshot in dir.
+func readSnapshotInfo(dir string) (snapshotInfo, error) {
+	info := snapshotInfo{}
+	data, err := ioutil.ReadFile(path.Join(dir, snapshotInfoFile))
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("invalid snapshot info in %s: %s", dir, err)
+	}
+	return info, nil
+}
+
+// linkRPM creates dest from source according to mode, it returns the mode actually used. Hardlinks
+// and reflinks fall back to a copy if the filesystem does not support them.
+func linkRPM(source, dest, mode string) (string, error) {
+	switch mode {
+	case SnapshotSymlink, SnapshotRelSymlink:
+		target, err := filepath.Abs(source)
+		if err != nil {
+			return mode, err
+		}
+		if mode == SnapshotRelSymlink {
+			destAbs, err := filepath.Abs(dest)
+			if err != nil {
+				return mode, err
+			}
+			if target, err = filepath.Rel(filepath.Dir(destAbs), target); err != nil {
+				return mode, err
+			}
+		}
+		return mode, os.Symlink(target, dest)
+	case SnapshotHardlink, SnapshotReflink:
+		// link the rpm itself if the repository is a snapshot with symlinks
+		resolved, err := filepath.EvalSymlinks(source)
+		if err != nil {
+			return mode, err
+		}
+		if mode == SnapshotHardlink {
+			err = os.Link(resolved, dest)
+		} else {
+			err = reflink(resolved, dest)
+		}
+		if err == nil || !linkNotSupported(err) {
+			return mode, err
+		}
+		Log.Debug("falling back to copy", "source", source, "mode", mode, "err", err)
+	}
+	return SnapshotCopy, copyFile(source, dest)
+}
+
+// linkNotSupported reports whether err means that a link cannot be created between the files,
+// e.g. because they are on different filesystems.
+func linkNotSupported(err error) bool {
+	if err == errReflinkNotSupported {
+		return true
+	}
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.EXDEV, syscall.EPERM, syscall.EMLINK, syscall.EOPNOTSUPP, syscall.EINVAL, syscall.ENOTTY, syscall.ENOSYS:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package gym
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSnapshotModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := path.Join(dir, "source")
+	testNamedRPM(t, source, "foo", "1.0", "1", "x86_64")
+	if err := CreateRepo(source, DefaultRepodataOptions()); err != nil {
+		t.Fatal(err)
+	}
+	rpm := "Packages/foo-1.0-1.x86_64.rpm"
+	sourceInfo, err := os.Stat(path.Join(source, rpm))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{SnapshotCopy, SnapshotSymlink, SnapshotRelSymlink, SnapshotHardlink, SnapshotReflink} {
+		dest := path.Join(dir, "snapshots", mode)
+		r := NewRepo(source, nil, nil, 0)
+		if err := r.Snapshot(dest, false, mode, false, 1); err != nil {
+			t.Fatalf("%s: %s", mode, err)
+		}
+		snapshot := path.Join(dest, "source")
+		file := path.Join(snapshot, rpm)
+		li, err := os.Lstat(file)
+		if err != nil {
+			t.Fatalf("%s: %s", mode, err)
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatalf("%s: %s", mode, err)
+		}
+		isLink := li.Mode()&os.ModeSymlink != 0
+		target, _ := os.Readlink(file)
+		switch mode {
+		case SnapshotCopy, SnapshotReflink:
+			if isLink || os.SameFile(fi, sourceInfo) || fi.Size() != sourceInfo.Size() {
+				t.Errorf("%s: expected an independent copy of the rpm", mode)
+			}
+		case SnapshotSymlink:
+			if !isLink || !filepath.IsAbs(target) {
+				t.Errorf("%s: expected an absolute symlink, got %s", mode, target)
+			}
+		case SnapshotRelSymlink:
+			if !isLink || filepath.IsAbs(target) || !os.SameFile(fi, sourceInfo) {
+				t.Errorf("%s: expected a relative symlink to the rpm, got %s", mode, target)
+			}
+		case SnapshotHardlink:
+			if isLink || !os.SameFile(fi, sourceInfo) {
+				t.Errorf("%s: expected a hardlink to the rpm", mode)
+			}
+		}
+		info, err := readSnapshotInfo(snapshot)
+		if err != nil {
+			t.Fatalf("%s: %s", mode, err)
+		}
+		if info.Mode != mode || info.Name != "source" || info.Packages != 1 || info.Created.IsZero() {
+			t.Errorf("%s: unexpected snapshot info %+v", mode, info)
+		}
+	}
+
+	// relative symlinks stay valid if the common parent is moved, e.g. into a chroot
+	moved := path.Join(dir, "moved")
+	if err := os.Mkdir(moved, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"source", "snapshots"} {
+		if err := os.Rename(path.Join(dir, name), path.Join(moved, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path.Join(moved, "snapshots", SnapshotRelSymlink, "source", rpm)); err != nil {
+		t.Errorf("relative symlink broken after move: %s", err)
+	}
+
+	r := NewRepo(path.Join(moved, "source"), nil, nil, 0)
+	if err := r.Snapshot(path.Join(dir, "invalid"), false, "move", false, 1); err == nil {
+		t.Error("expected error for invalid snapshot mode")
+	}
+	if !linkNotSupported(&os.LinkError{Op: "link", Err: syscall.EXDEV}) || linkNotSupported(&os.LinkError{Op: "link", Err: syscall.ENOENT}) {
+		t.Error("hardlinks across filesystems must fall back to copy, other errors not")
+	}
+}
@@ -0,0 +1,133 @@
+package gym
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Store is a content addressed blob store shared by repositories. The rpms are stored as
+// <Dir>/<checksum type>/<first two characters of checksum>/<checksum> and are hardlinked into
+// the repository trees, the store must therefore be on the same filesystem as the repositories.
+// A blob is referenced as long as it has more than one link.
+type Store struct {
+	Dir string
+}
+
+// NewStore creates a store in dir.
+func NewStore(dir string) *Store {
+	return &Store{Dir: strings.TrimRight(dir, "/")}
+}
+
+// blobPath returns the path of the blob with checksum.
+func (s *Store) blobPath(checksumType string, checksum string) string {
+	checksumType = hashType(checksumType)
+	checksum = strings.ToLower(checksum)
+	prefix := checksum
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	return path.Join(s.Dir, checksumType, prefix, checksum)
+}
+
+// blob returns the path of the blob with checksum and whether it exists.
+func (s *Store) blob(checksumType string, checksum string) (string, bool) {
+	if len(checksumType) == 0 || len(checksum) == 0 {
+		return "", false
+	}
+	blob := s.blobPath(checksumType, checksum)
+	_, err := os.Stat(blob)
+	return blob, err == nil
+}
+
+// link hardlinks the blob with checksum to dest, it reports whether the blob exists. If dest
+// already is the blob, it is left unchanged.
+func (s *Store) link(checksumType string, checksum string, dest string) (bool, error) {
+	if len(checksumType) == 0 || len(checksum) == 0 {
+		return false, nil
+	}
+	blob := s.blobPath(checksumType, checksum)
+	bfi, err := os.Stat(blob)
+	if err != nil {
+		return false, nil
+	}
+	if fi, err := os.Stat(dest); err == nil && os.SameFile(fi, bfi) {
+		return true, nil
+	}
+	return true, replaceWithLink(blob, dest)
+}
+
+// add puts file into the store. If the blob already exists, file is replaced by a link to it.
+func (s *Store) add(file string, checksumType string, checksum string) error {
+	if len(checksumType) == 0 || len(checksum) == 0 {
+		return nil
+	}
+	blob := s.blobPath(checksumType, checksum)
+	if err := os.MkdirAll(path.Dir(blob), 0755); err != nil {
+		return err
+	}
+	err := os.Link(file, blob)
+	if err == nil {
+		return nil
+	}
+	if !os.IsExist(err) {
+		return fmt.Errorf("could not add %s to store: %s", path.Base(file), err)
+	}
+	_, err = s.link(checksumType, checksum, file)
+	return err
+}
+
+// replaceWithLink atomically replaces dest with a hardlink to source.
+func replaceWithLink(source string, dest string) error {
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp := dest + ".link"
+	os.Remove(tmp)
+	if err := os.Link(source, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// GC removes the blobs which are no longer linked from a repository and returns the number
+// of removed blobs and their size. With dryRun the blobs are only listed.
+func (s *Store) GC(dryRun bool) (int, int64, error) {
+	if _, err := os.Stat(s.Dir); err != nil {
+		return 0, 0, err
+	}
+	removed := 0
+	var reclaimed int64
+	err := filepath.Walk(s.Dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.New("link count of blobs is not supported on this platform")
+		}
+		if stat.Nlink > 1 {
+			return nil
+		}
+		status := "unreferenced"
+		if !dryRun {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			status = "removed"
+		}
+		Log.Debug(ellipsis(path.Base(p), 40), "status", status, "numBytes", info.Size())
+		removed++
+		reclaimed = reclaimed + info.Size()
+		return nil
+	})
+	Log.Info("finished store gc", "store", s.Dir, "removedBlobs", removed, "reclaimedBytes", reclaimed, "dryRun", dryRun)
+	return removed, reclaimed, err
+}
@@ -0,0 +1,129 @@
+package gym
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestStoreSync(t *testing.T) {
+	var requests int32
+	fs := http.FileServer(http.Dir("testdata/repo"))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fs.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(path.Join(dir, "store"))
+	rpm := "Packages/GeoIP-devel-1.5.0-9.el7.i686.rpm"
+	files := []os.FileInfo{}
+	for _, name := range []string{"first", "second"} {
+		if err := os.Mkdir(path.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := copyDir("testdata/repo/repodata", path.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt32(&requests, 0)
+		r := NewRepo(path.Join(dir, name), []string{ts.URL}, nil, time.Second)
+		r.Store = store
+		if err := r.Sync("", 1); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path.Join(dir, name, rpm))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fi)
+		if name == "second" && atomic.LoadInt32(&requests) != 0 {
+			t.Errorf("expected no requests for the rpm in the store, got %d", requests)
+		}
+	}
+	if !os.SameFile(files[0], files[1]) {
+		t.Error("rpm is not hardlinked from the store")
+	}
+
+	// a blob added without gpgcheck is not linked into a repository with gpgcheck
+	signer, err := openpgp.NewEntity("gym", "test", "gym@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "RPM-GPG-KEY-gym")
+	kf, err := os.Create(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Serialize(kf); err != nil {
+		t.Fatal(err)
+	}
+	kf.Close()
+	if err := os.Mkdir(path.Join(dir, "checked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyDir("testdata/repo/repodata", path.Join(dir, "checked")); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepo(path.Join(dir, "checked"), []string{ts.URL}, nil, time.Second)
+	r.Store = store
+	r.GPGCheck = true
+	r.GPGKeys = []string{keyFile}
+	if err := r.Sync("", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "checked", rpm)); !os.IsNotExist(err) {
+		t.Error("rpm with unknown key has been linked from the store")
+	}
+
+	if removed, _, err := store.GC(false); err != nil || removed != 0 {
+		t.Errorf("expected no unreferenced blobs, got %d (err: %v)", removed, err)
+	}
+	for _, name := range []string{"first", "second"} {
+		if err := os.Remove(path.Join(dir, name, rpm)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if removed, _, err := store.GC(true); err != nil || removed != 1 {
+		t.Errorf("dry run: expected one unreferenced blob, got %d (err: %v)", removed, err)
+	}
+	if removed, size, err := store.GC(false); err != nil || removed != 1 || size != files[0].Size() {
+		t.Errorf("expected one removed blob of %d bytes, got %d of %d bytes (err: %v)", files[0].Size(), removed, size, err)
+	}
+	if removed, _, err := store.GC(false); err != nil || removed != 0 {
+		t.Errorf("expected empty store after gc, got %d blobs (err: %v)", removed, err)
+	}
+
+	// an rpm which cannot be added to the store is kept and verified
+	if err := ioutil.WriteFile(path.Join(dir, "nostore"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(dir, "third"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyDir("testdata/repo/repodata", path.Join(dir, "third")); err != nil {
+		t.Fatal(err)
+	}
+	r = NewRepo(path.Join(dir, "third"), []string{ts.URL}, nil, time.Second)
+	r.Store = NewStore(path.Join(dir, "nostore"))
+	if err := r.Sync("", 1); err != nil {
+		t.Fatal(err)
+	}
+	if state := readSyncState(path.Join(dir, "third")); !state.Complete {
+		t.Errorf("expected complete sync, got %+v", state)
+	}
+	if _, ok := openVerifiedDB(path.Join(dir, "third")).packages[rpm]; !ok {
+		t.Error("rpm not added to the store is not recorded as verified")
+	}
+}
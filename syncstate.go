@@ -0,0 +1,108 @@
+package gym
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// syncStateFile is the file in a repository with the state of the last rpm sync.
+const syncStateFile = ".gym/sync.json"
+
+// syncState is the state of the last rpm sync of a repository. It is used to skip the sync if
+// the upstream metadata has not changed and to skip the verification of rpms synced before.
+// Filtered repodata is never reused, the rpms selected by the options may have changed.
+type syncState struct {
+	Repomd   string            `json:"repomd"`   // sha256 of the upstream repomd.xml
+	Revision string            `json:"revision"` // revision of the upstream repomd.xml
+	Options  string            `json:"options"`  // fingerprint of the options selecting the rpms
+	Complete bool              `json:"complete"` // all rpms have been synced and the repodata is up to date
+	Filtered bool              `json:"filtered"` // the repodata has been rewritten by FilterRepodata
+	Synced   time.Time         `json:"synced"`
+	Packages map[string]string `json:"packages"` // checksums of the synced rpms by relative path
+}
+
+// readSyncState reads the state of the last sync of the repository in dir. An empty state is
+// returned if there is no usable state.
+func readSyncState(dir string) *syncState {
+	state := &syncState{Packages: map[string]string{}}
+	data, err := ioutil.ReadFile(path.Join(dir, syncStateFile))
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		Log.Warn("ignoring invalid sync state", "dir", dir, "err", err)
+		return &syncState{Packages: map[string]string{}}
+	}
+	if state.Packages == nil {
+		state.Packages = map[string]string{}
+	}
+	return state
+}
+
+// writeSyncState writes the state of the sync of the repository in dir.
+func writeSyncState(dir string, state *syncState) error {
+	file := path.Join(dir, syncStateFile)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// synced reports whether the rpm has been synced before and is unchanged, i.e. it does not
+// need to be verified again.
+func (s *syncState) synced(rpm *rpm, dest string) bool {
+	if s == nil || len(rpm.checksum) == 0 || !strings.EqualFold(s.Packages[rpm.relPath], rpm.checksum) {
+		return false
+	}
+	fi, err := os.Stat(dest)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	return rpm.size <= 0 || fi.Size() == int64(rpm.size)
+}
+
+// syncOptions returns a fingerprint of the options which select the synced rpms, a sync with
+// other options has to process all rpms.
+func (r *Repo) syncOptions(filter string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q %q %q %q %q %q %q %d %q %q %+v %v %v %v", filter, r.Include, r.Exclude, r.IncludePkgs, r.ExcludePkgs,
+		r.Arches, r.ExcludeArches, r.Packages, r.KeepNewest, r.Modules, r.selectedRPMList(), r.Errata, r.GPGCheck, r.KeepUnsigned, r.FilterMeta)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// selectedRPMList returns the relative paths of the selected rpms, e.g. from ResolvePackages
+// across repositories.
+func (r *Repo) selectedRPMList() []string {
+	list := []string{}
+	for _, rpm := range r.selection {
+		list = append(list, rpm.relPath)
+	}
+	return list
+}
+
+// repomdRevision returns the revision of repomd.xml.
+func repomdRevision(pathToXML string) string {
+	data, err := ioutil.ReadFile(pathToXML)
+	if err != nil {
+		return ""
+	}
+	rm := repomd{}
+	if err := xml.Unmarshal(data, &rm); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(rm.Revision)
+}
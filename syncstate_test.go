@@ -0,0 +1,148 @@
+package gym
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIncrementalSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := path.Join(dir, "upstream")
+	testNamedRPM(t, upstream, "foo", "1.0", "1", "x86_64")
+	if err := CreateRepo(upstream, DefaultRepodataOptions()); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	requests := []string{}
+	fs := http.FileServer(http.Dir(upstream))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests = append(requests, req.URL.Path)
+		mu.Unlock()
+		fs.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	local := path.Join(dir, "local")
+	syncRepo := func(full bool) string {
+		mu.Lock()
+		requests = []string{}
+		mu.Unlock()
+		r := NewRepo(local, []string{ts.URL}, nil, time.Second)
+		r.FullSync = full
+		if err := r.SyncMeta(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Sync("", 2); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		rpms := []string{}
+		for _, p := range requests {
+			if strings.HasSuffix(p, ".rpm") {
+				rpms = append(rpms, p)
+			} else if !strings.HasPrefix(p, "/repodata/") {
+				t.Errorf("unexpected request %s", p)
+			}
+		}
+		sort.Strings(rpms)
+		return strings.Join(rpms, " ") + " " + strings.Repeat("m", len(requests)-len(rpms))
+	}
+
+	if got := syncRepo(false); !strings.HasPrefix(got, "/Packages/foo-1.0-1.x86_64.rpm m") {
+		t.Errorf("first sync: expected metadata and foo-1.0 download, got %s", got)
+	}
+	state := readSyncState(local)
+	if !state.Complete || len(state.Repomd) == 0 || state.Packages["Packages/foo-1.0-1.x86_64.rpm"] == "" {
+		t.Errorf("unexpected sync state %+v", state)
+	}
+	// only repomd.xml is requested if upstream is unchanged
+	if got := syncRepo(false); got != " m" {
+		t.Errorf("unchanged upstream: expected only repomd.xml request, got %s", got)
+	}
+
+	// an rpm modified locally is trusted until a full sync
+	rpm := path.Join(local, "Packages/foo-1.0-1.x86_64.rpm")
+	data, err := ioutil.ReadFile(rpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(rpm, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := syncRepo(true); !strings.HasPrefix(got, "/Packages/foo-1.0-1.x86_64.rpm m") {
+		t.Errorf("full sync: expected metadata and foo-1.0 download, got %s", got)
+	}
+
+	// only the new rpm is downloaded when upstream changes
+	testNamedRPM(t, upstream, "foo", "2.0", "1", "x86_64")
+	if err := CreateRepo(upstream, DefaultRepodataOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if got := syncRepo(false); !strings.HasPrefix(got, "/Packages/foo-2.0-1.x86_64.rpm m") {
+		t.Errorf("changed upstream: expected only foo-2.0 download, got %s", got)
+	}
+	if got := syncRepo(false); got != " m" {
+		t.Errorf("unchanged upstream: expected only repomd.xml request, got %s", got)
+	}
+}
+
+func TestIncrementalSyncFiltered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := path.Join(dir, "upstream")
+	testNamedRPM(t, upstream, "foo", "1.0", "1", "x86_64")
+	testNamedRPM(t, upstream, "foo", "2.0", "1", "x86_64")
+	if err := CreateRepo(upstream, DefaultRepodataOptions()); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.FileServer(http.Dir(upstream)))
+	defer ts.Close()
+
+	local := path.Join(dir, "local")
+	syncRepo := func(keep int) []string {
+		r := NewRepo(local, []string{ts.URL}, nil, time.Second)
+		r.KeepNewest = keep
+		if err := r.SyncMeta(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Sync("", 2); err != nil {
+			t.Fatal(err)
+		}
+		rpms, err := findRPMs(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rpms
+	}
+	if rpms := syncRepo(1); strings.Join(rpms, " ") != "Packages/foo-2.0-1.x86_64.rpm" {
+		t.Errorf("keep 1: expected foo-2.0, got %v", rpms)
+	}
+	if !readSyncState(local).Filtered {
+		t.Error("sync state does not record the filtered repodata")
+	}
+	// the filtered repodata is replaced by upstream although upstream is unchanged
+	if rpms := syncRepo(0); strings.Join(rpms, " ") != "Packages/foo-1.0-1.x86_64.rpm Packages/foo-2.0-1.x86_64.rpm" {
+		t.Errorf("keep all: expected foo-1.0 and foo-2.0, got %v", rpms)
+	}
+	if len(readPrimaryXML(t, local)) != 2 {
+		t.Error("primary does not list all packages")
+	}
+}
@@ -9,8 +9,10 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -20,23 +22,24 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/xi2/xz"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
 // ProcessSQLFunc is the function type called for the rows created by processSqlite.
 type processSQLFunc func(rows *sql.Rows) error
 
-// processSqlite makes a sqlite db connection and performs query on the sqlite db.
+// processSqlite makes a sqlite db connection and performs query with args on the sqlite db.
 // The resulting rows can be processed by ProcessFunc.
-func processSqlite(pathToDB string, query string, processFn processSQLFunc) error {
+func processSqlite(pathToDB string, query string, processFn processSQLFunc, args ...interface{}) error {
 	db, err := sql.Open("sqlite3", pathToDB)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return err
 	}
@@ -57,40 +60,48 @@ func processXML(pathToXML string, processFn processXMLFunc) error {
 	return processFn(xml.NewDecoder(f))
 }
 
-func countResult(pathToDB string, filter string) (int, error) {
-	db, err := sql.Open("sqlite3", pathToDB)
-	if err != nil {
-		return 0, err
-	}
-	defer db.Close()
-
-	query := "select count(*) from packages"
-	if len(filter) > 0 {
-		query = query + " where location_href like '%" + filter + "%'"
-	}
-	var count int
-	if err := db.QueryRow(query, 1).Scan(&count); err != nil {
-		return 0, err
-	}
-	return count, nil
+// sqlitePackages calls fn for the packages of the primary sqlite db at pathToDB matching filter.
+// The packages are selected with the where clause of the filter and checked with its match.
+func sqlitePackages(pathToDB string, filter rpmFilter, fn func(p *pkgMeta) error) error {
+	where, args := filter.where()
+	query := "select name, arch, coalesce(epoch, ''), coalesce(version, ''), coalesce(release, ''), " +
+		"coalesce(rpm_license, ''), coalesce(rpm_group, ''), location_href, coalesce(size_package, 0), " +
+		"coalesce(size_archive, 0), checksum_type, pkgId from packages" + where
+	return processSqlite(pathToDB, query, func(rows *sql.Rows) error {
+		for rows.Next() {
+			p := &pkgMeta{}
+			if err := rows.Scan(&p.Name, &p.Arch, &p.Version.Epoch, &p.Version.Ver, &p.Version.Rel,
+				&p.Format.License, &p.Format.Group, &p.Location.Href, &p.Size.Package,
+				&p.Size.Archive, &p.Checksum.Type, &p.Checksum.Value); err != nil {
+				return err
+			}
+			if !filter.match(p) {
+				continue
+			}
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}, args...)
 }
 
-func totalBytes(pathToDB string, filter string) (int64, error) {
-	db, err := sql.Open("sqlite3", pathToDB)
-	if err != nil {
-		return 0, err
-	}
-	defer db.Close()
+func countResult(pathToDB string, filter rpmFilter) (int, error) {
+	count := 0
+	err := sqlitePackages(pathToDB, filter, func(p *pkgMeta) error {
+		count++
+		return nil
+	})
+	return count, err
+}
 
-	query := "select sum(size_archive) from packages"
-	if len(filter) > 0 {
-		query = query + " where location_href like '%" + filter + "%'"
-	}
+func totalBytes(pathToDB string, filter rpmFilter) (int64, error) {
 	var total int64
-	if err := db.QueryRow(query, 1).Scan(&total); err != nil {
-		return 0, err
-	}
-	return total, nil
+	err := sqlitePackages(pathToDB, filter, func(p *pkgMeta) error {
+		total = total + p.Size.Archive
+		return nil
+	})
+	return total, err
 }
 
 func uncompress(pathToFile string) (*os.File, error) {
@@ -110,12 +121,19 @@ func uncompress(pathToFile string) (*os.File, error) {
 			return nil, err
 		}
 	case ".xz":
-		r, err = xz.NewReader(fh, xz.DefaultDictMax)
+		r, err = xz.NewReader(fh)
 		if err != nil {
 			return nil, err
 		}
+	case ".zst":
+		d, err := zstd.NewReader(fh)
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		r = d
 	default:
-		return nil, fmt.Errorf("%s has wrong file extension, currently supported %s", pathToFile, ".bz2, .gz, .xz")
+		return nil, fmt.Errorf("%s has wrong file extension, currently supported %s", pathToFile, ".bz2, .gz, .xz, .zst")
 	}
 
 	tmpFile, err := ioutil.TempFile("", "")
@@ -129,6 +147,47 @@ func uncompress(pathToFile string) (*os.File, error) {
 	return tmpFile, nil
 }
 
+// compressor returns a writer that compresses to w with compression gz, xz or zstd
+// and the file extension for the compression.
+func compressor(w io.Writer, compression string) (io.WriteCloser, string, error) {
+	switch compression {
+	case "gz", "":
+		return gzip.NewWriter(w), ".gz", nil
+	case "xz":
+		xw, err := xz.NewWriter(w)
+		return xw, ".xz", err
+	case "zstd":
+		zw, err := zstd.NewWriter(w)
+		return zw, ".zst", err
+	}
+	return nil, "", fmt.Errorf("unsupported compression %s, currently supported gz, xz, zstd", compression)
+}
+
+// newHash returns the hash for a repodata checksum type, sha is an alias for sha1.
+func newHash(checksumType string) (hash.Hash, error) {
+	switch checksumType {
+	case "sha1", "sha":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum type %s", checksumType)
+}
+
+// fileChecksum returns the hex encoded checksum of a file.
+func fileChecksum(pathToFile string, checksumType string) (string, error) {
+	h, err := newHash(checksumType)
+	if err != nil {
+		return "", err
+	}
+	if err := hashFile(h, pathToFile); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // ConfigureTransport configures the http client transport (ssl, proxy)
 func ConfigureTransport(insecure bool, clientCertFile string, clientKeyFile string, caCerts ...string) (*http.Transport, error) {
 	Log.Debug("configure transport",
@@ -169,25 +228,56 @@ func ConfigureTransport(insecure bool, clientCertFile string, clientKeyFile stri
 	return transport, nil
 }
 
+// checksumOK reports whether the file has the checksum, if checksumType is empty it only
+// reports whether the file is readable. The file is hashed while it is read, so memory usage
+// does not depend on the size of the file.
 func checksumOK(pathToFile string, checksumType string, checksum string) bool {
-	fh, err := ioutil.ReadFile(pathToFile)
+	f, err := os.Open(pathToFile)
 	if err != nil {
 		return false
 	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.IsDir() {
+		return false
+	}
 	if len(checksumType) == 0 {
 		return true
 	}
-	calculatedChecksum := ""
-	switch checksumType {
-	case "sha256":
-		calculatedChecksum = fmt.Sprintf("%x", sha256.Sum256(fh))
-	case "sha512":
-		calculatedChecksum = fmt.Sprintf("%x", sha512.Sum512(fh))
-	default:
+	h := checksumHash(checksumType)
+	if _, err := io.Copy(h, f); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == checksum
+}
+
+// hashFile writes the content of a file to h.
+func hashFile(h hash.Hash, pathToFile string) error {
+	f, err := os.Open(pathToFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// checksumHash returns the hash for checksumType, unknown types are treated as sha1.
+func checksumHash(checksumType string) hash.Hash {
+	h, err := newHash(checksumType)
+	if err != nil {
+		return sha1.New()
+	}
+	return h
+}
 
-		calculatedChecksum = fmt.Sprintf("%x", sha1.Sum(fh))
+// contentRangeStart returns the first byte position of a Content-Range header value
+// like 'bytes 100-999/1000'.
+func contentRangeStart(contentRange string) (int64, error) {
+	var start, end int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d", &start, &end); err != nil {
+		return 0, fmt.Errorf("invalid content range '%s': %s", contentRange, err)
 	}
-	return calculatedChecksum == checksum
+	return start, nil
 }
 
 func ellipsis(s string, max int) string {
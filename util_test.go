@@ -13,14 +13,14 @@ func TestMain(m *testing.M) {
 }
 
 func TestCountResult(t *testing.T) {
-	count, err := countResult("testdata/centos7-primary.sqlite", "")
+	count, err := countResult("testdata/centos7-primary.sqlite", rpmFilter{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	if count != 8652 {
 		t.Errorf("count should be %d, but is %d", 8652, count)
 	}
-	count, err = countResult("testdata/centos7-primary.sqlite", "zsh")
+	count, err = countResult("testdata/centos7-primary.sqlite", zshFilter(t))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -29,15 +29,24 @@ func TestCountResult(t *testing.T) {
 	}
 }
 
+// zshFilter returns a filter for the rpms with zsh in their location.
+func zshFilter(t *testing.T) rpmFilter {
+	include, err := parseFilters([]string{"href=*zsh*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rpmFilter{include: include}
+}
+
 func TestTotalBytes(t *testing.T) {
-	total, err := totalBytes("testdata/centos7-primary.sqlite", "")
+	total, err := totalBytes("testdata/centos7-primary.sqlite", rpmFilter{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	if total != 24408969744 {
 		t.Errorf("count should be %d, but is %d", 24408969744, total)
 	}
-	total, err = totalBytes("testdata/centos7-primary.sqlite", "zsh")
+	total, err = totalBytes("testdata/centos7-primary.sqlite", zshFilter(t))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,125 @@
+package gym
+
+import (
+	"strconv"
+	"strings"
+)
+
+// rpmvercmp compares two version or release strings like rpm does. It returns -1 if a
+// is older than b, 1 if a is newer than b and 0 if they are equal.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	for len(a) > 0 || len(b) > 0 {
+		a = strings.TrimLeftFunc(a, isVersionSeparator)
+		b = strings.TrimLeftFunc(b, isVersionSeparator)
+
+		// a tilde sorts before everything, even the end of the string
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		// a caret sorts after the end of the string but before everything else
+		if strings.HasPrefix(a, "^") || strings.HasPrefix(b, "^") {
+			if len(a) == 0 {
+				return -1
+			}
+			if len(b) == 0 {
+				return 1
+			}
+			if !strings.HasPrefix(a, "^") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "^") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if len(a) == 0 || len(b) == 0 {
+			break
+		}
+
+		numeric := isDigit(rune(a[0]))
+		segment := isAlpha
+		if numeric {
+			segment = isDigit
+		}
+		i := strings.IndexFunc(a, func(r rune) bool { return !segment(r) })
+		if i < 0 {
+			i = len(a)
+		}
+		j := strings.IndexFunc(b, func(r rune) bool { return !segment(r) })
+		if j < 0 {
+			j = len(b)
+		}
+		sa, sb := a[:i], b[:j]
+		a, b = a[i:], b[j:]
+		// numeric segments are newer than alpha segments
+		if len(sb) == 0 {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+		if numeric {
+			sa = strings.TrimLeft(sa, "0")
+			sb = strings.TrimLeft(sb, "0")
+			if len(sa) != len(sb) {
+				if len(sa) > len(sb) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if c := strings.Compare(sa, sb); c != 0 {
+			return c
+		}
+	}
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	if len(a) == 0 {
+		return -1
+	}
+	return 1
+}
+
+// evrcmp compares epoch, version and release. Empty epochs are 0, the release is only
+// compared if both releases are set.
+func evrcmp(epochA, verA, relA, epochB, verB, relB string) int {
+	ea, _ := strconv.ParseInt(strings.TrimSpace(epochA), 10, 64)
+	eb, _ := strconv.ParseInt(strings.TrimSpace(epochB), 10, 64)
+	if ea != eb {
+		if ea > eb {
+			return 1
+		}
+		return -1
+	}
+	if c := rpmvercmp(verA, verB); c != 0 {
+		return c
+	}
+	if len(relA) == 0 || len(relB) == 0 {
+		return 0
+	}
+	return rpmvercmp(relA, relB)
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isAlpha(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+func isVersionSeparator(r rune) bool {
+	return !isDigit(r) && !isAlpha(r) && r != '~' && r != '^'
+}
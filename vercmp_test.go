@@ -0,0 +1,46 @@
+package gym
+
+import "testing"
+
+func TestRpmvercmp(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "2.0", -1},
+		{"2.0.1", "2.0", 1},
+		{"2.0", "2.0.1", -1},
+		{"1.0010", "1.9", 1},
+		{"1.05", "1.5", 0},
+		{"5.5p1", "5.5p2", -1},
+		{"5.5p10", "5.5p1", 1},
+		{"xyz10", "xyz10.1", -1},
+		{"1.0aa", "1.0a", 1},
+		{"10b2", "10a1", 1},
+		{"1.0", "1", 1},
+		{"1b", "1a", 1},
+		{"a", "1", -1},
+		{"2_0", "2.0", 0},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~rc1~git", "1.0~rc1", -1},
+		{"1.0^", "1.0", 1},
+		{"1.0^git1", "1.0.1", -1},
+		{"1.0^git1", "1.0~rc1", 1},
+	}
+	for _, test := range tests {
+		if got := rpmvercmp(test.a, test.b); got != test.expected {
+			t.Errorf("rpmvercmp(%s, %s): expected %d, got %d", test.a, test.b, test.expected, got)
+		}
+		if got := rpmvercmp(test.b, test.a); got != -test.expected {
+			t.Errorf("rpmvercmp(%s, %s): expected %d, got %d", test.b, test.a, -test.expected, got)
+		}
+	}
+	if evrcmp("1", "1.0", "1", "0", "2.0", "1") != 1 {
+		t.Error("epoch should be compared first")
+	}
+	if evrcmp("0", "1.0", "", "0", "1.0", "5") != 0 {
+		t.Error("release should only be compared if both are set")
+	}
+}
@@ -0,0 +1,234 @@
+package gym
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// verifiedFile is the file in a repository with the state of the verified rpms.
+const verifiedFile = ".gym/verified.json"
+
+// verifiedPkg is a local rpm whose checksum has been verified. The rpm is trusted without
+// hashing it again as long as its size and modification time are unchanged.
+type verifiedPkg struct {
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mtime"`
+	ChecksumType string    `json:"checksumType"`
+	Checksum     string    `json:"checksum"`
+	Verified     time.Time `json:"verified"`
+	Signature    string    `json:"signature,omitempty"` // status of the gpg signature, empty if not checked
+}
+
+// verifiedDB is the state of the verified rpms of a repository by path relative to the
+// repository. It is safe for concurrent use, a nil verifiedDB trusts no rpm.
+type verifiedDB struct {
+	mu       sync.Mutex
+	dir      string
+	packages map[string]*verifiedPkg
+	changed  bool
+}
+
+// openVerifiedDB reads the state of the verified rpms of the repository in dir. An empty state
+// is returned if there is no usable state.
+func openVerifiedDB(dir string) *verifiedDB {
+	db := &verifiedDB{dir: dir, packages: map[string]*verifiedPkg{}}
+	data, err := ioutil.ReadFile(path.Join(dir, verifiedFile))
+	if err != nil {
+		return db
+	}
+	if err := json.Unmarshal(data, &db.packages); err != nil {
+		Log.Warn("ignoring invalid verified packages state", "dir", dir, "err", err)
+		db.packages = map[string]*verifiedPkg{}
+	}
+	if db.packages == nil {
+		db.packages = map[string]*verifiedPkg{}
+	}
+	return db
+}
+
+// unchanged reports whether the file still has the size and modification time it had when it
+// was verified.
+func (p *verifiedPkg) unchanged(fi os.FileInfo) bool {
+	return fi.Mode().IsRegular() && fi.Size() == p.Size && fi.ModTime().Equal(p.ModTime)
+}
+
+// trusted reports whether the rpm at relPath has been verified with the checksum and is unchanged
+// since then.
+func (db *verifiedDB) trusted(relPath string, checksumType string, checksum string) bool {
+	return db.lookup(relPath, checksumType, checksum) != nil
+}
+
+// signature returns the recorded status of the signature of the rpm at relPath, it is empty if
+// the signature has not been checked or the rpm has changed since.
+func (db *verifiedDB) signature(relPath string, checksumType string, checksum string) string {
+	if p := db.lookup(relPath, checksumType, checksum); p != nil {
+		return p.Signature
+	}
+	return ""
+}
+
+// lookup returns the state of the rpm at relPath if it has been verified with the checksum and
+// is unchanged since then.
+func (db *verifiedDB) lookup(relPath string, checksumType string, checksum string) *verifiedPkg {
+	if db == nil || len(checksumType) == 0 {
+		return nil
+	}
+	db.mu.Lock()
+	p, ok := db.packages[path.Clean(relPath)]
+	db.mu.Unlock()
+	if !ok || hashType(p.ChecksumType) != hashType(checksumType) || !strings.EqualFold(p.Checksum, checksum) {
+		return nil
+	}
+	fi, err := os.Stat(path.Join(db.dir, relPath))
+	if err != nil || !p.unchanged(fi) {
+		return nil
+	}
+	return p
+}
+
+// record stores that the rpm at relPath has just been verified with the checksum. If signature
+// is empty, the status of the signature recorded for the same checksum is kept, it only depends
+// on the content of the rpm.
+func (db *verifiedDB) record(relPath string, checksumType string, checksum string, signature string) {
+	if db == nil || len(checksumType) == 0 {
+		return
+	}
+	fi, err := os.Stat(path.Join(db.dir, relPath))
+	if err != nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if p, ok := db.packages[path.Clean(relPath)]; ok && signature == "" && hashType(p.ChecksumType) == hashType(checksumType) && strings.EqualFold(p.Checksum, checksum) {
+		signature = p.Signature
+	}
+	db.packages[path.Clean(relPath)] = &verifiedPkg{
+		Size:         fi.Size(),
+		ModTime:      fi.ModTime(),
+		ChecksumType: hashType(checksumType),
+		Checksum:     strings.ToLower(checksum),
+		Verified:     time.Now(),
+		Signature:    signature,
+	}
+	db.changed = true
+}
+
+// forget removes the rpm at relPath from the state.
+func (db *verifiedDB) forget(relPath string) {
+	if db == nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.packages[path.Clean(relPath)]; ok {
+		delete(db.packages, path.Clean(relPath))
+		db.changed = true
+	}
+}
+
+// save writes the state if it has been changed.
+func (db *verifiedDB) save() error {
+	if db == nil {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.changed {
+		return nil
+	}
+	file := path.Join(db.dir, verifiedFile)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(db.packages)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+	db.changed = false
+	return nil
+}
+
+// hashType returns the canonical name of a checksum type, sha is an alias of sha1.
+func hashType(checksumType string) string {
+	if checksumType == "sha" {
+		return "sha1"
+	}
+	return checksumType
+}
+
+// verifiedOK reports whether the local rpm at relPath has the checksum. The rpm is only hashed
+// if it has not been verified before or has changed since, with Reverify it is always hashed.
+func (r *Repo) verifiedOK(relPath string, checksumType string, checksum string) bool {
+	if !r.Reverify && r.verified.trusted(relPath, checksumType, checksum) {
+		return true
+	}
+	if !checksumOK(path.Join(r.LocalPath, relPath), checksumType, checksum) {
+		r.verified.forget(relPath)
+		return false
+	}
+	r.verified.record(relPath, checksumType, checksum, "")
+	return true
+}
+
+// VerifyStatus is the verification state of the local rpms of a repository.
+type VerifyStatus struct {
+	Packages   int       // number of local rpms
+	Bytes      int64     // size of the local rpms
+	Verified   int       // rpms verified and unchanged since
+	Modified   []string  // rpms changed since their verification
+	Unverified []string  // rpms never verified
+	Missing    []string  // verified rpms which no longer exist
+	Oldest     time.Time // time of the oldest verification of an unchanged rpm
+}
+
+// VerifyStatus compares the local rpms with the state of the verified rpms. The rpms are not hashed,
+// a changed size or modification time marks an rpm as modified.
+func (r *Repo) VerifyStatus() (*VerifyStatus, error) {
+	local, err := r.localRPMs()
+	if err != nil {
+		return nil, err
+	}
+	db := openVerifiedDB(r.LocalPath)
+	status := &VerifyStatus{Packages: len(local)}
+	seen := map[string]bool{}
+	for _, relPath := range local {
+		seen[relPath] = true
+		fi, err := os.Stat(path.Join(r.LocalPath, relPath))
+		if err != nil {
+			return nil, err
+		}
+		status.Bytes = status.Bytes + fi.Size()
+		p, ok := db.packages[relPath]
+		switch {
+		case !ok:
+			status.Unverified = append(status.Unverified, relPath)
+		case !p.unchanged(fi):
+			status.Modified = append(status.Modified, relPath)
+		default:
+			status.Verified++
+			if status.Oldest.IsZero() || p.Verified.Before(status.Oldest) {
+				status.Oldest = p.Verified
+			}
+		}
+	}
+	for relPath := range db.packages {
+		if !seen[relPath] {
+			status.Missing = append(status.Missing, relPath)
+		}
+	}
+	sort.Strings(status.Missing)
+	Log.Info("finished verify status", "name", r.Name, "packages", status.Packages, "verified", status.Verified, "modified", len(status.Modified), "unverified", len(status.Unverified), "missing", len(status.Missing), "oldest", status.Oldest)
+	return status, nil
+}
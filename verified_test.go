@@ -0,0 +1,113 @@
+package gym
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerifiedPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := path.Join(dir, "upstream")
+	testNamedRPM(t, upstream, "foo", "1.0", "1", "x86_64")
+	if err := CreateRepo(upstream, DefaultRepodataOptions()); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	downloads := 0
+	fs := http.FileServer(http.Dir(upstream))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, ".rpm") {
+			mu.Lock()
+			downloads++
+			mu.Unlock()
+		}
+		fs.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	local := path.Join(dir, "local")
+	// full syncs ignore the state of the last sync, only the verified packages are trusted
+	syncRepo := func(reverify bool) int {
+		mu.Lock()
+		downloads = 0
+		mu.Unlock()
+		r := NewRepo(local, []string{ts.URL}, nil, time.Second)
+		r.FullSync = true
+		r.Reverify = reverify
+		if err := r.SyncMeta(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Sync("", 2); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return downloads
+	}
+
+	if n := syncRepo(false); n != 1 {
+		t.Errorf("first sync: expected 1 download, got %d", n)
+	}
+	relPath := "Packages/foo-1.0-1.x86_64.rpm"
+	db := openVerifiedDB(local)
+	p, ok := db.packages[relPath]
+	if !ok || p.ChecksumType != "sha256" || len(p.Checksum) == 0 || p.Size == 0 || p.Verified.IsZero() {
+		t.Fatalf("unexpected verified state %+v", p)
+	}
+
+	// a modification keeping size and modification time is not detected without rehashing
+	rpm := path.Join(local, relPath)
+	fi, err := os.Stat(rpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(rpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(rpm, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(rpm, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if n := syncRepo(false); n != 0 {
+		t.Errorf("unchanged rpm: expected no download, got %d", n)
+	}
+	if n := syncRepo(true); n != 1 {
+		t.Errorf("reverify: expected 1 download of the modified rpm, got %d", n)
+	}
+
+	r := NewRepo(local, nil, nil, 0)
+	status, err := r.VerifyStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Packages != 1 || status.Verified != 1 || len(status.Modified)+len(status.Unverified)+len(status.Missing) != 0 {
+		t.Errorf("expected 1 verified rpm, got %+v", status)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(rpm, later, later); err != nil {
+		t.Fatal(err)
+	}
+	testNamedRPM(t, local, "bar", "1.0", "1", "x86_64")
+	status, err = r.VerifyStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Verified != 0 || strings.Join(status.Modified, " ") != relPath || strings.Join(status.Unverified, " ") != "Packages/bar-1.0-1.x86_64.rpm" {
+		t.Errorf("expected modified foo and unverified bar, got %+v", status)
+	}
+}
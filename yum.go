@@ -1,22 +1,24 @@
 package gym
 
 import (
-	"database/sql"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	_ "github.com/mattn/go-sqlite3"
 	// sql driver for sql db
+	"golang.org/x/crypto/openpgp"
 	"gopkg.in/inconshreveable/log15.v2"
 	"gopkg.in/ini.v1"
 )
@@ -56,34 +58,69 @@ func updateLogger() {
 
 // Repo represents a Yum repository
 type Repo struct {
-	LocalPath  string
-	RemoteURL  string
-	Name       string
-	Enabled    bool
-	Client     *http.Client
-	rpmc       chan *rpm
-	resultc    chan *result
-	errorc     chan error
-	done       chan bool
-	total      int
-	totalBytes int64
-}
-
-// NewRepo creates a new repository
-func NewRepo(local string, remote string, transport *http.Transport, to time.Duration) *Repo {
+	LocalPath     string
+	RemoteURLs    []string
+	MirrorList    string
+	Metalink      string
+	Name          string
+	Enabled       bool
+	Client        *http.Client
+	Retry         RetryPolicy
+	GPGCheck      bool     // verify the signatures of downloaded rpms
+	RepoGPGCheck  bool     // verify the signature of repomd.xml
+	GPGKeys       []string // urls of the public keys used for signature verification
+	KeyringDir    string   // directory with additional public keys
+	KeepUnsigned  bool     // keep downloaded rpms without signature or with unsigned payload if GPGCheck is enabled
+	Repodata      RepodataOptions
+	FilterMeta    bool         // rewrite the repodata to list only the rpms present locally
+	Packages      []string     // package names or provides to sync together with their requires
+	KeepNewest    int          // sync only the newest N versions of each package name and arch, 0 keeps all
+	Arches        []string     // sync only these architectures, all if empty
+	ExcludeArches []string     // do not sync these architectures
+	Include       []string     // filter expressions, only packages matching one of them are synced
+	Exclude       []string     // filter expressions, packages matching one of them are not synced
+	ExcludePkgs   []string     // yum package globs of exclude=, matching packages are not synced
+	IncludePkgs   []string     // yum package globs of includepkgs=, only matching packages are synced if not empty
+	Errata        ErrataFilter // sync only the packages of the selected advisories if not empty
+	Modules       []string     // module name:stream globs, packages of other module streams are not synced
+	Store         *Store       // shared blob store the rpms are hardlinked from, nil disables the store
+	FullSync      bool         // ignore the state of the last sync, download all metadata and verify all rpms
+	Reverify      bool         // hash all local rpms, even if they are unchanged since their last verification
+	rpmc          chan *rpm
+	resultc       chan *result
+	errorc        chan error
+	done          chan bool
+	total         int
+	totalBytes    int64
+	mirrors       []string
+	keyring       openpgp.EntityList
+	selection     []*rpm      // rpms to sync if not nil, set by ResolvePackages
+	repomdSum     string      // sha256 of the upstream repomd.xml, set by SyncMeta
+	unchanged     bool        // upstream metadata unchanged since the last complete sync, set by SyncMeta
+	state         *syncState  // state of the last sync, nil if all rpms are verified
+	verified      *verifiedDB // state of the verified local rpms
+}
+
+// NewRepo creates a new repository, remotes is the ordered list of the repository's base urls.
+func NewRepo(local string, remotes []string, transport *http.Transport, to time.Duration) *Repo {
 	l := strings.TrimRight(local, "/")
-	r := strings.TrimRight(remote, "/")
+	r := []string{}
+	for _, remote := range remotes {
+		r = append(r, strings.TrimRight(remote, "/"))
+	}
 	client := new(http.Client)
 	client.Timeout = to
 	if transport != nil {
 		client = &http.Client{Transport: transport, Timeout: to}
 	}
 	repo := Repo{
-		Client:    client,
-		LocalPath: l,
-		RemoteURL: r,
-		resultc:   make(chan *result),
-		done:      make(chan bool),
+		Client:     client,
+		LocalPath:  l,
+		RemoteURLs: r,
+		Retry:      DefaultRetryPolicy(),
+		Repodata:   DefaultRepodataOptions(),
+		resultc:    make(chan *result),
+		done:       make(chan bool),
 	}
 	return &repo
 }
@@ -104,37 +141,98 @@ func (rl RepoList) Find(name string) *Repo {
 // NewRepoList creates an new RepoList
 func NewRepoList(pathToYumConf string, dest string, insecure bool, release string, baseArch string, to time.Duration) (RepoList, error) {
 	repos := RepoList{}
-	cfg, err := ini.Load(pathToYumConf)
+	cfg, err := ini.LoadSources(ini.LoadOptions{AllowPythonMultilineValues: true}, pathToYumConf)
 	if err != nil {
 		return repos, err
 	}
 	for _, s := range cfg.Sections() {
 		if len(s.Keys()) > 0 {
-			urlKey, err := s.GetKey("baseurl")
-			if err != nil {
-				return repos, err
+			replacer := strings.NewReplacer("$basearch", baseArch, "$releasever", release)
+			urls := strings.FieldsFunc(replacer.Replace(s.Key("baseurl").String()), func(c rune) bool {
+				return unicode.IsSpace(c) || c == ','
+			})
+			mirrorList := replacer.Replace(s.Key("mirrorlist").String())
+			metalink := replacer.Replace(s.Key("metalink").String())
+			if len(urls) == 0 && len(mirrorList) == 0 && len(metalink) == 0 {
+				return repos, fmt.Errorf("section %s has no baseurl, mirrorlist or metalink", s.Name())
 			}
-			url := strings.Replace(strings.Replace(urlKey.Value(), "$basearch", baseArch, -1), "$releasever", release, -1)
 			transport, err := ConfigureTransport(insecure, s.Key("sslclientcert").String(), s.Key("sslclientkey").String(), s.Key("sslcacert").String())
 			if err != nil {
 				return repos, err
 			}
-			r := NewRepo(path.Join(dest, s.Name()), url, transport, to)
+			r := NewRepo(path.Join(dest, s.Name()), urls, transport, to)
 			r.Name = s.Name()
+			r.MirrorList = mirrorList
+			r.Metalink = metalink
 			enabled, err := s.Key("enabled").Int()
 			if err == nil {
 				if enabled == 1 {
 					r.Enabled = true
 				}
 			}
+			gpgCheck, err := s.Key("gpgcheck").Int()
+			if err == nil {
+				r.GPGCheck = gpgCheck == 1
+			}
+			repoGPGCheck, err := s.Key("repo_gpgcheck").Int()
+			if err == nil {
+				r.RepoGPGCheck = repoGPGCheck == 1
+			}
+			r.GPGKeys = strings.FieldsFunc(replacer.Replace(s.Key("gpgkey").String()), func(c rune) bool {
+				return unicode.IsSpace(c) || c == ','
+			})
+			r.ExcludePkgs = strings.FieldsFunc(replacer.Replace(s.Key("exclude").String()), func(c rune) bool {
+				return unicode.IsSpace(c) || c == ','
+			})
+			r.IncludePkgs = strings.FieldsFunc(replacer.Replace(s.Key("includepkgs").String()), func(c rune) bool {
+				return unicode.IsSpace(c) || c == ','
+			})
 			repos = append(repos, *r)
 		}
 	}
 	return repos, nil
 }
 
-// Sync synchronizes remote RPMs to the local filesystem
+// Sync synchronizes remote RPMs to the local filesystem. If filter is not empty, only packages
+// matching the filter expression and the includes of the repository are synced, see parseFilter.
+// Before filter expressions, filter was a substring of the package location, e.g. Sync("zsh")
+// still selects the packages with zsh in the name but no longer matches directory names.
 func (r *Repo) Sync(filter string, numWorkers int) error {
+	options := r.syncOptions(filter)
+	r.state = nil
+	r.verified = openVerifiedDB(r.LocalPath)
+	if !r.FullSync && !r.Reverify {
+		r.state = readSyncState(r.LocalPath)
+		if r.unchanged && r.state.Complete && r.state.Options == options {
+			Log.Info("repository unchanged since last sync", "name", r.Name, "revision", r.state.Revision, "synced", r.state.Synced)
+			return nil
+		}
+	}
+	if r.GPGCheck {
+		if err := r.initKeyring(); err != nil {
+			return err
+		}
+	}
+	if len(r.Packages) > 0 && r.selection == nil {
+		if err := ResolvePackages([]*Repo{r}, r.Packages); err != nil {
+			return err
+		}
+	}
+	if !r.Errata.empty() {
+		if err := r.selectErrata(filter); err != nil {
+			return err
+		}
+	}
+	if len(r.Modules) > 0 {
+		if err := r.selectModules(filter); err != nil {
+			return err
+		}
+	}
+	if r.KeepNewest > 0 {
+		if err := r.selectNewest(filter); err != nil {
+			return err
+		}
+	}
 	if err := r.rpmList(filter); err != nil {
 		return err
 	}
@@ -154,9 +252,17 @@ func (r *Repo) Sync(filter string, numWorkers int) error {
 	}()
 
 	var currentBytes int64
+	statusCount := map[string]int{}
+	retries := 0
+	state := &syncState{Repomd: r.repomdSum, Revision: repomdRevision(path.Join(r.LocalPath, "repodata/repomd.xml")), Options: options, Packages: map[string]string{}}
 	for res := range r.resultc {
+		statusCount[res.status]++
+		retries = retries + res.retries
+		if res.err == nil {
+			state.Packages[res.rpm.relPath] = res.rpm.checksum
+		}
 		if res.err != nil {
-			Log.Error(path.Base(res.rpm.relPath), "status", res.status, "workerid", res.workerID, "err", res.err)
+			Log.Error(path.Base(res.rpm.relPath), "status", res.status, "workerid", res.workerID, "retries", res.retries, "mirror", res.mirror, "signature", res.signature, "err", res.err)
 		} else {
 			currentBytes = currentBytes + int64(res.rpm.size)
 			progress := float64(currentBytes)
@@ -167,10 +273,10 @@ func (r *Repo) Sync(filter string, numWorkers int) error {
 			}
 			if res.err != nil {
 			}
-			if res.status == "cached" {
-				Log.Debug(ellipsis(path.Base(res.rpm.relPath), 40), "status", res.status, "err", res.err, "progress", fmt.Sprintf(progressMsg, progress), "numBytes", res.bytesDownloaded, "workerid", res.workerID)
+			if res.status == "cached" || res.status == "linked" {
+				Log.Debug(ellipsis(path.Base(res.rpm.relPath), 40), "status", res.status, "err", res.err, "progress", fmt.Sprintf(progressMsg, progress), "numBytes", res.bytesDownloaded, "workerid", res.workerID, "retries", res.retries, "mirror", res.mirror)
 			} else {
-				Log.Info(ellipsis(path.Base(res.rpm.relPath), 40), "status", res.status, "err", res.err, "progress", fmt.Sprintf(progressMsg, progress), "numBytes", res.bytesDownloaded, "workerid", res.workerID)
+				Log.Info(ellipsis(path.Base(res.rpm.relPath), 40), "status", res.status, "err", res.err, "progress", fmt.Sprintf(progressMsg, progress), "numBytes", res.bytesDownloaded, "workerid", res.workerID, "retries", res.retries, "mirror", res.mirror, "signature", res.signature)
 			}
 		}
 	}
@@ -178,15 +284,83 @@ func (r *Repo) Sync(filter string, numWorkers int) error {
 	if err := <-r.errorc; err != nil {
 		return err
 	}
-	Log.Info("finished rpm sync", "name", r.Name)
-	return nil
+	if err := r.verified.save(); err != nil {
+		Log.Warn("could not write verified packages state", "name", r.Name, "err", err)
+	}
+	Log.Info("finished rpm sync", "name", r.Name, "downloaded", statusCount["downld"], "cached", statusCount["cached"], "linked", statusCount["linked"], "failed", statusCount["failed"], "retries", retries)
+	var err error
+	if r.filtersRepodata() {
+		state.Filtered = true
+		err = r.FilterRepodata()
+	}
+	// an incomplete sync is repeated, but the rpms synced successfully are not verified again
+	state.Complete = err == nil && statusCount["failed"] == 0
+	state.Synced = time.Now()
+	if serr := writeSyncState(r.LocalPath, state); serr != nil {
+		Log.Warn("could not write sync state", "name", r.Name, "err", serr)
+	}
+	return err
 }
 
 // SyncMeta downloads the repository's metadata comps.xml, repomd.xml filelist.xml etc...
+// If the repository has a metalink or mirrorlist, the mirrors are tried in order until the
+// metadata of one mirror is downloaded completely. This mirror is then used for the rpm sync.
+// With RepoGPGCheck the new metadata is only put in place if the signature of repomd.xml is valid.
 func (r *Repo) SyncMeta() error {
-	if _, err := r.download(r.RemoteURL+"/repodata/repomd.xml", path.Join(r.LocalPath, ".newrepodata", "repomd.xml"), "", ""); err != nil {
+	mirrors, hashes, err := r.resolveMirrors()
+	if err != nil {
+		return err
+	}
+	for i, mirror := range mirrors {
+		if err = r.syncMeta(mirror, hashes); err == nil {
+			// the mirror with the current metadata is preferred for the rpm downloads
+			r.mirrors = append([]string{mirror}, append(mirrors[:i:i], mirrors[i+1:]...)...)
+			return nil
+		}
+		Log.Warn("metadata sync failed", "name", r.Name, "mirror", mirror, "err", err)
+		if err := os.RemoveAll(path.Join(r.LocalPath, ".newrepodata")); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// syncMeta downloads the metadata from the mirror with base url remoteURL. If hashes is not
+// empty, repomd.xml has to match one of the hashes.
+func (r *Repo) syncMeta(remoteURL string, hashes []repomdHash) error {
+	repomdPath := path.Join(r.LocalPath, ".newrepodata", "repomd.xml")
+	if _, _, err := r.download(remoteURL+"/repodata/repomd.xml", repomdPath, "", ""); err != nil {
+		return err
+	}
+	if err := verifyRepomd(repomdPath, hashes); err != nil {
 		return err
 	}
+	repomdSum, err := fileChecksum(repomdPath, "sha256")
+	if err != nil {
+		return err
+	}
+	if r.RepoGPGCheck {
+		// the signature is kept next to repomd.xml for downstream clients
+		if err := r.initKeyring(); err != nil {
+			return err
+		}
+		if _, _, err := r.download(remoteURL+"/repodata/repomd.xml.asc", repomdPath+".asc", "", ""); err != nil {
+			return err
+		}
+		if err := verifyRepomdSignature(repomdPath, repomdPath+".asc", r.keyring); err != nil {
+			return err
+		}
+	}
+	r.repomdSum = repomdSum
+	if !r.FullSync {
+		state := readSyncState(r.LocalPath)
+		if _, err := os.Stat(path.Join(r.LocalPath, "repodata/repomd.xml")); err == nil && state.Complete && !state.Filtered && state.Repomd == repomdSum {
+			// the local repodata is the same as upstream
+			Log.Info("metadata unchanged since last sync", "name", r.Name, "revision", state.Revision)
+			r.unchanged = true
+			return os.RemoveAll(path.Join(r.LocalPath, ".newrepodata"))
+		}
+	}
 	metaFiles, err := r.lsMeta()
 	if err != nil {
 		return err
@@ -198,8 +372,12 @@ func (r *Repo) SyncMeta() error {
 		wg.Add(1)
 		go func(m metaFile) {
 			defer wg.Done()
-			if _, err := r.download(r.RemoteURL+"/"+m.href, path.Join(r.LocalPath, "/.new"+m.href), m.checksum, m.checksumType); err != nil {
-				errorc <- fmt.Errorf("download failed, url=%s, dest=%s, err=%s", r.RemoteURL+"/"+m.href, path.Join(r.LocalPath), err)
+			dest := path.Join(r.LocalPath, "/.new"+m.href)
+			if !r.FullSync && r.reuseMeta(m, dest) {
+				return
+			}
+			if _, _, err := r.download(remoteURL+"/"+m.href, dest, m.checksum, m.checksumType); err != nil {
+				errorc <- fmt.Errorf("download failed, url=%s, dest=%s, err=%s", remoteURL+"/"+m.href, path.Join(r.LocalPath), err)
 			}
 		}(m)
 	}
@@ -223,7 +401,28 @@ func (r *Repo) SyncMeta() error {
 	return nil
 }
 
-func (r *Repo) Snapshot(dest string, timestamp, link bool, createRepo bool, numWorkers int) error {
+// reuseMeta links the metadata file m from the current repodata to dest if it is unchanged.
+func (r *Repo) reuseMeta(m metaFile, dest string) bool {
+	current := path.Join(r.LocalPath, m.href)
+	if len(m.checksumType) == 0 || !strings.HasPrefix(m.href, "repodata/") || !checksumOK(current, m.checksumType, m.checksum) {
+		return false
+	}
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return false
+	}
+	if _, err := linkRPM(current, dest, SnapshotHardlink); err != nil {
+		return false
+	}
+	Log.Debug("metadata unchanged", "name", path.Base(m.href))
+	return true
+}
+
+// Snapshot creates a snapshot of the repository in dest/<name of the repository>, mode is one of
+// the snapshot modes e.g: SnapshotCopy or SnapshotHardlink.
+func (r *Repo) Snapshot(dest string, timestamp bool, mode string, createRepo bool, numWorkers int) error {
+	if !validSnapshotMode(mode) {
+		return fmt.Errorf("invalid snapshot mode %s", mode)
+	}
 	if _, err := os.Stat(path.Join(r.LocalPath, "repodata/repomd.xml")); err != nil {
 		return fmt.Errorf("%s is not a valid repository, repomd.xml does not exist", r.LocalPath)
 	}
@@ -235,6 +434,9 @@ func (r *Repo) Snapshot(dest string, timestamp, link bool, createRepo bool, numW
 		return fmt.Errorf("destination %s already exists", destination)
 	}
 
+	if err := r.selectSnapshot(); err != nil {
+		return err
+	}
 	if err := r.rpmList(""); err != nil {
 		return err
 	}
@@ -243,7 +445,7 @@ func (r *Repo) Snapshot(dest string, timestamp, link bool, createRepo bool, numW
 	wg.Add(numWorkers)
 	for i := 0; i < numWorkers; i++ {
 		go func(id int) {
-			r.snapshotWorker(destination, link, id)
+			r.snapshotWorker(destination, mode, id)
 			wg.Done()
 		}(i + 1)
 	}
@@ -253,198 +455,347 @@ func (r *Repo) Snapshot(dest string, timestamp, link bool, createRepo bool, numW
 		close(r.resultc)
 	}()
 
-	mode := "copy"
-	if link {
-		mode = "link"
+	info := snapshotInfo{Name: r.Name, Source: r.LocalPath, Created: time.Now(), Mode: mode}
+	if len(info.Name) == 0 {
+		info.Name = path.Base(r.LocalPath)
 	}
 	for res := range r.resultc {
 		if res.err != nil {
 			Log.Error(path.Base(res.rpm.relPath), "status", res.status, "workerid", res.workerID, "err", res.err)
-		} else {
-			Log.Debug(ellipsis(path.Base(res.rpm.relPath), 40), "mode", mode, "err", res.err, "workerid", res.workerID)
+			continue
+		}
+		Log.Debug(ellipsis(path.Base(res.rpm.relPath), 40), "mode", res.status, "err", res.err, "workerid", res.workerID)
+		if res.status == "skipped" {
+			continue
+		}
+		info.Packages++
+		if res.status != mode {
+			info.Copied++
 		}
 	}
 
 	if err := <-r.errorc; err != nil {
 		return err
 	}
-	if !createRepo {
-		return copyDir(path.Join(r.LocalPath, "repodata"), destination)
+	if info.Copied > 0 {
+		Log.Warn("rpms copied instead of linked", "name", r.Name, "mode", mode, "copied", info.Copied)
 	}
-
-	cmdString, err := exec.LookPath("createrepo")
-	if err != nil {
+	if err := r.snapshotRepodata(destination, createRepo); err != nil {
 		return err
 	}
+	return writeSnapshotInfo(destination, info)
+}
+
+// selectSnapshot restricts the rpms of a snapshot to the packages selected by Errata, Modules
+// and KeepNewest.
+func (r *Repo) selectSnapshot() error {
+	if !r.Errata.empty() {
+		if err := r.selectErrata(""); err != nil {
+			return err
+		}
+	}
+	if len(r.Modules) > 0 {
+		if err := r.selectModules(""); err != nil {
+			return err
+		}
+	}
+	if r.KeepNewest > 0 {
+		return r.selectNewest("")
+	}
+	return nil
+}
+
+// snapshotRepodata copies or generates the repodata of the snapshot in destination.
+func (r *Repo) snapshotRepodata(destination string, createRepo bool) error {
+	if !createRepo {
+		if err := copyDir(path.Join(r.LocalPath, "repodata"), destination); err != nil {
+			return err
+		}
+		if !r.filtersRepodata() {
+			return nil
+		}
+		snapshot := NewRepo(destination, nil, nil, 0)
+		snapshot.Name = r.Name
+		snapshot.Repodata = r.Repodata
+		snapshot.Errata = r.Errata
+		snapshot.Modules = r.Modules
+		return snapshot.FilterRepodata()
+	}
+
+	opts := r.Repodata
 	metaFiles, err := r.lsMeta()
 	if err != nil {
 		return err
 	}
-	args := []string{"-d"}
 	if meta, ok := metaFiles.get("group"); ok {
-		args = append(args, path.Join(r.LocalPath, meta.href))
+		opts.GroupFile = path.Join(r.LocalPath, meta.href)
+	}
+	extra := map[string][]byte{}
+	if r.filtersRepodata() {
+		updateinfo, err := r.snapshotUpdateinfo(destination)
+		if err != nil {
+			return err
+		}
+		if updateinfo != nil {
+			extra["updateinfo"] = updateinfo
+		}
 	}
-	args = append(args, destination)
-	cmd := exec.Command(cmdString, args...)
-	out, err := cmd.CombinedOutput()
-	Log.Debug("run create repo", "cmd", strings.Join(cmd.Args, " "), "out", string(out))
+	// module streams are needed to install modular packages, they are kept even without filtering
+	modules, err := r.snapshotModules(destination)
 	if err != nil {
-		return fmt.Errorf("create repo failed, err: %s, output: %s", err, string(out))
+		return err
 	}
-	return nil
+	if modules != nil {
+		extra["modules"] = modules
+	}
+	return createRepodata(destination, opts, extra)
 }
 
 // rpmList reads the available rpms from sqlite db and puts the RPM in a channel for later processing
 func (r *Repo) rpmList(filter string) error {
+	f, err := r.rpmFilter(filter)
+	if err != nil {
+		return err
+	}
+	if r.selection != nil {
+		rpms := []*rpm{}
+		for _, rpm := range r.selection {
+			if f.match(rpm.pkg) {
+				rpms = append(rpms, rpm)
+			}
+		}
+		return r.rpmListFromRPMs(rpms)
+	}
 	metaFiles, err := r.lsMeta()
 	if err != nil {
 		return err
 	}
 	primary, ok := metaFiles.get("primary_db")
 	if ok {
-		return r.rpmListFromSqlite(filter, primary)
+		return r.rpmListFromSqlite(f, primary)
 	}
 	primary, ok = metaFiles.get("primary")
 	if !ok {
 		return errors.New("now primary db sqlite or xml file found")
 	}
-	return r.rpmListFromXML(filter, primary)
+	return r.rpmListFromXML(f, primary)
 
 }
 
-// rpmListFromSqlite reads the available rpms from sqlite db and puts the RPM in a channel for later processing
-func (r *Repo) rpmListFromSqlite(filter string, primary metaFile) error {
-	r.rpmc = make(chan *rpm)
-	r.errorc = make(chan error, 1)
-
-	tmpFile, err := uncompress(path.Join(r.LocalPath, "repodata", primary.name))
-	if err != nil {
-		return err
+// rpmFilter returns the filter for the rpms to sync with the repository's filter expressions,
+// package globs and architectures, filter is an additional include expression if not empty.
+func (r *Repo) rpmFilter(filter string) (rpmFilter, error) {
+	f := rpmFilter{
+		arches:        r.Arches,
+		excludeArches: r.ExcludeArches,
 	}
-
-	r.total, err = countResult(tmpFile.Name(), filter)
-	if err != nil {
-		return err
+	var err error
+	if f.include, err = parseFilters(r.Include); err != nil {
+		return f, err
 	}
-	if r.total == 0 {
-		close(r.rpmc)
-		close(r.errorc)
-		r.totalBytes = 0
-		return nil
+	if len(filter) > 0 {
+		// the filter narrows the packages selected by the includes
+		extra, err := parseFilters([]string{filter})
+		if err != nil {
+			return f, err
+		}
+		f.include = andFilters(f.include, extra)
 	}
-	r.totalBytes, err = totalBytes(tmpFile.Name(), filter)
-	if err != nil {
-		return err
+	if f.exclude, err = parseFilters(r.Exclude); err != nil {
+		return f, err
 	}
-	query := "select location_href, size_archive, checksum_type, pkgId from packages"
-	if len(filter) > 0 {
-		query = query + " where location_href like '%" + filter + "%'"
+	for _, spec := range r.ExcludePkgs {
+		c, err := parsePkgSpec(spec)
+		if err != nil {
+			return f, err
+		}
+		f.exclude = append(f.exclude, filterExpr{c})
+	}
+	// a package must match one of the include expressions and one of the included package globs
+	specs := []filterExpr{}
+	for _, spec := range r.IncludePkgs {
+		c, err := parsePkgSpec(spec)
+		if err != nil {
+			return f, err
+		}
+		specs = append(specs, filterExpr{c})
+	}
+	f.include = andFilters(f.include, specs)
+	return f, nil
+}
+
+// rpmListFromRPMs puts a list of rpms in a channel for later processing
+func (r *Repo) rpmListFromRPMs(rpms []*rpm) error {
+	r.rpmc = make(chan *rpm)
+	r.errorc = make(chan error, 1)
+	r.total = len(rpms)
+	r.totalBytes = 0
+	for _, rpm := range rpms {
+		r.totalBytes = r.totalBytes + int64(rpm.size)
 	}
 	go func() {
-		// Close rpms channel after we have rpm list
 		defer close(r.rpmc)
 		defer close(r.errorc)
-		i := 0
-		r.errorc <- processSqlite(tmpFile.Name(), query, func(rows *sql.Rows) error {
-			for rows.Next() {
-				i++
-				var locationHref, checksum, checksumType string
-				var sizeArchive int
-				if err := rows.Scan(&locationHref, &sizeArchive, &checksumType, &checksum); err != nil {
-					return err
-				}
-				rpm := newRPM(locationHref, checksum, checksumType, sizeArchive)
-				rpm.downloadID = i
-				select {
-				case r.rpmc <- rpm:
-				case <-r.done:
-					return errors.New("rpmlist canceled")
-				}
+		for i, rpm := range rpms {
+			rpm.downloadID = i + 1
+			select {
+			case r.rpmc <- rpm:
+			case <-r.done:
+				r.errorc <- errors.New("rpmlist canceled")
+				return
 			}
-			return nil
-		})
+		}
+		r.errorc <- nil
 	}()
 	return nil
 }
 
-// rpmListFromXML reads the available rpms from xml and puts the RPM in a channel for later processing
-func (r *Repo) rpmListFromXML(filter string, primary metaFile) error {
-	r.rpmc = make(chan *rpm)
-	r.errorc = make(chan error, 1)
+// rpmListFromSqlite reads the available rpms from sqlite db and puts the RPM in a channel for later processing.
+// The db is read completely first, so that the totals are known before the rpms are processed.
+func (r *Repo) rpmListFromSqlite(filter rpmFilter, primary metaFile) error {
+	tmpFile, err := uncompress(r.metaPath(primary))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
 
-	tmpFile, err := uncompress(path.Join(r.LocalPath, "repodata", primary.name))
+	rpms := []*rpm{}
+	err = sqlitePackages(tmpFile.Name(), filter, func(p *pkgMeta) error {
+		rpms = append(rpms, p.rpm())
+		return nil
+	})
 	if err != nil {
 		return err
 	}
+	return r.rpmListFromRPMs(rpms)
+}
 
-	if len(filter) > 0 {
+// rpmListFromXML reads the available rpms from xml and puts the RPM in a channel for later processing.
+// The xml is read completely first, so that the totals are known before the rpms are processed.
+func (r *Repo) rpmListFromXML(filter rpmFilter, primary metaFile) error {
+	tmpFile, err := uncompress(r.metaPath(primary))
+	if err != nil {
+		return err
 	}
-	go func() {
-		// Close rpms channel after we have rpm list
-		defer close(r.rpmc)
-		defer close(r.errorc)
-		i := 0
-		r.errorc <- processXML(tmpFile.Name(), func(decoder *xml.Decoder) error {
-			for {
-				i++
-				// Read tokens from the XML document in a stream.
-				t, _ := decoder.Token()
-				if t == nil {
-					break
+	defer os.Remove(tmpFile.Name())
+
+	rpms := []*rpm{}
+	err = processXML(tmpFile.Name(), func(decoder *xml.Decoder) error {
+		for {
+			// Read tokens from the XML document in a stream.
+			t, err := decoder.Token()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if se, ok := t.(xml.StartElement); ok && se.Name.Local == "package" {
+				p := &pkgMeta{}
+				if err := decoder.DecodeElement(p, &se); err != nil {
+					return err
 				}
-				switch se := t.(type) {
-				case xml.StartElement:
-					if se.Name.Local == "package" {
-						var p rpmPackage
-						decoder.DecodeElement(&p, &se)
-						rpm := newRPM(p.Location.Href, p.Checksum.Value, p.Checksum.Type, p.Size.Archive)
-						rpm.downloadID = i
-						if len(filter) > 0 && !strings.Contains(rpm.relPath, filter) {
-							continue
-						}
-						select {
-						case r.rpmc <- rpm:
-						case <-r.done:
-							return errors.New("rpmlist canceled")
-						}
-					}
+				if !filter.match(p) {
+					continue
 				}
+				rpms = append(rpms, p.rpm())
 			}
-			return nil
-		})
-	}()
-	return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return r.rpmListFromRPMs(rpms)
 }
 
-// download url and verify checksum of downloaded file, if shaType is empty no verification is done
-func (r *Repo) download(url string, dest string, checksum string, shaType string) (int64, error) {
+// download url and verify checksum of downloaded file, if shaType is empty no verification is done.
+// The checksum is computed while the file is downloaded. Transient errors are retried according
+// to the repository's retry policy, the number of retries is returned.
+func (r *Repo) download(url string, dest string, checksum string, shaType string) (int64, int, error) {
 	Log.Debug(ellipsis(path.Base(url), 40), "destdir", path.Dir(dest), "sumType", shaType, "checksum", checksum)
 	if _, err := os.Stat(dest); err == nil {
 		if len(shaType) > 0 && checksumOK(dest, shaType, checksum) {
-			return 0, nil
+			return 0, 0, nil
 		}
 	}
-	size, err := r.Download(url, dest)
+	return r.downloadVerify(url, dest, checksum, shaType)
+}
+
+// downloadVerify downloads url to dest even if dest exists and verifies the checksum of the
+// downloaded file, see download.
+func (r *Repo) downloadVerify(url string, dest string, checksum string, shaType string) (int64, int, error) {
+	var h hash.Hash
+	if len(shaType) > 0 {
+		h = checksumHash(shaType)
+	}
+	size, retries, err := r.downloadRetry(url, dest, h)
 	if err != nil {
-		return 0, err
+		return 0, retries, err
 	}
-	if !checksumOK(dest, shaType, checksum) {
-		return size, errors.New("checksum missmatch")
+	if h != nil && hex.EncodeToString(h.Sum(nil)) != checksum {
+		return size, retries, errChecksumMismatch
 	}
-	return size, nil
+	return size, retries, nil
 }
 
-// Download url and verify checksum of downloaded file, if shaType is empty no verification is done
-func (r *Repo) Download(url string, dest string) (int64, error) {
-	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
-		return 0, err
+// downloadFromMirrors downloads relPath from the first mirror that serves it. The next
+// mirror is tried on connection errors, missing files, server errors and checksum
+// mismatches. The mirror that served the file is returned. An existing dest is not verified
+// again, the caller has already found it to be invalid.
+func (r *Repo) downloadFromMirrors(relPath string, dest string, checksum string, shaType string) (int64, int, string, error) {
+	mirrors := r.mirrorURLs()
+	if len(mirrors) == 0 {
+		return 0, 0, "", errors.New("repository has no base url")
+	}
+	totalRetries := 0
+	var err error
+	for _, mirror := range mirrors {
+		var size int64
+		var retries int
+		size, retries, err = r.downloadVerify(mirror+"/"+relPath, dest, checksum, shaType)
+		totalRetries = totalRetries + retries
+		if err == nil {
+			return size, totalRetries, mirror, nil
+		}
+		if !mirrorFailover(err) {
+			return size, totalRetries, mirror, err
+		}
+		Log.Debug("download from mirror failed", "name", path.Base(relPath), "mirror", mirror, "err", err)
 	}
+	return 0, totalRetries, mirrors[len(mirrors)-1], err
+}
 
-	out, err := os.Create(dest)
-	if err != nil {
+// Download url to dest, transient errors are retried according to the repository's retry policy.
+// See fetch for details.
+func (r *Repo) Download(url string, dest string) (int64, error) {
+	size, _, err := r.downloadRetry(url, dest, nil)
+	return size, err
+}
+
+// downloadRetry fetches url until it succeeds or the retry policy gives up. The returned size
+// is the sum of the bytes downloaded by all attempts. If h is not nil, it is the hash of dest
+// after a successful download.
+func (r *Repo) downloadRetry(url string, dest string, h hash.Hash) (int64, int, error) {
+	var total int64
+	retries, err := r.Retry.retry(path.Base(url), func() error {
+		size, err := r.fetch(url, dest, h)
+		total = total + size
+		return err
+	})
+	return total, retries, err
+}
+
+// fetch downloads url to dest. The data is written to dest.part first and renamed to dest
+// once the download is complete. An existing dest.part from an interrupted download
+// is resumed with a http range request, if the server does not support range
+// requests or the remote file changed, the whole file is downloaded again. If h is not nil, it is
+// reset and the data is hashed while it is written, a resumed part is hashed before the download
+// continues.
+func (r *Repo) fetch(url string, dest string, h hash.Hash) (int64, error) {
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
 		return 0, err
 	}
-	defer out.Close()
+	part := dest + ".part"
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return 0, err
@@ -452,18 +803,69 @@ func (r *Repo) Download(url string, dest string) (int64, error) {
 	if filepath.Ext(url) == ".gz" {
 		req.Header.Add("Accept-Encoding", "gzip") //otherwise the client decompresses *.gz files, that is not what we want
 	}
+	var offset int64
+	if fi, err := os.Stat(part); err == nil && fi.Size() > 0 {
+		// the modification time of the part file is set to the remote Last-Modified
+		// time, with If-Range the server only sends the range if the file is unchanged
+		offset = fi.Size()
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", fi.ModTime().UTC().Format(http.TimeFormat))
+	}
 	resp, err := r.Client.Do(req)
 	if err != nil {
 		return 0, err
 	}
-	if resp.StatusCode > 299 {
-		return 0, fmt.Errorf("http status: %s", resp.Status)
-	}
 	defer resp.Body.Close()
-	size, err := io.Copy(out, resp.Body)
+
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			os.Remove(part)
+			return 0, fmt.Errorf("unexpected content range '%s' for resumed download at offset %d", resp.Header.Get("Content-Range"), offset)
+		}
+		Log.Debug("resume download", "url", url, "offset", offset)
+		flag = os.O_WRONLY | os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the part file is not a prefix of the remote file, start from scratch
+		resp.Body.Close()
+		if err := os.Remove(part); err != nil {
+			return 0, err
+		}
+		return r.fetch(url, dest, h)
+	case resp.StatusCode > 299:
+		return 0, &httpStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+
+	out, err := os.OpenFile(part, flag, 0644)
 	if err != nil {
 		return 0, err
 	}
+	var w io.Writer = out
+	if h != nil {
+		h.Reset()
+		if flag&os.O_APPEND != 0 {
+			if err := hashFile(h, part); err != nil {
+				out.Close()
+				return 0, err
+			}
+		}
+		w = io.MultiWriter(out, h)
+	}
+	size, err := io.Copy(w, resp.Body)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if lastModified, perr := http.ParseTime(resp.Header.Get("Last-Modified")); perr == nil {
+		os.Chtimes(part, lastModified, lastModified)
+	}
+	if err != nil {
+		return size, err
+	}
+	if err := os.Rename(part, dest); err != nil {
+		return size, err
+	}
 	return size, nil
 }
 
@@ -473,6 +875,9 @@ type result struct {
 	workerID        int
 	progress        string
 	bytesDownloaded int64
+	retries         int
+	mirror          string
+	signature       string
 	status          string
 }
 
@@ -498,8 +903,46 @@ func (r *Repo) downloadWorker(id int) {
 	i := 0
 	for rpm := range r.rpmc {
 		i++
-		bytesDownloaded, err := r.download(r.RemoteURL+"/"+rpm.relPath, path.Join(r.LocalPath, rpm.relPath), rpm.checksum, rpm.checksumType)
-		res := newResult(rpm, id, bytesDownloaded, err)
+		dest := path.Join(r.LocalPath, rpm.relPath)
+		var res *result
+		if r.state.synced(rpm, dest) {
+			// the rpm has been verified by a previous sync
+			res = newResult(rpm, id, 0, nil)
+		}
+		if res == nil && r.Store != nil && !r.Reverify {
+			// a blob in the store is already verified, no download is necessary
+			res = r.linkFromStore(rpm, dest, id)
+		}
+		if res == nil && len(rpm.checksumType) > 0 && r.verifiedOK(rpm.relPath, rpm.checksumType, rpm.checksum) {
+			// the local rpm is unchanged since its last verification or has just been hashed
+			if r.addToStore(rpm, dest) {
+				// the rpm may have been replaced by a link to the blob
+				r.verified.record(rpm.relPath, rpm.checksumType, rpm.checksum, "")
+			}
+			res = newResult(rpm, id, 0, nil)
+		}
+		if res == nil {
+			bytesDownloaded, retries, mirror, err := r.downloadFromMirrors(rpm.relPath, dest, rpm.checksum, rpm.checksumType)
+			signature := ""
+			if err == nil && r.GPGCheck {
+				// the signature is checked before the rpm is added to the store
+				signature, err = r.checkSignature(rpm, dest)
+			}
+			if err == nil {
+				r.addToStore(rpm, dest)
+				r.verified.record(rpm.relPath, rpm.checksumType, rpm.checksum, signature)
+			}
+			res = newResult(rpm, id, bytesDownloaded, err)
+			res.retries = retries
+			res.mirror = mirror
+			res.signature = signature
+		}
+		if res.err == nil && res.signature == "" && r.GPGCheck {
+			// rpms synced before, from the store or without gpgcheck have to be signed as well
+			if res.signature, res.err = r.checkSignature(rpm, dest); res.err != nil {
+				res.status = "failed"
+			}
+		}
 		select {
 		case r.resultc <- res:
 		case <-r.done:
@@ -509,12 +952,70 @@ func (r *Repo) downloadWorker(id int) {
 	}
 }
 
-func (r *Repo) snapshotWorker(dest string, link bool, id int) {
+// addToStore adds the verified rpm to the store and reports whether it has been added. The store
+// only saves space, an rpm which cannot be added is kept and only a warning is logged.
+func (r *Repo) addToStore(rpm *rpm, dest string) bool {
+	if r.Store == nil {
+		return false
+	}
+	if err := r.Store.add(dest, rpm.checksumType, rpm.checksum); err != nil {
+		Log.Warn("could not add rpm to store", "name", r.Name, "rpm", rpm.relPath, "err", err)
+		return false
+	}
+	return true
+}
+
+// linkFromStore links the rpm from the store, it returns nil if the store has no blob of the rpm.
+// With GPGCheck the blob is only linked if its signature is accepted, it may have been added by a
+// repository without gpgcheck.
+func (r *Repo) linkFromStore(rpm *rpm, dest string, id int) *result {
+	blob, ok := r.Store.blob(rpm.checksumType, rpm.checksum)
+	if !ok {
+		return nil
+	}
+	signature := ""
+	if r.GPGCheck {
+		// the signature recorded for the local rpm applies to the blob with the same checksum
+		signature = r.verified.signature(rpm.relPath, rpm.checksumType, rpm.checksum)
+		var err error
+		if signature == "" || r.acceptSignature(signature, nil) != nil {
+			signature, err = verifyRPMSignature(blob, r.keyring)
+		}
+		if err = r.acceptSignature(signature, err); err != nil {
+			res := newResult(rpm, id, 0, fmt.Errorf("blob %s in store: %s", path.Base(blob), err))
+			res.signature = signature
+			return res
+		}
+	}
+	linked, err := r.Store.link(rpm.checksumType, rpm.checksum, dest)
+	if !linked {
+		return nil
+	}
+	res := newResult(rpm, id, 0, err)
+	res.signature = signature
+	if err == nil {
+		res.status = "linked"
+		r.verified.record(rpm.relPath, rpm.checksumType, rpm.checksum, signature)
+	}
+	return res
+}
+
+func (r *Repo) snapshotWorker(dest string, mode string, id int) {
 	i := 0
 	for rpm := range r.rpmc {
 		i++
-		err := r.copyOrLink(dest, rpm, link)
-		res := newResult(rpm, id, 0, err)
+		var res *result
+		if _, err := os.Stat(path.Join(r.LocalPath, rpm.relPath)); os.IsNotExist(err) && r.FilterMeta {
+			// rpms missing in a filtered mirror are not part of the snapshot
+			res = newResult(rpm, id, 0, nil)
+			res.status = "skipped"
+		} else {
+			used, err := r.copyOrLink(dest, rpm, mode)
+			res = newResult(rpm, id, 0, err)
+			if err == nil {
+				res.status = used
+			}
+		}
 		select {
 		case r.resultc <- res:
 		case <-r.done:
@@ -524,29 +1025,30 @@ func (r *Repo) snapshotWorker(dest string, link bool, id int) {
 	}
 }
 
-func (r *Repo) copyOrLink(destDir string, rpm *rpm, link bool) error {
+// copyOrLink creates the rpm in destDir according to mode and returns the mode actually used.
+func (r *Repo) copyOrLink(destDir string, rpm *rpm, mode string) (string, error) {
 	source := path.Join(r.LocalPath, rpm.relPath)
 	destPath := path.Join(destDir, rpm.relPath)
 	if err := os.MkdirAll(path.Dir(destPath), 0755); err != nil {
-		return err
-	}
-	if link {
-		sourceAbs, err := filepath.Abs(source)
-		if err != nil {
-			return err
-		}
-		Log.Debug("link rpm", "source", source, "dest", destPath)
-		return os.Symlink(sourceAbs, destPath)
+		return mode, err
 	}
-	// copy rpm
-	Log.Debug("copy rpm", "source", source, "dest", destPath)
-	if err := copyFile(source, destPath); err != nil {
-		return err
+	Log.Debug("snapshot rpm", "source", source, "dest", destPath, "mode", mode)
+	used, err := linkRPM(source, destPath, mode)
+	if err != nil || used != SnapshotCopy {
+		return used, err
 	}
 	if !checksumOK(destPath, rpm.checksumType, rpm.checksum) {
-		return errors.New("checksum missmatch")
+		return used, errChecksumMismatch
 	}
-	return nil
+	return used, nil
+}
+
+// mirrorURLs returns the base urls used for rpm downloads in order of preference.
+func (r *Repo) mirrorURLs() []string {
+	if len(r.mirrors) > 0 {
+		return r.mirrors
+	}
+	return r.RemoteURLs
 }
 
 func (r *Repo) lsMeta() (metaFiles, error) {
@@ -555,3 +1057,8 @@ func (r *Repo) lsMeta() (metaFiles, error) {
 	}
 	return newMetafiles(path.Join(r.LocalPath, "repodata", "repomd.xml"))
 }
+
+// metaPath returns the path of the local metadata file m in repodata.
+func (r *Repo) metaPath(m metaFile) string {
+	return path.Join(r.LocalPath, "repodata", m.name)
+}
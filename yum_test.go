@@ -30,7 +30,7 @@ func TestDownload(t *testing.T) {
 	checksum := "b5b9f746d4e1a95c6ee8f5da381dd6bc339f1dc1e018c06c2b4f0b3c3446f558"
 	checksumType := "sha256"
 	r := NewRepo("/tmp", "", nil)
-	if _, err := r.download(url, dest, checksum, checksumType); err != nil {
+	if _, _, err := r.download(url, dest, checksum, checksumType); err != nil {
 		t.Error(err)
 	}
 }
@@ -53,8 +53,8 @@ func TestSyncFromRepofile(t *testing.T) {
 	}
 	r := repos[0]
 	url := "http://ftp.linux.cz/pub/linux/fedora/linux/releases/22/Server/x86_64/os"
-	if r.RemoteURL != url {
-		t.Errorf("got url %s, should be %s", r.RemoteURL, url)
+	if r.RemoteURLs[0] != url {
+		t.Errorf("got url %s, should be %s", r.RemoteURLs[0], url)
 
 	}
 }